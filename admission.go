@@ -0,0 +1,80 @@
+package httpadapter
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// 服務器資源的上限，超過任何一個上限時拒絕新的 tcp-chain 與 channel，各項 <1 則不限制
+type Admission struct {
+	// 活動的 tcp-chain 數量
+	Chains int
+	// 所有 tcp-chain 上活動的 channel 數量
+	Channels int
+	// 進程的 goroutine 數量
+	Goroutines int
+	// 已經收到但還沒有被 channel 讀取的數據字節數
+	Buffered int64
+	// 拒絕 tcp-chain 時在 hello 中建議客戶端等待多久後重試，<1 則使用 5 秒
+	RetryAfter time.Duration
+}
+
+const defaultRetryAfter = time.Second * 5
+
+// 服務器運行時的資源統計
+type admission struct {
+	limit Admission
+	// 活動的 tcp-chain
+	chains int64
+	// 活動的 channel
+	channels int64
+	// 還沒有被讀取的數據
+	buffered int64
+}
+
+func newAdmission(limit Admission) *admission {
+	if limit.RetryAfter < 1 {
+		limit.RetryAfter = defaultRetryAfter
+	}
+	return &admission{
+		limit: limit,
+	}
+}
+
+// 返回進程級別的資源是否超過上限
+func (a *admission) pressure() bool {
+	if a.limit.Buffered > 0 && atomic.LoadInt64(&a.buffered) >= a.limit.Buffered {
+		return true
+	}
+	if a.limit.Goroutines > 0 && runtime.NumGoroutine() >= a.limit.Goroutines {
+		return true
+	}
+	return false
+}
+
+// 爲新的 tcp-chain 佔用一個名額，成功時調用者需要在 tcp-chain 結束後調用 releaseChain
+func (a *admission) acquireChain() bool {
+	return a.acquire(&a.chains, a.limit.Chains)
+}
+func (a *admission) releaseChain() {
+	atomic.AddInt64(&a.chains, -1)
+}
+
+// 爲新的 channel 佔用一個名額，成功時調用者需要在 channel 結束後調用 releaseChannel
+func (a *admission) acquireChannel() bool {
+	return a.acquire(&a.channels, a.limit.Channels)
+}
+func (a *admission) releaseChannel() {
+	atomic.AddInt64(&a.channels, -1)
+}
+
+// 先增加計數再檢查上限，超過則撤銷，保證併發的請求不會同時通過檢查而超過上限
+func (a *admission) acquire(count *int64, limit int) bool {
+	n := atomic.AddInt64(count, 1)
+	if (limit > 0 && n > int64(limit)) || a.pressure() {
+		atomic.AddInt64(count, -1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package httpadapter
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 帶寬限制的速率設定，單位是每秒字節數，<1 則不限制，可以在運行時修改
+type bandwidthRate struct {
+	rate int64
+}
+
+func (r *bandwidthRate) load() int64 {
+	return atomic.LoadInt64(&r.rate)
+}
+func (r *bandwidthRate) store(rate int) {
+	if rate < 1 {
+		rate = 0
+	}
+	atomic.StoreInt64(&r.rate, int64(rate))
+}
+
+// 限制傳輸字節數的令牌桶，速率讀取自共享的 bandwidthRate 以便運行時調整
+//
+// 桶的容量是一秒的流量，取出超過桶中令牌的數據會產生欠款，之後的傳輸需要等待欠款被補充
+type bandwidth struct {
+	rate *bandwidthRate
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidth(rate *bandwidthRate) *bandwidth {
+	return &bandwidth{
+		rate: rate,
+	}
+}
+
+// 取出 n 字節的令牌，返回需要等待的時間
+func (b *bandwidth) reserve(n int) (wait time.Duration) {
+	rate := b.rate.load()
+	now := time.Now()
+	b.Lock()
+	if rate < 1 {
+		// 不限制時清除狀態，以便重新啓用時從滿桶開始
+		b.last = time.Time{}
+		b.Unlock()
+		return
+	}
+	burst := float64(rate)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * burst
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / burst * float64(time.Second))
+	}
+	b.Unlock()
+	return
+}
+
+// 等待一段時間，如果 done0 或 done1 先結束則返回 false
+func sleep(done0, done1 <-chan struct{}, wait time.Duration) bool {
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	select {
+	case <-timer.C:
+		return true
+	case <-done0:
+	case <-done1:
+	}
+	if !timer.Stop() {
+		<-timer.C
+	}
+	return false
+}
+
+// 服務器或客戶端的帶寬設定
+type bandwidthLimits struct {
+	// 每個 channel 寫入數據的速率
+	channel bandwidthRate
+	// 每個 tcp-chain 寫入數據的速率
+	chain bandwidthRate
+	// 所有 tcp-chain 寫入數據的總速率
+	all bandwidthRate
+	// 所有 tcp-chain 共享的令牌桶
+	shared *bandwidth
+}
+
+func newBandwidthLimits(channel, chain, all int) *bandwidthLimits {
+	l := &bandwidthLimits{}
+	l.channel.store(channel)
+	l.chain.store(chain)
+	l.all.store(all)
+	l.shared = newBandwidth(&l.all)
+	return l
+}
+func (l *bandwidthLimits) set(channel, chain, all int) {
+	l.channel.store(channel)
+	l.chain.store(chain)
+	l.all.store(all)
+}
+func (l *bandwidthLimits) get() (channel, chain, all int) {
+	return int(l.channel.load()), int(l.chain.load()), int(l.all.load())
+}
+
+// 返回 tcp-chain 使用的帶寬限制
+func (l *bandwidthLimits) newChain() *chainBandwidth {
+	return &chainBandwidth{
+		limits: l,
+		chain:  newBandwidth(&l.chain),
+	}
+}
+
+// tcp-chain 的帶寬限制
+type chainBandwidth struct {
+	limits *bandwidthLimits
+	chain  *bandwidth
+}
+
+// 返回新 channel 使用的帶寬限制
+func (b *chainBandwidth) newChannel() *channelBandwidth {
+	if b == nil {
+		return nil
+	}
+	return &channelBandwidth{
+		chain:   b,
+		channel: newBandwidth(&b.limits.channel),
+	}
+}
+
+// channel 的帶寬限制，在寫入指令進入 tcp-chain 的發送隊列前等待，
+// 所以等待只會阻塞當前 channel 而不會延遲 ping 與確認等控制指令以及其它 channel
+type channelBandwidth struct {
+	chain   *chainBandwidth
+	channel *bandwidth
+}
+
+// 等待可以傳輸 n 字節，如果 done0 或 done1 先結束則返回 false
+func (b *channelBandwidth) wait(done0, done1 <-chan struct{}, n int) bool {
+	if b == nil {
+		return true
+	}
+	wait := b.channel.reserve(n)
+	if chain := b.chain.chain.reserve(n); chain > wait {
+		wait = chain
+	}
+	if shared := b.chain.limits.shared.reserve(n); shared > wait {
+		wait = shared
+	}
+	return sleep(done0, done1, wait)
+}
@@ -23,6 +23,10 @@ type baseTransport struct {
 
 	// 數據寫入通道
 	ch chan []byte
+	// 如果爲 true 每個指令都以帶有 crc32c 校驗的幀傳輸
+	checksum bool
+	// 帶寬限制，nil 則不限制
+	bandwidth *chainBandwidth
 }
 
 // 關閉傳輸層 此後所有關聯的資源都應該關閉和釋放
@@ -67,6 +71,33 @@ func (t *baseTransport) servePing(active <-chan int, duration time.Duration) {
 	}
 }
 
+// 沒有 channel 的時間超過 timeout 時關閉 tcp-chain，channels 返回當前的 channel 數量
+//
+// 每隔 timeout/4 檢查一次，所以實際關閉的時間可能比 timeout 稍晚
+func (t *baseTransport) serveIdle(timeout time.Duration, channels func() int) {
+	interval := timeout / 4
+	if interval < time.Millisecond*10 {
+		interval = time.Millisecond * 10
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	idle := time.Now()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			if channels() != 0 {
+				idle = now
+			} else if now.Sub(idle) >= timeout {
+				Logger.Printf("tcp-chain(%v) idle timeout\n", t.c.RemoteAddr())
+				t.Close()
+				return
+			}
+		}
+	}
+}
+
 // 合併數據並寫入到 tcp
 func (t *baseTransport) serveWrite(active chan<- int, size int) {
 	defer t.c.Close()
@@ -75,11 +106,15 @@ func (t *baseTransport) serveWrite(active chan<- int, size int) {
 		w  io.Writer = t.c
 		wf *bufio.Writer
 		e  error
+		fw *frameWriter
 	)
 	if size > 0 {
 		wf = bufio.NewWriterSize(w, size)
 		w = wf
 	}
+	if t.checksum {
+		fw = &frameWriter{}
+	}
 	for {
 		if active != nil {
 			select {
@@ -91,7 +126,7 @@ func (t *baseTransport) serveWrite(active chan<- int, size int) {
 		// 讀取待寫入數據
 		select {
 		case b = <-t.ch:
-			_, e = w.Write(b)
+			e = t.write(w, fw, b)
 			if e != nil {
 				return
 			}
@@ -104,7 +139,7 @@ func (t *baseTransport) serveWrite(active chan<- int, size int) {
 		for {
 			select {
 			case b = <-t.ch:
-				_, e = w.Write(b)
+				e = t.write(w, fw, b)
 				if e != nil {
 					return
 				}
@@ -124,6 +159,16 @@ func (t *baseTransport) serveWrite(active chan<- int, size int) {
 	}
 }
 
+// 寫入一個指令，如果 fw 不爲 nil 則寫入爲幀
+func (t *baseTransport) write(w io.Writer, fw *frameWriter, b []byte) (e error) {
+	if fw == nil {
+		_, e = w.Write(b)
+	} else {
+		e = fw.write(w, b)
+	}
+	return
+}
+
 // 響應 pong 指令
 func (t *baseTransport) onPong(r io.Reader, buf []byte) (exit bool) {
 	_, e := io.ReadFull(r, buf[1:5])
@@ -2,8 +2,10 @@ package httpadapter
 
 import (
 	"context"
+	"errors"
 	"math"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,6 +13,16 @@ import (
 	"github.com/powerpuffpenguin/httpadapter/pipe"
 )
 
+// 重置 channel 的原因只會返回給執行重置的一方，close 指令不攜帶原因，對端只會看到普通的關閉
+var (
+	// channel 在兩個方向都沒有數據流動超過了空閒超時
+	ErrChannelIdle = errors.New("httpadapter: Channel idle timeout")
+	// channel 超過了最大生存時間
+	ErrChannelLifetime = errors.New("httpadapter: Channel lifetime exceeded")
+	// 一元請求沒有在限制的時間內完成
+	ErrUnaryTimeout = errors.New("httpadapter: Unary timeout")
+)
+
 type ioTransport interface {
 	delete(c *ioChannel)
 	Done() <-chan struct{}
@@ -47,6 +59,23 @@ type ioChannel struct {
 	readDeadline atomic.Value
 	// 寫入截止時間
 	writeDeadline atomic.Value
+	// 帶寬限制，nil 則不限制
+	bandwidth *channelBandwidth
+	// 如果不爲 nil，pipe 中還沒有被讀取的數據會被計入此統計
+	buffered *int64
+	// 此 channel 計入 buffered 的數據
+	pending int64
+
+	// 最後一次收發數據的時間
+	active int64
+	// 創建時間與生存時間的截止時間，截止時間爲 0 表示不限制
+	created  int64
+	lifetime int64
+	// 重置 channel 的原因，設置後讀寫會返回此錯誤
+	reason atomic.Value
+	// 關閉時需要停止的定時器
+	timerLocker sync.Mutex
+	timers      []*time.Timer
 }
 
 func newIOChannel(transport ioTransport,
@@ -55,6 +84,7 @@ func newIOChannel(transport ioTransport,
 	window, remoteWindow int,
 ) *ioChannel {
 	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now().UnixNano()
 	return &ioChannel{
 		transport:    transport,
 		id:           id,
@@ -67,6 +97,8 @@ func newIOChannel(transport ioTransport,
 		remoteWindow: uint64(remoteWindow),
 		confirm:      make(chan uint64, 1),
 		sendConfirm:  make(chan int, 10),
+		active:       now,
+		created:      now,
 	}
 }
 
@@ -78,6 +110,13 @@ func (c *ioChannel) Close() (e error) {
 	if c.closed == 0 && atomic.SwapInt32(&c.closed, 1) == 0 {
 		c.cancel()
 		c.pipe.Close()
+		c.unbuffer(math.MaxInt64)
+		c.timerLocker.Lock()
+		for _, timer := range c.timers {
+			timer.Stop()
+		}
+		c.timers = nil
+		c.timerLocker.Unlock()
 	} else {
 		e = ErrChannelClosed
 	}
@@ -95,6 +134,7 @@ func (c *ioChannel) RemoteAddr() net.Addr {
 func (c *ioChannel) SetDeadline(t time.Time) (e error) {
 	if c.closed == 0 && atomic.LoadInt32(&c.closed) == 0 {
 		c.deadline.Store(t)
+		c.pipe.SetReadDeadline(minDeadline(t, c.loadDeadline(&c.readDeadline)))
 	} else {
 		e = ErrChannelClosed
 	}
@@ -104,6 +144,7 @@ func (c *ioChannel) SetDeadline(t time.Time) (e error) {
 func (c *ioChannel) SetReadDeadline(t time.Time) (e error) {
 	if c.closed == 0 && atomic.LoadInt32(&c.closed) == 0 {
 		c.readDeadline.Store(t)
+		c.pipe.SetReadDeadline(minDeadline(t, c.loadDeadline(&c.deadline)))
 	} else {
 		e = ErrChannelClosed
 	}
@@ -170,12 +211,16 @@ IOS:
 			core.ByteOrder.PutUint64(data[1:], c.id)
 			core.ByteOrder.PutUint16(data[9:], uint16(size))
 			copy(data[11:], b[:size])
+			if !c.bandwidth.wait(done0, done1, len(data)) {
+				break IOS
+			}
 			select {
 			case <-done0:
 				break IOS
 			case <-done1:
 				break IOS
 			case ch <- data:
+				atomic.StoreInt64(&c.active, time.Now().UnixNano())
 				writed += size
 				b = b[size:]
 				size = uint64(len(b))
@@ -219,19 +264,22 @@ func (c *ioChannel) choose(b []byte, writed uint64) (data []byte, confirm uint64
 	}
 	return
 }
-func (c *ioChannel) Write(b []byte) (n int, e error) {
-	var deadline time.Time
-	v := c.deadline.Load()
-	if v != nil {
-		deadline = v.(time.Time)
+func (c *ioChannel) loadDeadline(v *atomic.Value) (t time.Time) {
+	if val := v.Load(); val != nil {
+		t = val.(time.Time)
 	}
-	v = c.writeDeadline.Load()
-	if v != nil {
-		d := v.(time.Time)
-		if d.Before(deadline) {
-			deadline = d
-		}
+	return
+}
+
+// 返回較早的截止時間，零值表示沒有截止時間
+func minDeadline(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
 	}
+	return a
+}
+func (c *ioChannel) Write(b []byte) (n int, e error) {
+	deadline := minDeadline(c.loadDeadline(&c.deadline), c.loadDeadline(&c.writeDeadline))
 	var timer *time.Timer
 	if !deadline.IsZero() {
 		now := time.Now()
@@ -275,6 +323,9 @@ func (c *ioChannel) Write(b []byte) (n int, e error) {
 			e = context.DeadlineExceeded
 		}
 	}
+	if e == ErrChannelClosed {
+		e = c.resetError(e)
+	}
 	return
 }
 
@@ -371,7 +422,11 @@ func (c *ioChannel) serveConfirm() {
 
 func (c *ioChannel) Read(b []byte) (n int, e error) {
 	n, e = c.pipe.Read(b)
+	if e != nil {
+		e = c.resetError(e)
+	}
 	if n != 0 {
+		c.unbuffer(int64(n))
 		select {
 		case c.sendConfirm <- n:
 		case <-c.ctx.Done():
@@ -385,5 +440,127 @@ func (c *ioChannel) Pipe(b []byte) {
 	_, e := c.pipe.Write(b)
 	if e != nil { // pipe 錯誤關閉 channel
 		c.Close()
+		return
+	}
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	if c.buffered != nil {
+		atomic.AddInt64(&c.pending, int64(len(b)))
+		atomic.AddInt64(c.buffered, int64(len(b)))
+		if atomic.LoadInt32(&c.closed) != 0 {
+			// 關閉後 pipe 中的數據不會再被計數
+			c.unbuffer(math.MaxInt64)
+		}
+	}
+}
+
+// 從 buffered 中減去已經被讀取或丟棄的數據
+func (c *ioChannel) unbuffer(n int64) {
+	if c.buffered == nil {
+		return
+	}
+	for {
+		pending := atomic.LoadInt64(&c.pending)
+		if pending == 0 {
+			return
+		}
+		if n > pending {
+			n = pending
+		}
+		if atomic.CompareAndSwapInt64(&c.pending, pending, pending-n) {
+			atomic.AddInt64(c.buffered, -n)
+			return
+		}
+	}
+}
+
+// 以 reason 重置 channel，之後的讀寫都會返回 reason
+func (c *ioChannel) reset(reason error) {
+	if atomic.LoadInt32(&c.closed) != 0 || !c.reason.CompareAndSwap(nil, reason) {
+		return
+	}
+	Logger.Printf("channel(%v) reset: %v\n", c.id, reason)
+	c.Close()
+}
+
+// 如果 channel 被重置返回重置原因，否則返回 e
+func (c *ioChannel) resetError(e error) error {
+	if reason := c.reason.Load(); reason != nil {
+		return reason.(error)
+	}
+	return e
+}
+
+// 添加一個定時器，f 返回的值不爲 0 時會在此時間後再次調用 f，channel 關閉時會停止定時器
+func (c *ioChannel) addTimer(d time.Duration, f func() time.Duration) {
+	c.timerLocker.Lock()
+	defer c.timerLocker.Unlock()
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		next := f()
+		if next <= 0 {
+			return
+		}
+		c.timerLocker.Lock()
+		if atomic.LoadInt32(&c.closed) == 0 {
+			timer.Reset(next)
+		}
+		c.timerLocker.Unlock()
+	})
+	c.timers = append(c.timers, timer)
+}
+
+// 在 d 之後以 reason 重置 channel，d <= 0 則不限制
+func (c *ioChannel) resetAfter(d time.Duration, reason error) {
+	if d <= 0 {
+		return
+	}
+	c.addTimer(d, func() time.Duration {
+		c.reset(reason)
+		return 0
+	})
+}
+
+// 設置 channel 從創建開始最長可以存在多久，之後以 ErrChannelLifetime 重置 channel，<= 0 則不限制
+//
+// 可以多次調用，後設置的值會覆蓋之前的設置
+func (c *ioChannel) setLifetime(lifetime time.Duration) {
+	var deadline int64
+	if lifetime > 0 {
+		deadline = c.created + int64(lifetime)
+	}
+	old := atomic.SwapInt64(&c.lifetime, deadline)
+	if deadline == 0 || (old != 0 && old <= deadline) {
+		// 已有的定時器會在觸發時讀取新的截止時間
+		return
 	}
+	c.addTimer(time.Until(time.Unix(0, deadline)), func() time.Duration {
+		deadline := atomic.LoadInt64(&c.lifetime)
+		if deadline == 0 {
+			return 0
+		}
+		wait := time.Until(time.Unix(0, deadline))
+		if wait <= 0 {
+			c.reset(ErrChannelLifetime)
+			return 0
+		}
+		return wait
+	})
+}
+
+// 兩個方向都沒有數據流動超過 timeout 時以 ErrChannelIdle 重置 channel，timeout <= 0 則不限制
+func (c *ioChannel) resetIdle(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	c.addTimer(timeout, func() time.Duration {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.active)))
+		if idle >= timeout {
+			c.reset(ErrChannelIdle)
+			return 0
+		}
+		return timeout - idle
+	})
 }
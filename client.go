@@ -3,14 +3,20 @@ package httpadapter
 import (
 	"context"
 	"errors"
+	"io"
 	"math"
 	"net"
+	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 var ErrClientClosed = errors.New("httpadapter: Client closed")
 
+// NewClientFromConn 創建的客戶端，其數據流已經被使用過
+var ErrClientConnUsed = errors.New("httpadapter: Client conn already used")
+
 type getClientTransport struct {
 	Error     error
 	Transport *clientTransport
@@ -22,6 +28,8 @@ type Client struct {
 	closed  int32
 	ch      chan chan getClientTransport
 	remove  chan *clientTransport
+	// 帶寬限制
+	bandwidth *bandwidthLimits
 }
 
 func NewClient(address string, opt ...ClientOption) (client *Client) {
@@ -35,10 +43,59 @@ func NewClient(address string, opt ...ClientOption) (client *Client) {
 		done:    make(chan struct{}),
 		ch:      make(chan chan getClientTransport),
 		remove:  make(chan *clientTransport),
+		bandwidth: newBandwidthLimits(opts.channelBandwidth,
+			opts.chainBandwidth,
+			0,
+		),
 	}
 	go client.serve()
 	return
 }
+
+// 在已經建立的數據流上創建客戶端，例如 stdio、管道或串口，rwc 會在客戶端關閉時被關閉
+//
+// 數據流只能承載一個 tcp-chain，它斷開後客戶端不會重連，之後創建 channel 都會返回錯誤。
+// opt 中的 WithDialer 會被忽略
+func NewClientFromConn(rwc io.ReadWriteCloser, opt ...ClientOption) (client *Client) {
+	dialer := &connDialer{
+		c: newRWCConn(rwc),
+	}
+	opt = append(opt, WithDialer(dialer))
+	client = NewClient(``, opt...)
+	go func() {
+		<-client.done
+		dialer.Close()
+	}()
+	return
+}
+
+// 只會返回一次連接的 ClientDialer
+type connDialer struct {
+	c      net.Conn
+	locker sync.Mutex
+}
+
+func (d *connDialer) Dial(network, address string) (c net.Conn, e error) {
+	d.locker.Lock()
+	c = d.c
+	d.c = nil
+	d.locker.Unlock()
+	if c == nil {
+		e = ErrClientConnUsed
+	}
+	return
+}
+
+// 關閉還沒有被使用的連接
+func (d *connDialer) Close() {
+	d.locker.Lock()
+	c := d.c
+	d.c = nil
+	d.locker.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
 func (c *Client) Close() (e error) {
 	if c.closed == 0 && atomic.SwapInt32(&c.closed, 1) == 0 {
 		close(c.done)
@@ -94,6 +151,7 @@ func (c *Client) newTransport() (t *clientTransport, e error) {
 		conn.Close()
 		return
 	}
+	t.bandwidth = c.bandwidth.newChain()
 	go t.Serve(buf)
 	return
 }
@@ -102,6 +160,9 @@ func (c *Client) serve() {
 		keys = make(map[*clientTransport]bool)
 		t    *clientTransport
 		e    error
+		// 服務器拒絕 tcp-chain 時的退避狀態
+		busy  backoff
+		busyE *BusyError
 	)
 CS:
 	for {
@@ -120,13 +181,21 @@ CS:
 				}
 			}
 			if t == nil {
-				t, e = c.newTransport()
+				e = busy.check()
+				if e == nil {
+					t, e = c.newTransport()
+					if errors.As(e, &busyE) {
+						// 服務器繁忙，按照提示退避
+						busyE.RetryAfter = busy.busy(busyE.RetryAfter)
+					}
+				}
 				if e != nil {
 					ch <- getClientTransport{
 						Error: e,
 					}
 					continue CS
 				}
+				busy.reset()
 				keys[t] = true
 			}
 			ch <- getClientTransport{
@@ -170,3 +239,57 @@ func (c *Client) Ping() time.Duration {
 func (c *Client) Dialer() ClientDialer {
 	return c.opts.dialer
 }
+
+// 返回客戶端支持的響應壓縮編碼
+func (c *Client) Encoding() []string {
+	return c.opts.encoding
+}
+
+// 返回客戶端是否請求 crc32c 校驗
+func (c *Client) Checksum() bool {
+	return c.opts.checksum
+}
+
+// 返回客戶端發送數據的帶寬限制，單位是每秒字節數，<1 則不限制
+func (c *Client) Bandwidth() (channel, chain int) {
+	channel, chain, _ = c.bandwidth.get()
+	return
+}
+
+// 在運行時調整客戶端發送數據的帶寬限制，對已經存在的 channel 與 tcp-chain 也會生效，<1 則不限制
+func (c *Client) SetBandwidth(channel, chain int) {
+	c.bandwidth.set(channel, chain, 0)
+}
+
+// 返回 tcp-chain 上沒有任何 channel 多久後關閉 tcp-chain，<1 則不限制
+func (c *Client) ChainIdleTimeout() time.Duration {
+	return c.opts.chainIdleTimeout
+}
+
+// 返回 channel 在兩個方向都沒有數據流動多久後被重置，<1 則不限制
+func (c *Client) ChannelIdleTimeout() time.Duration {
+	return c.opts.channelIdleTimeout
+}
+
+// 返回請求 scheme 的 channel 最長可以存在多久，<1 則不限制
+func (c *Client) ChannelLifetime(scheme string) time.Duration {
+	return c.opts.lifetimes[scheme]
+}
+
+// 返回 Unary 的最長時間，<1 則不限制
+func (c *Client) UnaryTimeout() time.Duration {
+	return c.opts.unaryTimeout
+}
+
+// 按照請求的 scheme 設置 channel 的生存時間
+func (c *Client) setLifetime(conn net.Conn, rawURL string) {
+	channel, ok := conn.(*ioChannel)
+	if !ok || len(c.opts.lifetimes) == 0 {
+		return
+	}
+	if u, e := url.Parse(rawURL); e == nil {
+		if lifetime, ok := c.opts.lifetimes[u.Scheme]; ok {
+			channel.setLifetime(lifetime)
+		}
+	}
+}
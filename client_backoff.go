@@ -0,0 +1,61 @@
+package httpadapter
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Second * 30
+)
+
+// 服務器繁忙時的退避狀態，退避期間客戶端不會再打擾服務器而是直接返回 BusyError
+//
+// 服務器給出重試提示時按照提示等待，否則從 1 秒開始每次加倍直到 30 秒
+type backoff struct {
+	sync.Mutex
+	until time.Time
+	delay time.Duration
+}
+
+// 如果正在退避返回 BusyError
+func (b *backoff) check() (e error) {
+	b.Lock()
+	if !b.until.IsZero() {
+		if wait := time.Until(b.until); wait > 0 {
+			e = &BusyError{
+				RetryAfter: wait,
+			}
+		}
+	}
+	b.Unlock()
+	return
+}
+
+// 記錄服務器繁忙，返回需要退避的時間
+func (b *backoff) busy(retryAfter time.Duration) time.Duration {
+	b.Lock()
+	if retryAfter <= 0 {
+		if b.delay < minBackoff {
+			b.delay = minBackoff
+		} else if b.delay < maxBackoff {
+			b.delay *= 2
+			if b.delay > maxBackoff {
+				b.delay = maxBackoff
+			}
+		}
+		retryAfter = b.delay
+	}
+	b.until = time.Now().Add(retryAfter)
+	b.Unlock()
+	return retryAfter
+}
+
+// 服務器恢復正常後清除退避狀態
+func (b *backoff) reset() {
+	b.Lock()
+	b.until = time.Time{}
+	b.delay = 0
+	b.Unlock()
+}
@@ -0,0 +1,100 @@
+package httpadapter
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+var (
+	// 服務器認爲請求的元信息無效
+	ErrBadRequest = errors.New("httpadapter: bad request")
+	// 請求被服務器的轉發策略拒絕
+	ErrRejectedByPolicy = errors.New("httpadapter: rejected by policy")
+	// 服務器不支持請求的 scheme/method/mode
+	ErrUnsupported = errors.New("httpadapter: unsupported")
+	// 請求 body 超過了服務器限制
+	ErrBodyTooLarge = errors.New("httpadapter: body too large")
+	// 服務器無法連接上游
+	ErrUpstreamUnreachable = errors.New("httpadapter: upstream unreachable")
+	// 上游的響應無法被轉發
+	ErrUpstreamError = errors.New("httpadapter: upstream error")
+	// 超過了服務器的請求速率或流量配額
+	ErrRateLimited = errors.New("httpadapter: rate limited")
+	// 服務器資源不足，拒絕了 tcp-chain 或 channel
+	ErrServerBusy = errors.New("httpadapter: server busy")
+	// 上游沒有在服務器限制的時間內響應
+	ErrTimeout = errors.New("httpadapter: timeout")
+)
+
+// 服務器繁忙時返回的錯誤，可以使用 errors.Is 與 ErrServerBusy 比較
+//
+// 客戶端會在 RetryAfter 內自動退避，期間創建 channel 都會直接返回此錯誤而不連接服務器
+type BusyError struct {
+	// 建議等待多久後重試
+	RetryAfter time.Duration
+	// 服務器返回的描述
+	Message string
+}
+
+func (e *BusyError) Error() string {
+	s := `httpadapter: server busy, retry after ` + e.RetryAfter.String()
+	if e.Message != `` {
+		s += `: ` + e.Message
+	}
+	return s
+}
+func (e *BusyError) Unwrap() error {
+	return ErrServerBusy
+}
+
+// 服務器中轉層返回的錯誤，它與上游返回的 http 錯誤不同，表示請求沒有被轉發或轉發失敗
+//
+// 可以使用 errors.Is 與 ErrRejectedByPolicy 等錯誤比較
+type ForwardError struct {
+	// 服務器返回的 http 響應碼
+	Status int
+	// 錯誤代碼
+	Code core.ErrorCode
+	// 錯誤描述
+	Message string
+	// 可選的錯誤詳情
+	Details map[string]string
+}
+
+func newForwardError(status int, err *core.Error) *ForwardError {
+	return &ForwardError{
+		Status:  status,
+		Code:    err.Code,
+		Message: err.Message,
+		Details: err.Details,
+	}
+}
+func (e *ForwardError) Error() string {
+	return `httpadapter: ` + e.Code.String() + ` (` + strconv.Itoa(e.Status) + `): ` + e.Message
+}
+
+// 返回錯誤代碼對應的預定義錯誤
+func (e *ForwardError) Unwrap() error {
+	switch e.Code {
+	case core.ErrorBadRequest:
+		return ErrBadRequest
+	case core.ErrorRejectedByPolicy:
+		return ErrRejectedByPolicy
+	case core.ErrorUnsupported:
+		return ErrUnsupported
+	case core.ErrorBodyTooLarge:
+		return ErrBodyTooLarge
+	case core.ErrorUpstreamUnreachable:
+		return ErrUpstreamUnreachable
+	case core.ErrorUpstreamError:
+		return ErrUpstreamError
+	case core.ErrorRateLimited:
+		return ErrRateLimited
+	case core.ErrorTimeout:
+		return ErrTimeout
+	}
+	return nil
+}
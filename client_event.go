@@ -0,0 +1,253 @@
+package httpadapter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+	"github.com/powerpuffpenguin/httpadapter/internal/pipe"
+)
+
+var ErrEventSourceClosed = errors.New("httpadapter: EventSource closed")
+
+// Server-Sent Events 中的一個事件
+type Event struct {
+	// 事件 id
+	ID string
+	// 事件類型，如果上游沒有設置則爲空字符串(等同於 message)
+	Event string
+	// 事件數據
+	Data string
+}
+
+// 類似瀏覽器 EventSource 的 Server-Sent Events 客戶端，斷線後會自動攜帶 Last-Event-ID 重連
+type EventSource struct {
+	client *Client
+	url    string
+	header http.Header
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lastEventID string
+	retry       time.Duration
+
+	conn   net.Conn
+	b      []byte
+	closed bool
+	sync.Mutex
+}
+
+// 請求代理訪問一個 Server-Sent Events 服務
+func (c *Client) EventSource(ctx context.Context, u string, header http.Header) (es *EventSource, resp *MessageResponse, e error) {
+	uri, e := url.Parse(u)
+	if e != nil {
+		return
+	} else if uri.Scheme != `http` && uri.Scheme != `https` || uri.Host == `` {
+		e = errors.New(`not support url: ` + u)
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	es = &EventSource{
+		client: c,
+		url:    u,
+		header: header,
+		ctx:    ctx,
+		cancel: cancel,
+		retry:  time.Second * 3,
+		b:      make([]byte, 4),
+	}
+	resp, _, e = es.connect()
+	if e != nil {
+		cancel()
+		es = nil
+		return
+	}
+	// ctx 結束時關閉連接，以便解除阻塞中的 Recv
+	go func() {
+		<-ctx.Done()
+		es.closeConn()
+	}()
+	return
+}
+
+// 關閉事件流，並且不再重連
+func (es *EventSource) Close() (e error) {
+	es.Lock()
+	if es.closed {
+		es.Unlock()
+		e = ErrEventSourceClosed
+		return
+	}
+	es.closed = true
+	es.Unlock()
+
+	es.cancel()
+	es.closeConn()
+	return
+}
+func (es *EventSource) closeConn() {
+	es.Lock()
+	conn := es.conn
+	es.conn = nil
+	es.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// 返回最後收到的事件 id
+func (es *EventSource) LastEventID() (id string) {
+	es.Lock()
+	id = es.lastEventID
+	es.Unlock()
+	return
+}
+
+// 返回當前的重連等待時間
+func (es *EventSource) Retry() (retry time.Duration) {
+	es.Lock()
+	retry = es.retry
+	es.Unlock()
+	return
+}
+
+func (es *EventSource) connect() (resp *MessageResponse, fatal bool, e error) {
+	header := make(http.Header, len(es.header)+1)
+	for k, v := range es.header {
+		header[k] = v
+	}
+	if id := es.LastEventID(); id != `` {
+		header.Set(`Last-Event-ID`, id)
+	}
+	cc, resp, e := es.client.unary(es.ctx, nil, 0, &core.ClientMetadata{
+		URL:    es.url,
+		Method: http.MethodGet,
+		Header: header,
+		Mode:   core.ModeEvent,
+	})
+	if e != nil {
+		// 無法連接上游時等待重連，其它被服務器拒絕的請求不再重連
+		fatal = !errors.Is(e, ErrUpstreamUnreachable) &&
+			!errors.Is(e, ErrUpstreamError) &&
+			errors.As(e, new(*ForwardError))
+		return
+	} else if resp.Status != http.StatusOK || !isEventStream(resp.Header.Get(`Content-Type`)) {
+		defer cc.Close()
+		fatal = true
+		buffer := make([]byte, 256)
+		var n int
+		n, e = pipe.ReadAll(resp.Body, buffer)
+		if e == nil {
+			if n == 0 {
+				e = errors.New(`event stream error: status=` + strconv.Itoa(resp.Status))
+			} else {
+				e = errors.New(string(buffer[:n]))
+			}
+		}
+		return
+	}
+	es.Lock()
+	if es.ctx.Err() == nil {
+		es.conn = cc
+	} else {
+		cc.Close()
+		e = ErrEventSourceClosed
+	}
+	es.Unlock()
+	return
+}
+
+// 返回下一個事件，連接斷開時會等待重連時間後自動重連，not goroutine safe
+func (es *EventSource) Recv() (event *Event, e error) {
+	for {
+		es.Lock()
+		conn := es.conn
+		es.Unlock()
+		if conn == nil {
+			// 等待重連
+			timer := time.NewTimer(es.Retry())
+			select {
+			case <-es.ctx.Done():
+				if !timer.Stop() {
+					<-timer.C
+				}
+				e = ErrEventSourceClosed
+				return
+			case <-timer.C:
+			}
+			var fatal bool
+			_, fatal, e = es.connect()
+			if e != nil {
+				if fatal || es.ctx.Err() != nil {
+					return
+				}
+				e = nil
+			}
+			continue
+		}
+
+		var val core.Event
+		e = es.read(conn, &val)
+		if e != nil {
+			es.Lock()
+			if es.conn == conn {
+				es.conn = nil
+			}
+			es.Unlock()
+			conn.Close()
+			if es.ctx.Err() != nil {
+				e = ErrEventSourceClosed
+				return
+			}
+			e = nil
+			continue
+		}
+		es.Lock()
+		if val.Retry > 0 {
+			es.retry = time.Duration(val.Retry) * time.Millisecond
+		}
+		if val.HasID {
+			es.lastEventID = val.ID
+		}
+		id := es.lastEventID
+		es.Unlock()
+		if val.HasData {
+			event = &Event{
+				ID:    id,
+				Event: val.Event,
+				Data:  val.Data,
+			}
+			return
+		}
+	}
+}
+func (es *EventSource) read(conn net.Conn, event *core.Event) (e error) {
+	_, e = io.ReadFull(conn, es.b[:4])
+	if e != nil {
+		return
+	}
+	size := core.ByteOrder.Uint32(es.b)
+	if size > core.MaxEventSize {
+		e = errors.New(`event too large`)
+		return
+	}
+	if cap(es.b) < int(size) {
+		es.b = make([]byte, size)
+	}
+	b := es.b[:size]
+	_, e = io.ReadFull(conn, b)
+	if e != nil {
+		return
+	}
+	e = json.Unmarshal(b, event)
+	return
+}
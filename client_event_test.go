@@ -0,0 +1,155 @@
+package httpadapter_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/httpadapter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientEventSource(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/sse`, func(w http.ResponseWriter, r *http.Request) {
+		start := 0
+		if s := r.Header.Get(`Last-Event-ID`); s != `` {
+			start, _ = strconv.Atoi(s)
+		}
+		w.Header().Set(`Content-Type`, `text/event-stream`)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": comment\nretry: 10\n\n")
+		for i := start + 1; i <= start+2; i++ {
+			fmt.Fprintf(w, "id: %d\nevent: count\ndata: line %d\ndata: end\n\n", i, i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc(`/text`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`not event`))
+	})
+
+	s := newServer(t,
+		httpadapter.ServerWindow(4),
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	es, resp, e := client.EventSource(context.Background(), BaseURL+`/sse`, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer es.Close()
+	if !assert.Equal(t, http.StatusOK, resp.Status) {
+		t.FailNow()
+	}
+	for i := 1; i <= 6; i++ {
+		event, e := es.Recv()
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, strconv.Itoa(i), event.ID) ||
+			!assert.Equal(t, `count`, event.Event) ||
+			!assert.Equal(t, fmt.Sprintf("line %d\nend", i), event.Data) {
+			t.FailNow()
+		}
+	}
+
+	_, _, e = client.EventSource(context.Background(), BaseURL+`/text`, nil)
+	if !assert.NotNil(t, e) {
+		t.FailNow()
+	}
+}
+func TestClientEventSourceCancel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/sse`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/event-stream`)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// 不發送事件，讓 Recv 一直阻塞
+		<-r.Context().Done()
+	})
+
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	es, _, e := client.EventSource(ctx, BaseURL+`/sse`, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	recv := make(chan error, 1)
+	go func() {
+		_, e := es.Recv()
+		recv <- e
+	}()
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	select {
+	case e = <-recv:
+		if !assert.ErrorIs(t, e, httpadapter.ErrEventSourceClosed) {
+			t.FailNow()
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal(`Recv not released by context`)
+	}
+	// ctx 結束後依然需要 Close 一次
+	if !assert.Nil(t, es.Close()) {
+		t.FailNow()
+	}
+	if !assert.ErrorIs(t, es.Close(), httpadapter.ErrEventSourceClosed) {
+		t.FailNow()
+	}
+}
+func TestClientEventSourceLineEndings(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/sse`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/event-stream`)
+		w.WriteHeader(http.StatusOK)
+		// CR、CRLF 與 LF 混合使用
+		fmt.Fprint(w, "id: 1\rdata: a\r\r")
+		fmt.Fprint(w, "id: 2\r\ndata: b\r\n\r\n")
+		fmt.Fprint(w, "id: 3\ndata: c\rdata: d\n\n")
+		// CRLF 被拆分到兩次發送中，LF 不能被當作空行
+		fmt.Fprint(w, "id: 4\r\ndata: e\r")
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Millisecond * 50)
+		fmt.Fprint(w, "\ndata: f\r\n\r\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	es, _, e := client.EventSource(context.Background(), BaseURL+`/sse`, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer es.Close()
+	for i, data := range []string{"a", "b", "c\nd", "e\nf"} {
+		event, e := es.Recv()
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, strconv.Itoa(i+1), event.ID) ||
+			!assert.Equal(t, data, event.Data) {
+			t.FailNow()
+		}
+	}
+}
@@ -23,6 +23,18 @@ type clientOptions struct {
 	ping time.Duration
 
 	dialer ClientDialer
+
+	encoding []string
+
+	checksum bool
+
+	channelBandwidth int
+	chainBandwidth   int
+
+	chainIdleTimeout   time.Duration
+	channelIdleTimeout time.Duration
+	lifetimes          map[string]time.Duration
+	unaryTimeout       time.Duration
 }
 type ClientDialer interface {
 	Dial(network, address string) (net.Conn, error)
@@ -67,3 +79,86 @@ func WithDialer(dialer ClientDialer) ClientOption {
 		opts.dialer = dialer
 	})
 }
+
+// 設置是否請求服務器對 tcp-chain 的每個指令使用 crc32c 校驗，用於可能損壞數據的鏈路，例如串口轉 tcp，
+// 損壞的指令所屬的 channel 會被重置而 tcp-chain 盡量保持可用。服務器不支持時使用普通的傳輸
+func WithChecksum(checksum bool) ClientOption {
+	return option.New(func(opts *clientOptions) {
+		opts.checksum = checksum
+	})
+}
+
+// 設置客戶端發送數據的帶寬限制，單位是每秒字節數，分別限制每個 channel 與每個 tcp-chain，< 1 則不限制，
+// 用於避免批量上傳佔滿設備的上行鏈路
+//
+// 運行時可以使用 Client.SetBandwidth 調整
+func WithBandwidth(channel, chain int) ClientOption {
+	return option.New(func(opts *clientOptions) {
+		opts.channelBandwidth = channel
+		opts.chainBandwidth = chain
+	})
+}
+
+// 設置 tcp-chain 上沒有任何 channel 多久後關閉 tcp-chain，之後創建 channel 時會重新連接，< 1 則不限制
+func WithChainIdleTimeout(timeout time.Duration) ClientOption {
+	return option.New(func(opts *clientOptions) {
+		opts.chainIdleTimeout = timeout
+	})
+}
+
+// 設置 channel 在兩個方向都沒有數據流動多久後被重置，之後的讀寫返回 ErrChannelIdle，< 1 則不限制
+func WithChannelIdleTimeout(timeout time.Duration) ClientOption {
+	return option.New(func(opts *clientOptions) {
+		opts.channelIdleTimeout = timeout
+	})
+}
+
+// 設置請求 scheme(例如 tcp ws http)的 channel 最長可以存在多久，超過後 channel 被重置，
+// 之後的讀寫返回 ErrChannelLifetime，< 1 則不限制，scheme 爲空字符串時設置所有 channel 的默認值
+func WithChannelLifetime(scheme string, lifetime time.Duration) ClientOption {
+	return option.New(func(opts *clientOptions) {
+		lifetimes := make(map[string]time.Duration, len(opts.lifetimes)+1)
+		for k, v := range opts.lifetimes {
+			lifetimes[k] = v
+		}
+		if lifetime > 0 {
+			lifetimes[scheme] = lifetime
+		} else {
+			delete(lifetimes, scheme)
+		}
+		opts.lifetimes = lifetimes
+	})
+}
+
+// 設置 Unary 從發送請求到讀取完響應 body 的最長時間，< 1 則不限制
+//
+// 收到響應前超時 Unary 返回 context.DeadlineExceeded，之後超時讀取 body 返回 ErrUnaryTimeout
+func WithUnaryTimeout(timeout time.Duration) ClientOption {
+	return option.New(func(opts *clientOptions) {
+		opts.unaryTimeout = timeout
+	})
+}
+
+// 設置客戶端支持的響應壓縮編碼，按照優先順序排列，服務器會使用客戶端支持的編碼壓縮一元請求的響應，
+// 客戶端會在 MessageResponse.Body 中自動解壓
+//
+// 支持 zstd gzip deflate，如果不設置則不壓縮
+func WithEncoding(encoding ...string) ClientOption {
+	return option.New(func(opts *clientOptions) {
+		opts.encoding = encoding
+	})
+}
+
+type connectOptions struct {
+	compress string
+}
+type ConnectOption option.Option[connectOptions]
+
+// 要求服務器使用指定的編碼壓縮 tcp/ws 通道的數據流，支持 deflate 與 zstd
+//
+// 每次寫入後都會刷新壓縮數據，所以不會增加交互延遲
+func ConnectCompress(encoding string) ConnectOption {
+	return option.New(func(opts *connectOptions) {
+		opts.compress = encoding
+	})
+}
@@ -0,0 +1,124 @@
+package httpadapter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+var ErrStreamClosed = errors.New("httpadapter: Stream closed")
+
+// 全雙工的 http 流，可以在讀取響應的同時繼續寫入請求 body，適用於 grpc 等基於 http2 的流式接口
+type Stream struct {
+	c net.Conn
+	w *core.ChunkedWriter
+
+	ready chan struct{}
+	resp  *MessageResponse
+	err   error
+
+	done   chan struct{}
+	closed int32
+	sync.Mutex
+}
+
+// 請求代理訪問一個 http 流，ctx 在整個流的生命週期內有效
+func (c *Client) Stream(ctx context.Context, u, method string, header http.Header) (s *Stream, e error) {
+	uri, e := url.Parse(u)
+	if e != nil {
+		return
+	} else if uri.Scheme != `http` && uri.Scheme != `https` || uri.Host == `` {
+		e = errors.New(`not support url: ` + u)
+		return
+	}
+	if method == `` {
+		method = http.MethodPost
+	} else if !core.ValidMethod(method) {
+		e = errors.New(`not support method: ` + method)
+		return
+	}
+	b, e := encodeMessage(&core.ClientMetadata{
+		URL:     u,
+		Method:  method,
+		Header:  header,
+		Mode:    core.ModeStream,
+		Trailer: true,
+	}, core.BodyChunked)
+	if e != nil {
+		return
+	}
+	conn, e := c.DialContext(ctx)
+	if e != nil {
+		return
+	}
+	c.setLifetime(conn, u)
+	_, e = conn.Write(b)
+	if e != nil {
+		conn.Close()
+		return
+	}
+	s = &Stream{
+		c:     conn,
+		w:     core.NewChunkedWriter(conn),
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		s.resp, s.err = readMessage(conn, b)
+		close(s.ready)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	return
+}
+
+// 寫入請求 body
+func (s *Stream) Write(b []byte) (n int, e error) {
+	s.Lock()
+	n, e = s.w.Write(b)
+	s.Unlock()
+	return
+}
+
+// 結束請求 body 的寫入，之後不能再調用 Write
+func (s *Stream) CloseWrite() (e error) {
+	s.Lock()
+	e = s.w.Close()
+	s.Unlock()
+	return
+}
+
+// 等待並返回響應，響應 Body 讀取到 EOF 後 Trailer 會被設置
+func (s *Stream) Response(ctx context.Context) (resp *MessageResponse, e error) {
+	select {
+	case <-ctx.Done():
+		e = ctx.Err()
+	case <-s.done:
+		e = ErrStreamClosed
+	case <-s.ready:
+		resp, e = s.resp, s.err
+	}
+	return
+}
+
+// 關閉流並釋放資源
+func (s *Stream) Close() (e error) {
+	if s.closed == 0 && atomic.SwapInt32(&s.closed, 1) == 0 {
+		close(s.done)
+		e = s.c.Close()
+	} else {
+		e = ErrStreamClosed
+	}
+	return
+}
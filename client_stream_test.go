@@ -0,0 +1,275 @@
+package httpadapter_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/powerpuffpenguin/httpadapter"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+func TestClientStream(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/stream`, func(w http.ResponseWriter, r *http.Request) {
+		b, e := io.ReadAll(r.Body)
+		if e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(`Trailer`, `Grpc-Status`)
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Write([]byte(strings.ToUpper(string(b))))
+		w.(http.Flusher).Flush()
+		w.Header().Set(`Grpc-Status`, `0`)
+	})
+
+	s := newServer(t,
+		httpadapter.ServerWindow(4),
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	ctx := context.Background()
+	stream, e := client.Stream(ctx, BaseURL+`/stream`, http.MethodPost, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer stream.Close()
+	for _, str := range []string{`abc`, `-`, strings.Repeat(`x`, 100)} {
+		_, e = stream.Write([]byte(str))
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+	}
+	e = stream.CloseWrite()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	resp, e := stream.Response(ctx)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, http.StatusOK, resp.Status) || !assert.True(t, resp.Chunked) {
+		t.FailNow()
+	}
+	b, e := io.ReadAll(resp.Body)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `ABC-`+strings.Repeat(`X`, 100), string(b)) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `0`, resp.Trailer.Get(`Grpc-Status`)) {
+		t.FailNow()
+	}
+}
+func TestClientStreamDuplex(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/echo`, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set(`Trailer`, `Echo-Count`)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// 每收到一個 chunk 就立刻返回
+		count := 0
+		b := make([]byte, 1024)
+		for {
+			n, e := r.Body.Read(b)
+			if n != 0 {
+				count++
+				w.Write(b[:n])
+				w.(http.Flusher).Flush()
+			}
+			if e != nil {
+				break
+			}
+		}
+		w.Header().Set(`Echo-Count`, strconv.Itoa(count))
+	})
+
+	// 上游使用 h2c 才能在響應的同時讀取請求 body
+	upstream := newH2CClient()
+	defer upstream.CloseIdleConnections()
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerHookDo(upstream),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	ctx := context.Background()
+	stream, e := client.Stream(ctx, BaseURL+`/echo`, http.MethodPost, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer stream.Close()
+	resp, e := stream.Response(ctx)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, http.StatusOK, resp.Status) {
+		t.FailNow()
+	}
+	// 在 CloseWrite 之前交替寫入請求與讀取響應
+	for i := 0; i < 10; i++ {
+		str := `chunk-` + strconv.Itoa(i)
+		_, e = stream.Write([]byte(str))
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		b := make([]byte, len(str))
+		_, e = io.ReadFull(resp.Body, b)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, str, string(b)) {
+			t.FailNow()
+		}
+	}
+	e = stream.CloseWrite()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	b, e := io.ReadAll(resp.Body)
+	if !assert.Nil(t, e) || !assert.Empty(t, b) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `10`, resp.Trailer.Get(`Echo-Count`)) {
+		t.FailNow()
+	}
+}
+func TestClientStreamBodyLimit(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/read`, func(w http.ResponseWriter, r *http.Request) {
+		b, e := io.ReadAll(r.Body)
+		if e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	})
+	mux.HandleFunc(`/echo`, func(w http.ResponseWriter, r *http.Request) {
+		// 先返回響應頭，之後 body 超過限制只能重置 channel
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		b := make([]byte, 1024)
+		for {
+			n, e := r.Body.Read(b)
+			if n != 0 {
+				w.Write(b[:n])
+				w.(http.Flusher).Flush()
+			}
+			if e != nil {
+				break
+			}
+		}
+	})
+
+	// http/1.1 不支持在響應後繼續讀取請求 body，所以使用 h2c 訪問上游
+	upstream := newH2CClient()
+	defer upstream.CloseIdleConnections()
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerHookDo(upstream),
+		httpadapter.ServerBodyLimit(10),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	ctx := context.Background()
+	// 響應開始前超過限制返回 413
+	stream, e := client.Stream(ctx, BaseURL+`/read`, http.MethodPost, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = stream.Write([]byte(strings.Repeat(`x`, 20)))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	stream.CloseWrite()
+	_, e = stream.Response(ctx)
+	if !assert.ErrorIs(t, e, httpadapter.ErrBodyTooLarge) {
+		t.FailNow()
+	}
+	stream.Close()
+
+	// 沒有超過限制
+	stream, e = client.Stream(ctx, BaseURL+`/read`, http.MethodPost, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = stream.Write([]byte(`0123456789`))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	stream.CloseWrite()
+	resp, e := stream.Response(ctx)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	b, e := io.ReadAll(resp.Body)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `0123456789`, string(b)) {
+		t.FailNow()
+	}
+	stream.Close()
+
+	// 響應開始後超過限制重置 channel
+	stream, e = client.Stream(ctx, BaseURL+`/echo`, http.MethodPost, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer stream.Close()
+	resp, e = stream.Response(ctx)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, http.StatusOK, resp.Status) {
+		t.FailNow()
+	}
+	_, e = stream.Write([]byte(`01234`))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	b = make([]byte, 5)
+	_, e = io.ReadFull(resp.Body, b)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	stream.Write([]byte(strings.Repeat(`x`, 20)))
+	_, e = io.ReadAll(resp.Body)
+	if !assert.NotNil(t, e) {
+		t.FailNow()
+	}
+}
+
+// 返回以 h2c prior knowledge 訪問上游的 http 客戶端
+func newH2CClient() *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+}
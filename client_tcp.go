@@ -12,7 +12,7 @@ import (
 )
 
 // 請求代理訪問一個 tcp/tls
-func (c *Client) Connect(ctx context.Context, u string) (tc net.Conn, resp *MessageResponse, e error) {
+func (c *Client) Connect(ctx context.Context, u string, opt ...ConnectOption) (tc net.Conn, resp *MessageResponse, e error) {
 	uri, e := url.Parse(u)
 	if e != nil {
 		return
@@ -20,8 +20,13 @@ func (c *Client) Connect(ctx context.Context, u string) (tc net.Conn, resp *Mess
 		e = errors.New(`not support url: ` + u)
 		return
 	}
+	var opts connectOptions
+	for _, o := range opt {
+		o.Apply(&opts)
+	}
 	cc, resp, e := c.unary(ctx, nil, 0, &core.ClientMetadata{
-		URL: u,
+		URL:      u,
+		Compress: opts.compress,
 	})
 	if e != nil {
 		return
@@ -38,6 +43,19 @@ func (c *Client) Connect(ctx context.Context, u string) (tc net.Conn, resp *Mess
 		}
 		return
 	}
-	tc = cc
+	tc, e = newStreamConn(cc, resp)
+	return
+}
+
+// 如果服務器確認了壓縮則包裝通道
+func newStreamConn(cc net.Conn, resp *MessageResponse) (c net.Conn, e error) {
+	if resp.Compress == `` {
+		c = cc
+		return
+	}
+	c, e = newCompressConn(cc, resp.Compress)
+	if e != nil {
+		cc.Close()
+	}
 	return
 }
@@ -3,6 +3,7 @@ package httpadapter_test
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -290,3 +291,238 @@ func testClientTCP(t *testing.T, opts ...httpadapter.ClientOption) {
 		t.FailNow()
 	}
 }
+func TestClientTCPCompress(t *testing.T) {
+	var upgrader = websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/ws`, func(w http.ResponseWriter, r *http.Request) {
+		ws, e := upgrader.Upgrade(w, r, nil)
+		if e != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			t, p, e := ws.ReadMessage()
+			if e != nil {
+				break
+			}
+			e = ws.WriteMessage(t, p)
+			if e != nil {
+				break
+			}
+		}
+	})
+	var wait sync.WaitGroup
+	l, e := net.Listen(`tcp`, TCP)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer func() {
+		l.Close()
+		wait.Wait()
+	}()
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				break
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			}(c)
+		}
+	}()
+
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	_, _, e = client.Connect(context.Background(),
+		"tcp://"+TCP,
+		httpadapter.ConnectCompress(`br`),
+	)
+	if !assert.ErrorIs(t, e, httpadapter.ErrUnsupported) {
+		t.FailNow()
+	}
+
+	large := bytes.Repeat([]byte("compress "), 1024*16)
+	for _, encoding := range []string{`deflate`, `zstd`} {
+		c, resp, e := client.Connect(context.Background(),
+			"tcp://"+TCP,
+			httpadapter.ConnectCompress(encoding),
+		)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, encoding, resp.Compress) {
+			t.FailNow()
+		}
+		// 每次寫入都會刷新，所以不需要等待更多數據就能讀取到響應
+		for i := 0; i < 10; i++ {
+			str := []byte(fmt.Sprintf("%s-%v", encoding, i))
+			_, e = c.Write(str)
+			if !assert.Nil(t, e) {
+				t.FailNow()
+			}
+			recv := make([]byte, len(str))
+			_, e = io.ReadFull(c, recv)
+			if !assert.Nil(t, e) {
+				t.FailNow()
+			}
+			if !assert.Equal(t, str, recv) {
+				t.FailNow()
+			}
+		}
+		go c.Write(large)
+		recv := make([]byte, len(large))
+		_, e = io.ReadFull(c, recv)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, large, recv) {
+			t.FailNow()
+		}
+		c.Close()
+
+		ws, resp, e := client.Websocket(context.Background(),
+			BaseWebsocket+`/ws`,
+			nil,
+			httpadapter.ConnectCompress(encoding),
+		)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, encoding, resp.Compress) {
+			t.FailNow()
+		}
+		for i := 0; i < 10; i++ {
+			str := fmt.Sprintf("%s-%v", encoding, i)
+			_, e = ws.WriteText(str)
+			if !assert.Nil(t, e) {
+				t.FailNow()
+			}
+			ty, b, e := ws.ReadMessage()
+			if !assert.Nil(t, e) {
+				t.FailNow()
+			}
+			if !assert.Equal(t, websocket.TextMessage, ty) {
+				t.FailNow()
+			}
+			if !assert.Equal(t, str, string(b)) {
+				t.FailNow()
+			}
+		}
+		_, e = ws.Write(large)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		ty, b, e := ws.ReadMessage()
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, websocket.BinaryMessage, ty) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, large, b) {
+			t.FailNow()
+		}
+		ws.Close()
+	}
+}
+func TestClientTCPCompressCloseWrite(t *testing.T) {
+	var (
+		wait   sync.WaitGroup
+		locker sync.Mutex
+		conns  []net.Conn
+	)
+	l, e := net.Listen(`tcp`, TCP)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer func() {
+		l.Close()
+		locker.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		locker.Unlock()
+		wait.Wait()
+	}()
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for {
+			// 接受連接但從不讀取，讓寫入被流量控制阻塞
+			c, e := l.Accept()
+			if e != nil {
+				break
+			}
+			locker.Lock()
+			conns = append(conns, c)
+			locker.Unlock()
+		}
+	}()
+
+	s := newServer(t)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	c, _, e := client.Connect(context.Background(),
+		"tcp://"+TCP,
+		httpadapter.ConnectCompress(`deflate`),
+	)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	var written int64
+	writer := make(chan error, 1)
+	go func() {
+		// 隨機數據無法被壓縮，很快就會填滿窗口與緩衝區
+		b := make([]byte, 1024*64)
+		for {
+			rand.Read(b)
+			_, e := c.Write(b)
+			if e != nil {
+				writer <- e
+				return
+			}
+			atomic.AddInt64(&written, int64(len(b)))
+		}
+	}()
+	// 等待寫入不再前進
+	last := int64(-1)
+	for i := 0; i < 100; i++ {
+		time.Sleep(time.Millisecond * 200)
+		current := atomic.LoadInt64(&written)
+		if current == last {
+			break
+		}
+		last = current
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 3):
+		t.Fatal(`Close blocked by stalled Write`)
+	}
+	select {
+	case e = <-writer:
+		if !assert.NotNil(t, e) {
+			t.FailNow()
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal(`Write not released by Close`)
+	}
+}
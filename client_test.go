@@ -2,19 +2,24 @@ package httpadapter_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/powerpuffpenguin/httpadapter"
 	"github.com/powerpuffpenguin/httpadapter/core"
+	"github.com/powerpuffpenguin/httpadapter/rewriter"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -331,3 +336,672 @@ func testClientHttpBody(t *testing.T, opts ...httpadapter.ClientOption) {
 	})
 	checkClientHttpBody(t, resp, e, `11`)
 }
+func TestClientHttpMethod(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/method`, func(w http.ResponseWriter, r *http.Request) {
+		b, e := io.ReadAll(r.Body)
+		if e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Write([]byte(r.Method + ` ` + string(b)))
+	})
+
+	s := newServer(t,
+		httpadapter.ServerWindow(4),
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerMethods(http.MethodDelete, http.MethodOptions, `PROPFIND`),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	for _, method := range []string{http.MethodDelete, http.MethodOptions, `PROPFIND`} {
+		body := `{"id":1}`
+		resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+			URL:     BaseURL + `/method`,
+			Method:  method,
+			Body:    strings.NewReader(body),
+			BodyLen: uint64(len(body)),
+		})
+		checkClientHttpBody(t, resp, e, method+` `+body)
+	}
+
+	// not allowed
+	_, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL:    BaseURL + `/method`,
+		Method: http.MethodGet,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrRejectedByPolicy) {
+		t.FailNow()
+	}
+	var fe *httpadapter.ForwardError
+	if !assert.ErrorAs(t, e, &fe) || !assert.Equal(t, http.StatusBadRequest, fe.Status) {
+		t.FailNow()
+	}
+
+	// invalid token
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL:    BaseURL + `/method`,
+		Method: `BAD METHOD`,
+	})
+	if !assert.NotNil(t, e) {
+		t.FailNow()
+	}
+}
+func TestClientHttpError(t *testing.T) {
+	s := newServer(t,
+		httpadapter.ServerWindow(4),
+		httpadapter.ServerHookURL(httpadapter.HookURLFunc(func(u *url.URL) (*url.URL, error) {
+			if u.Path == `/reject` {
+				return nil, errors.New(`url not allowed`)
+			}
+			return u, nil
+		})),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	_, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/reject`,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrRejectedByPolicy) {
+		t.FailNow()
+	}
+
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://127.0.0.1:1/unreachable`,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrUpstreamUnreachable) {
+		t.FailNow()
+	}
+
+	_, _, e = client.Connect(context.Background(), `tcp://127.0.0.1:1`)
+	if !assert.ErrorIs(t, e, httpadapter.ErrUpstreamUnreachable) {
+		t.FailNow()
+	}
+}
+func TestClientHttpTrailer(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/trailer`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Trailer`, `Server-Timing`)
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Write([]byte(`ok`))
+		w.Header().Set(`Server-Timing`, `db;dur=53`)
+	})
+
+	s := newServer(t,
+		httpadapter.ServerWindow(4),
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL:    BaseURL + `/trailer`,
+		Method: http.MethodGet,
+	})
+	checkClientHttpBody(t, resp, e, `ok`)
+	if !assert.Equal(t, `db;dur=53`, resp.Trailer.Get(`Server-Timing`)) {
+		t.FailNow()
+	}
+}
+
+type testContinueReader struct {
+	r    io.Reader
+	read bool
+}
+
+func (r *testContinueReader) Read(p []byte) (int, error) {
+	r.read = true
+	return r.r.Read(p)
+}
+func TestClientHttpContinue(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/upload`, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(`Authorization`) == `` {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, e := io.ReadAll(r.Body)
+		if e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	})
+
+	s := newServer(t,
+		httpadapter.ServerWindow(4),
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerBodyLimit(10),
+		httpadapter.ServerExpectContinue(true),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	// rejected by upstream
+	body := &testContinueReader{r: strings.NewReader(`upload`)}
+	resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL:            BaseURL + `/upload`,
+		Method:         http.MethodPost,
+		Body:           body,
+		BodyLen:        6,
+		ExpectContinue: true,
+	})
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if !assert.Equal(t, http.StatusUnauthorized, resp.Status) || !assert.False(t, body.read) {
+		t.FailNow()
+	}
+
+	// rejected by size limit
+	body = &testContinueReader{r: strings.NewReader(`upload too large`)}
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL:            BaseURL + `/upload`,
+		Method:         http.MethodPost,
+		Body:           body,
+		BodyLen:        16,
+		ExpectContinue: true,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrBodyTooLarge) || !assert.False(t, body.read) {
+		t.FailNow()
+	}
+
+	// accepted
+	body = &testContinueReader{r: strings.NewReader(`upload`)}
+	resp, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL:    BaseURL + `/upload`,
+		Method: http.MethodPost,
+		Header: http.Header{
+			`Authorization`: []string{`Bearer token`},
+		},
+		Body:           body,
+		BodyLen:        6,
+		ExpectContinue: true,
+	})
+	checkClientHttpBody(t, resp, e, `upload`)
+}
+func TestClientHttpEncoding(t *testing.T) {
+	text := strings.Repeat(`compress me `, 1024)
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/text`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Write([]byte(text))
+	})
+	mux.HandleFunc(`/gzip`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Header().Set(`Content-Encoding`, `gzip`)
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(text))
+		gw.Close()
+	})
+
+	s := newServer(t,
+		httpadapter.ServerWindow(4),
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	for _, encoding := range []string{core.EncodingZstd, core.EncodingGzip, core.EncodingDeflate} {
+		client := httpadapter.NewClient(Addr, httpadapter.WithEncoding(encoding))
+		for _, path := range []string{`/text`, `/gzip`} {
+			resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+				URL: BaseURL + path,
+			})
+			if !assert.Nil(t, e) {
+				t.FailNow()
+			}
+			if !assert.True(t, resp.Uncompressed) {
+				t.FailNow()
+			}
+			checkClientHttpBody(t, resp, e, text)
+		}
+		client.Close()
+	}
+}
+func TestClientHttpRewriter(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/v1/echo`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Write([]byte(r.URL.Path + ` ` + r.Header.Get(`X-Rewriter`) + ` ` + r.Header.Get(`Cookie`)))
+	})
+	r, e := rewriter.New(
+		rewriter.Rule{
+			Paths:  []string{`^/reject`},
+			Reject: true,
+		},
+		rewriter.Rule{
+			Hosts:     []string{Addr},
+			Paths:     []string{`@^/api(/.*)$`},
+			Path:      `$1`,
+			DelHeader: []string{`Cookie`},
+			AddHeader: http.Header{
+				`X-Rewriter`: []string{`ok`},
+			},
+		},
+	)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerHookURL(r),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/api/v1/echo`,
+		Header: http.Header{
+			`Cookie`: []string{`id=1`},
+		},
+	})
+	checkClientHttpBody(t, resp, e, `/v1/echo ok `)
+
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/reject`,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrRejectedByPolicy) {
+		t.FailNow()
+	}
+}
+func TestClientGuard(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/text`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Write([]byte(`ok`))
+	})
+	guard, e := httpadapter.NewDestinationGuard(nil, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerDestinationGuard(guard),
+	)
+	client := httpadapter.NewClient(Addr)
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/text`,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrRejectedByPolicy) {
+		t.FailNow()
+	}
+	var fe *httpadapter.ForwardError
+	if !assert.ErrorAs(t, e, &fe) || !assert.Equal(t, http.StatusForbidden, fe.Status) {
+		t.FailNow()
+	}
+	_, _, e = client.Connect(context.Background(), `tcp://`+TCP)
+	if !assert.ErrorIs(t, e, httpadapter.ErrRejectedByPolicy) {
+		t.FailNow()
+	}
+	_, _, e = client.Websocket(context.Background(), BaseWebsocket+`/ws`, nil)
+	if !assert.ErrorIs(t, e, httpadapter.ErrRejectedByPolicy) {
+		t.FailNow()
+	}
+	// 域名解析後的 ip 同樣被檢查
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://localhost:12233/text`,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrRejectedByPolicy) {
+		t.FailNow()
+	}
+	client.Close()
+	s.CloseAndWait()
+
+	// allow 優先於 deny
+	guard, e = httpadapter.NewDestinationGuard([]string{`127.0.0.1/32`}, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	s = newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerDestinationGuard(guard),
+	)
+	defer s.CloseAndWait()
+	client = httpadapter.NewClient(Addr)
+	defer client.Close()
+	resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/text`,
+	})
+	checkClientHttpBody(t, resp, e, `ok`)
+}
+func TestDestinationGuard(t *testing.T) {
+	guard, e := httpadapter.NewDestinationGuard([]string{`10.1.0.0/16`}, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	items := []struct {
+		ip      string
+		allowed bool
+	}{
+		{`10.0.0.1`, false},
+		{`::ffff:10.0.0.1`, false},
+		{`1.1.1.1`, true},
+		{`2606:4700::1111`, true},
+		// NAT64 內嵌的 ipv4
+		{`64:ff9b::a00:1`, false},
+		{`64:ff9b::7f00:1`, false},
+		{`64:ff9b::a9fe:a9fe`, false},
+		{`64:ff9b::101:101`, true},
+		{`64:ff9b::a01:1`, true},
+		{`64:ff9b:1::a00:1`, false},
+		// 6to4 內嵌的 ipv4
+		{`2002:a00:1::1`, false},
+		{`2002:c0a8:101::1`, false},
+		{`2002:101:101::1`, true},
+	}
+	for _, item := range items {
+		if !assert.Equal(t, item.allowed, guard.Allowed(net.ParseIP(item.ip)), item.ip) {
+			t.FailNow()
+		}
+	}
+}
+func TestClientHttpLocal(t *testing.T) {
+	large := strings.Repeat(`local `, 1024*20)
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/v1/small`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Write([]byte(r.Host + ` ` + r.URL.Path))
+	})
+	mux.HandleFunc(`/v1/large`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Trailer`, `X-Checksum`)
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.Write([]byte(large))
+		w.Header().Set(`X-Checksum`, strconv.Itoa(len(large)))
+	})
+	mux.HandleFunc(`/v1/echo`, func(w http.ResponseWriter, r *http.Request) {
+		b, e := io.ReadAll(r.Body)
+		if e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(`Content-Length`, strconv.Itoa(len(b)+len(r.Method)+1))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.Method + ` `))
+		w.Write(b)
+	})
+	mux.HandleFunc(`/v1/flush`, func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			w.Write([]byte(strconv.Itoa(i)))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+`X-Count`, `3`)
+	})
+	s := newServer(t,
+		httpadapter.ServerLocal(`local.test`, mux),
+		httpadapter.ServerLocal(`http://prefix.test/v1/`, mux),
+		httpadapter.ServerLocal(`http://segment.test/v1`, mux),
+	)
+	defer s.CloseAndWait()
+	// 無效的設定在創建 ServerOption 時 panic
+	for _, pattern := range []string{``, `http://%zz/`, `tcp://local.test/`, `http:///v1`} {
+		if !assert.Panics(t, func() { httpadapter.ServerLocal(pattern, mux) }, pattern) {
+			t.FailNow()
+		}
+	}
+	if !assert.Panics(t, func() { httpadapter.ServerLocal(`local.test`, nil) }) {
+		t.FailNow()
+	}
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	// 不需要解析域名
+	resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://local.test:9000/v1/small`,
+	})
+	if !assert.Nil(t, e) || !assert.False(t, resp.Chunked) || !assert.Equal(t, uint64(25), resp.BodyLen) {
+		t.FailNow()
+	}
+	checkClientHttpBody(t, resp, e, `local.test:9000 /v1/small`)
+
+	resp, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://prefix.test/v1/large`,
+	})
+	if !assert.Nil(t, e) || !assert.True(t, resp.Chunked) {
+		t.FailNow()
+	}
+	checkClientHttpBody(t, resp, e, large)
+	if !assert.Equal(t, strconv.Itoa(len(large)), resp.Trailer.Get(`X-Checksum`)) {
+		t.FailNow()
+	}
+
+	body := `{"id":1}`
+	resp, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL:            `http://local.test/v1/echo`,
+		Method:         http.MethodPut,
+		Body:           strings.NewReader(body),
+		BodyLen:        uint64(len(body)),
+		ExpectContinue: true,
+	})
+	if !assert.Nil(t, e) || !assert.Equal(t, http.StatusCreated, resp.Status) {
+		t.FailNow()
+	}
+	b, e := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !assert.Nil(t, e) || !assert.Equal(t, `PUT `+body, string(b)) {
+		t.FailNow()
+	}
+
+	resp, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://local.test/v1/flush`,
+	})
+	if !assert.Nil(t, e) || !assert.True(t, resp.Chunked) {
+		t.FailNow()
+	}
+	checkClientHttpBody(t, resp, e, `012`)
+	if !assert.Equal(t, `3`, resp.Trailer.Get(`X-Count`)) {
+		t.FailNow()
+	}
+
+	// 不匹配的前綴仍然通過網路轉發
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://prefix.test/v2/small`,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrUpstreamUnreachable) {
+		t.FailNow()
+	}
+	// 不以 / 結尾的前綴只匹配完整的路徑段
+	resp, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://segment.test/v1/small`,
+	})
+	checkClientHttpBody(t, resp, e, `segment.test /v1/small`)
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://segment.test/v1small`,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrUpstreamUnreachable) {
+		t.FailNow()
+	}
+
+	// 壓縮
+	client = httpadapter.NewClient(Addr, httpadapter.WithEncoding(`gzip`))
+	defer client.Close()
+	resp, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: `http://local.test/v1/large`,
+	})
+	if !assert.Nil(t, e) || !assert.True(t, resp.Uncompressed) {
+		t.FailNow()
+	}
+	checkClientHttpBody(t, resp, e, large)
+}
+
+// 按照 mode 損壞寫入的數據
+type corruptConn struct {
+	net.Conn
+	// 1 翻轉指令數據中的一個字節，2 在幀之間插入噪聲
+	mode int32
+}
+
+func (c *corruptConn) Write(b []byte) (int, error) {
+	switch atomic.LoadInt32(&c.mode) {
+	case 1:
+		if i := bytes.Index(b, []byte(`aaa`)); i >= 0 {
+			atomic.StoreInt32(&c.mode, 0)
+			corrupted := make([]byte, len(b))
+			copy(corrupted, b)
+			corrupted[i+1] = 'b'
+			_, e := c.Conn.Write(corrupted)
+			return len(b), e
+		}
+	case 2:
+		atomic.StoreInt32(&c.mode, 0)
+		_, e := c.Conn.Write([]byte("\xa5\xc3noise\xa5"))
+		if e != nil {
+			return 0, e
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+type corruptDialer struct {
+	c *corruptConn
+}
+
+func (d *corruptDialer) Dial(network, address string) (net.Conn, error) {
+	c, e := net.Dial(network, address)
+	if e != nil {
+		return nil, e
+	}
+	d.c = &corruptConn{Conn: c}
+	return d.c, nil
+}
+func TestClientChecksum(t *testing.T) {
+	testClient(t, httpadapter.WithChecksum(true))
+
+	s := newServer(t,
+		ServerEcho(0),
+	)
+	defer s.CloseAndWait()
+	dialer := &corruptDialer{}
+	client := httpadapter.NewClient(Addr,
+		httpadapter.WithChecksum(true),
+		httpadapter.WithDialer(dialer),
+	)
+	defer client.Close()
+	echo := func(c net.Conn, data string) {
+		_, e := c.Write([]byte(data))
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		b := make([]byte, len(data))
+		_, e = io.ReadFull(c, b)
+		if !assert.Nil(t, e) || !assert.Equal(t, data, string(b)) {
+			t.FailNow()
+		}
+	}
+	c0, e := client.Dial()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer c0.Close()
+	echo(c0, `ok`)
+
+	// 幀之間的噪聲被跳過
+	atomic.StoreInt32(&dialer.c.mode, 2)
+	echo(c0, `noise`)
+
+	// 數據損壞只重置所屬的 channel
+	c1, e := client.Dial()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer c1.Close()
+	atomic.StoreInt32(&dialer.c.mode, 1)
+	_, e = c1.Write([]byte(strings.Repeat(`a`, 1000)))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = io.ReadFull(c1, make([]byte, 1000))
+	if !assert.NotNil(t, e) {
+		t.FailNow()
+	}
+	echo(c0, `alive`)
+}
+
+func TestClientBandwidth(t *testing.T) {
+	s := newServer(t,
+		ServerEcho(0),
+	)
+	defer s.CloseAndWait()
+	client := httpadapter.NewClient(Addr,
+		httpadapter.WithBandwidth(32*1024, 0),
+	)
+	defer client.Close()
+	if !assert.Equal(t, [2]int{32 * 1024, 0}, func() [2]int {
+		channel, chain := client.Bandwidth()
+		return [2]int{channel, chain}
+	}()) {
+		t.FailNow()
+	}
+	echo := func(size int) time.Duration {
+		c, e := client.Dial()
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		defer c.Close()
+		at := time.Now()
+		go c.Write(make([]byte, size))
+		_, e = io.ReadFull(c, make([]byte, size))
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		return time.Since(at)
+	}
+	// 桶中只有一秒的流量，超出的 32k 需要等待大約 1 秒，無限制時應該遠快於此
+	limited := echo(64 * 1024)
+	if !assert.GreaterOrEqual(t, limited, time.Millisecond*700) {
+		t.FailNow()
+	}
+	// 運行時取消限制
+	client.SetBandwidth(0, 0)
+	if !assert.Less(t, echo(64*1024), limited/2) {
+		t.FailNow()
+	}
+
+	// 限制 tcp-chain 時，等待中的數據不應該延遲其它 channel 的創建等控制指令
+	client.SetBandwidth(0, 32*1024)
+	wait := make(chan time.Duration, 1)
+	go func() {
+		wait <- echo(96 * 1024)
+	}()
+	time.Sleep(time.Millisecond * 200)
+	at := time.Now()
+	c, e := client.Dial()
+	dial := time.Since(at)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	c.Close()
+	limited = <-wait
+	if !assert.GreaterOrEqual(t, limited, time.Second) {
+		t.FailNow()
+	}
+	if !assert.Less(t, dial, limited/4) {
+		t.FailNow()
+	}
+	client.SetBandwidth(0, 0)
+
+	// 服務器限制 tcp-chain 的發送速率，ServerEcho 每次寫入 10 字節，加上指令頭 32k 數據大約佔用 66k
+	s.SetBandwidth(0, 32*1024, 0)
+	limited = echo(32 * 1024)
+	if !assert.GreaterOrEqual(t, limited, time.Millisecond*700) {
+		t.FailNow()
+	}
+	s.SetBandwidth(0, 0, 0)
+	if !assert.Less(t, echo(32*1024), limited/2) {
+		t.FailNow()
+	}
+}
@@ -24,6 +24,10 @@ type keyClientChannelRW struct {
 	req []byte
 	ch  chan createClientChannel
 }
+
+// 創建結果到達前 channel 被關閉或重置，這不是服務器返回的代碼
+const createReset = 0xff
+
 type createClientChannel struct {
 	value *ioChannel
 	code  byte
@@ -36,6 +40,9 @@ type clientTransport struct {
 	opts *clientOptions
 	keys map[uint64]*keyClientChannel
 
+	// 服務器拒絕創建 channel 時的退避狀態
+	backoff backoff
+
 	sync.Mutex
 	baseTransport
 }
@@ -45,6 +52,10 @@ func newClientTransport(c net.Conn, buf []byte, opts *clientOptions) (t *clientT
 		Window:  opts.window,
 		Version: []string{core.ProtocolVersion},
 	}
+	if opts.checksum {
+		// 不支持校驗的服務器會選擇 ProtocolVersion
+		req.Version = []string{core.ProtocolVersionCRC32C, core.ProtocolVersion}
+	}
 	data, e := req.MarshalTo(buf)
 	if e != nil {
 		return
@@ -58,11 +69,21 @@ func newClientTransport(c net.Conn, buf []byte, opts *clientOptions) (t *clientT
 	if e != nil {
 		return
 	}
+	checksum := false
 	if resp.Code == core.HelloOk {
-		if resp.Message != core.ProtocolVersion {
+		if opts.checksum && resp.Message == core.ProtocolVersionCRC32C {
+			checksum = true
+		} else if resp.Message != core.ProtocolVersion {
 			e = core.HelloError(core.HelloInvalidVersion)
 			return
 		}
+	} else if resp.Code == core.HelloBusy {
+		retryAfter, _ := core.ParseRetryAfter(resp.Message)
+		e = &BusyError{
+			RetryAfter: retryAfter,
+			Message:    resp.Message,
+		}
+		return
 	} else {
 		e = fmt.Errorf("%v %s", resp.Code, resp.Message)
 		return
@@ -73,10 +94,11 @@ func newClientTransport(c net.Conn, buf []byte, opts *clientOptions) (t *clientT
 		opts: opts,
 		keys: make(map[uint64]*keyClientChannel),
 		baseTransport: baseTransport{
-			done:   make(chan struct{}),
-			window: resp.Window,
-			c:      c,
-			ch:     make(chan []byte, 50),
+			done:     make(chan struct{}),
+			window:   resp.Window,
+			c:        c,
+			ch:       make(chan []byte, 50),
+			checksum: checksum,
 		},
 	}
 	return
@@ -95,11 +117,17 @@ func (t *clientTransport) Serve(b []byte) {
 	if t.opts.readBuffer > 0 {
 		r = bufio.NewReaderSize(r, t.opts.readBuffer)
 	}
+	if t.checksum {
+		r = newFrameReader(r, t.reset)
+	}
 	// ping
 	if t.opts.ping > time.Second {
 		active = make(chan int, 1)
 		go t.servePing(active, t.opts.ping)
 	}
+	if t.opts.chainIdleTimeout > 0 {
+		go t.serveIdle(t.opts.chainIdleTimeout, t.channels)
+	}
 	// 寫入 tcp-chain
 	go t.serveWrite(active, t.opts.writeBuffer)
 
@@ -166,6 +194,9 @@ CS:
 					localAddr, remoteAddr,
 					int(t.opts.window), int(t.window),
 				)
+				val.channel.bandwidth = t.bandwidth.newChannel()
+				val.channel.resetIdle(t.opts.channelIdleTimeout)
+				val.channel.setLifetime(t.opts.lifetimes[``])
 				go val.channel.Serve()
 			}
 			if t.createResult(rw, code, val.channel) {
@@ -181,6 +212,9 @@ CS:
 			if cc, exists := t.keys[id]; exists {
 				if cc.channel != nil {
 					cc.channel.Close()
+				} else if cc.rw != nil {
+					// 還在等待創建結果
+					t.createResult(cc.rw, createReset, nil)
 				}
 				delete(t.keys, id)
 			}
@@ -275,6 +309,12 @@ CS:
 	t.Unlock()
 }
 
+func (t *clientTransport) channels() (n int) {
+	t.Lock()
+	n = len(t.keys)
+	t.Unlock()
+	return
+}
 func (t *clientTransport) delete(c *ioChannel) {
 	deleted := false
 	t.Lock()
@@ -289,6 +329,21 @@ func (t *clientTransport) delete(c *ioChannel) {
 	t.sendClose(c.id)
 }
 
+// 幀損壞時重置 channel
+func (t *clientTransport) reset(id uint64) {
+	t.Lock()
+	if cc, exists := t.keys[id]; exists {
+		if cc.channel != nil {
+			cc.channel.Close()
+		} else if cc.rw != nil {
+			t.createResult(cc.rw, createReset, nil)
+		}
+		delete(t.keys, id)
+	}
+	t.Unlock()
+	t.sendClose(id)
+}
+
 func (t *clientTransport) createResult(rw *keyClientChannelRW, code byte, val *ioChannel) (exit bool) {
 	select {
 	case <-rw.ctx.Done():
@@ -325,6 +380,10 @@ func (t *clientTransport) createResult(rw *keyClientChannelRW, code byte, val *i
 	return
 }
 func (t *clientTransport) Create(ctx context.Context) (c net.Conn, e error) {
+	e = t.backoff.check()
+	if e != nil {
+		return
+	}
 	id := atomic.AddUint64(&t.id, 1)
 	data := make([]byte, 1+8)
 	data[0] = byte(core.CommandCreate)
@@ -368,10 +427,20 @@ func (t *clientTransport) Create(ctx context.Context) (c net.Conn, e error) {
 		switch val.code {
 		case 0:
 			c = val.value
+			t.backoff.reset()
 		case 1:
 			e = errors.New(`code=1 id already exists: ` + strconv.FormatInt(int64(id), 10))
 		case 2:
 			e = errors.New(`code=2 too many channels`)
+		case 3:
+			e = fmt.Errorf(`code=3 channel creation %w`, ErrRateLimited)
+		case 4:
+			e = &BusyError{
+				RetryAfter: t.backoff.busy(0),
+				Message:    `code=4 channel creation refused`,
+			}
+		case createReset:
+			e = ErrChannelClosed
 		default:
 			e = errors.New(`unknow error(` + strconv.Itoa(int(val.code)) + `)`)
 		}
@@ -11,34 +11,27 @@ import (
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"time"
 
 	"github.com/powerpuffpenguin/easygo"
 	"github.com/powerpuffpenguin/httpadapter/core"
 )
 
 func (c *Client) unary(ctx context.Context, body io.Reader, bodylen uint64, md *core.ClientMetadata) (cc net.Conn, resp *MessageResponse, e error) {
-	w := bytes.NewBuffer(make([]byte, 10, 256))
-	e = json.NewEncoder(w).Encode(md)
+	b, e := encodeMessage(md, bodylen)
 	if e != nil {
 		return
 	}
-	b := w.Bytes()
-	metalen := len(b) - 10
-	if metalen > math.MaxUint16 {
-		e = errors.New(`metadata length too long`)
-		return
-	}
-	core.ByteOrder.PutUint16(b, uint16(metalen))
-	core.ByteOrder.PutUint64(b[2:], bodylen)
 	conn, e := c.DialContext(ctx)
 	if e != nil {
 		return
 	}
-	ch := make(chan easygo.Pair[MessageResponse, error], 1)
+	c.setLifetime(conn, md.URL)
+	ch := make(chan easygo.Pair[*MessageResponse, error], 1)
 	go func() {
 		// write header md
 		var e error
-		var resp easygo.Pair[MessageResponse, error]
+		var resp easygo.Pair[*MessageResponse, error]
 		_, e = conn.Write(b)
 		if e != nil {
 			resp.Second = e
@@ -47,6 +40,14 @@ func (c *Client) unary(ctx context.Context, body io.Reader, bodylen uint64, md *
 		}
 		// write body
 		if bodylen > 0 {
+			if md.Continue {
+				// 等待服務器允許發送 body
+				resp.First, resp.Second = readMessage(conn, b)
+				if resp.Second != nil || resp.First.Status != http.StatusContinue {
+					ch <- resp
+					return
+				}
+			}
 			_, e = io.Copy(conn, io.LimitReader(body, int64(bodylen)))
 			if e != nil {
 				resp.Second = e
@@ -55,63 +56,7 @@ func (c *Client) unary(ctx context.Context, body io.Reader, bodylen uint64, md *
 			}
 		}
 
-		// read header
-		data := b[:10]
-		_, e = io.ReadFull(conn, data)
-		if e != nil {
-			resp.Second = e
-			ch <- resp
-			return
-		}
-		metalen := int(core.ByteOrder.Uint16(data))
-		if metalen == 0 {
-			resp.Second = errors.New(`metalen invalid`)
-			ch <- resp
-			return
-		}
-		bodylen := uint64(core.ByteOrder.Uint64(data[2:]))
-		if bodylen > math.MaxInt64 {
-			resp.Second = errors.New(`bodylen invalid`)
-			ch <- resp
-			return
-		}
-
-		// read md
-		if cap(b) < metalen {
-			data = make([]byte, metalen)
-		} else {
-			data = b[:metalen]
-		}
-		_, e = io.ReadFull(conn, data)
-		if e != nil {
-			resp.Second = e
-			ch <- resp
-			return
-		}
-		var md core.ServerMetadata
-		e = json.Unmarshal(data, &md)
-		if e != nil {
-			resp.Second = e
-			ch <- resp
-			return
-		}
-
-		// read body
-		if bodylen == 0 {
-			resp.First.Body = nilReadCloser{}
-		} else {
-			resp.First.BodyLen = bodylen
-			resp.First.Body = readCloser{
-				Closer: conn,
-				Reader: io.LimitReader(conn, int64(bodylen)),
-			}
-		}
-		resp.First.Status = md.Status
-		header := make(http.Header, len(md.Header))
-		for k, v := range md.Header {
-			header[textproto.CanonicalMIMEHeaderKey(k)] = v
-		}
-		resp.First.Header = header
+		resp.First, resp.Second = readMessage(conn, b)
 		ch <- resp
 	}()
 	select {
@@ -119,7 +64,7 @@ func (c *Client) unary(ctx context.Context, body io.Reader, bodylen uint64, md *
 		e = ctx.Err()
 		conn.Close()
 	case obj := <-ch:
-		resp, e = &obj.First, obj.Second
+		resp, e = obj.First, obj.Second
 		if e == nil {
 			cc = conn
 		} else {
@@ -129,7 +74,102 @@ func (c *Client) unary(ctx context.Context, body io.Reader, bodylen uint64, md *
 	return
 }
 
-// 請求一個一元方法
+// 編碼客戶端要發送的 Message 頭
+func encodeMessage(md *core.ClientMetadata, bodylen uint64) (b []byte, e error) {
+	w := bytes.NewBuffer(make([]byte, 10, 256))
+	e = json.NewEncoder(w).Encode(md)
+	if e != nil {
+		return
+	}
+	b = w.Bytes()
+	metalen := len(b) - 10
+	if metalen > math.MaxUint16 {
+		e = errors.New(`metadata length too long`)
+		return
+	}
+	core.ByteOrder.PutUint16(b, uint16(metalen))
+	core.ByteOrder.PutUint64(b[2:], bodylen)
+	return
+}
+
+// 讀取服務器返回的 Message 頭
+func readMessage(conn net.Conn, b []byte) (resp *MessageResponse, e error) {
+	// read header
+	data := b[:10]
+	_, e = io.ReadFull(conn, data)
+	if e != nil {
+		return
+	}
+	metalen := int(core.ByteOrder.Uint16(data))
+	if metalen == 0 {
+		e = errors.New(`metalen invalid`)
+		return
+	}
+	bodylen := uint64(core.ByteOrder.Uint64(data[2:]))
+	if bodylen > math.MaxInt64 && bodylen != core.BodyChunked {
+		e = errors.New(`bodylen invalid`)
+		return
+	}
+
+	// read md
+	if cap(b) < metalen {
+		data = make([]byte, metalen)
+	} else {
+		data = b[:metalen]
+	}
+	_, e = io.ReadFull(conn, data)
+	if e != nil {
+		return
+	}
+	var md core.ServerMetadata
+	e = json.Unmarshal(data, &md)
+	if e != nil {
+		return
+	} else if md.Error != nil {
+		e = newForwardError(md.Status, md.Error)
+		return
+	}
+
+	// read body
+	resp = &MessageResponse{}
+	if bodylen == core.BodyChunked {
+		resp.Chunked = true
+		resp.Body = &messageBody{
+			resp:    resp,
+			trailer: md.Trailer,
+			Closer:  conn,
+			Reader:  core.NewChunkedReader(conn),
+			conn:    conn,
+		}
+	} else if md.Trailer {
+		resp.BodyLen = bodylen
+		resp.Body = &messageBody{
+			resp:    resp,
+			trailer: true,
+			Closer:  conn,
+			Reader:  io.LimitReader(conn, int64(bodylen)),
+			conn:    conn,
+		}
+	} else if bodylen == 0 {
+		resp.Body = nilReadCloser{}
+	} else {
+		resp.BodyLen = bodylen
+		resp.Body = readCloser{
+			Closer: conn,
+			Reader: io.LimitReader(conn, int64(bodylen)),
+		}
+	}
+	resp.Status = md.Status
+	resp.Compress = md.Compress
+	header := make(http.Header, len(md.Header))
+	for k, v := range md.Header {
+		header[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	resp.Header = header
+	return
+}
+
+// 請求一個一元方法，如果請求沒有被服務器轉發或轉發失敗返回 *ForwardError
 func (c *Client) Unary(ctx context.Context, req *MessageRequest) (resp *MessageResponse, e error) {
 	uri, e := url.Parse(req.URL)
 	if e != nil {
@@ -139,38 +179,133 @@ func (c *Client) Unary(ctx context.Context, req *MessageRequest) (resp *MessageR
 		return
 	}
 
-	var bodylen uint64
-	switch req.Method {
-	case http.MethodPost, http.MethodPut, http.MethodPatch:
-		if req.BodyLen != 0 && req.Body != nil {
-			bodylen = req.BodyLen
-		}
-	case http.MethodGet, http.MethodHead, http.MethodDelete:
-	default:
-		e = errors.New(`not support method: ` + req.Method)
+	method := req.Method
+	if method == `` {
+		method = http.MethodGet
+	} else if !core.ValidMethod(method) {
+		e = errors.New(`not support method: ` + method)
 		return
 	}
+	var bodylen uint64
+	if req.BodyLen != 0 && req.Body != nil {
+		bodylen = req.BodyLen
+	}
 	if bodylen > math.MaxInt64 {
 		e = errors.New(`body length too long`)
 		return
 	}
-	cc, resp, e := c.unary(ctx, req.Body, req.BodyLen, &core.ClientMetadata{
-		URL:    req.URL,
-		Method: req.Method,
-		Header: req.Header,
+	var deadline time.Time
+	if c.opts.unaryTimeout > 0 {
+		deadline = time.Now().Add(c.opts.unaryTimeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	cc, resp, e := c.unary(ctx, req.Body, bodylen, &core.ClientMetadata{
+		URL:      req.URL,
+		Method:   method,
+		Header:   req.Header,
+		Trailer:  true,
+		Continue: req.ExpectContinue && bodylen > 0,
+		Encoding: c.opts.encoding,
 	})
 	if e != nil {
 		return
 	} else if resp.Body == nil {
 		cc.Close()
+		return
+	}
+	if channel, ok := cc.(*ioChannel); ok && !deadline.IsZero() {
+		// 讀取 body 也受時間限制
+		channel.resetAfter(time.Until(deadline), ErrUnaryTimeout)
+	}
+	if len(c.opts.encoding) != 0 {
+		e = resp.decompress(c.opts.encoding)
+		if e != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+	}
+	return
+}
+
+// 如果響應使用了客戶端支持的壓縮編碼則自動解壓
+func (resp *MessageResponse) decompress(encodings []string) (e error) {
+	encoding := normalizeEncoding(resp.Header.Get(`Content-Encoding`))
+	if encoding == `` || encoding == core.EncodingIdentity {
+		return
+	}
+	for _, s := range encodings {
+		if s == encoding {
+			var r io.ReadCloser
+			r, e = newDecompressReader(encoding, resp.Body)
+			if e != nil {
+				return
+			}
+			resp.Body = decompressBody{
+				r:    r,
+				body: resp.Body,
+			}
+			resp.Header.Del(`Content-Encoding`)
+			resp.Header.Del(`Content-Length`)
+			resp.BodyLen = 0
+			resp.Chunked = true
+			resp.Uncompressed = true
+			return
+		}
+	}
+	return
+}
+
+type decompressBody struct {
+	r    io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b decompressBody) Read(p []byte) (n int, e error) {
+	n, e = b.r.Read(p)
+	if e == io.EOF {
+		// 讀取剩餘數據以便解析 trailer
+		_, err := io.Copy(io.Discard, b.body)
+		if err != nil {
+			e = err
+		}
 	}
 	return
 }
+func (b decompressBody) Close() error {
+	b.r.Close()
+	return b.body.Close()
+}
 
 type readCloser struct {
 	io.Reader
 	io.Closer
 }
+
+// chunked body，讀取到 EOF 後會解析 trailer
+type messageBody struct {
+	resp    *MessageResponse
+	trailer bool
+	conn    io.Reader
+	io.Reader
+	io.Closer
+}
+
+func (b *messageBody) Read(p []byte) (n int, e error) {
+	n, e = b.Reader.Read(p)
+	if e == io.EOF && b.trailer {
+		b.trailer = false
+		trailer, err := core.ReadTrailer(b.conn)
+		if err == nil {
+			b.resp.Trailer = trailer
+		} else {
+			e = err
+		}
+	}
+	return
+}
+
 type nilReadCloser struct{}
 
 func (nilReadCloser) Close() error {
@@ -183,14 +318,17 @@ func (nilReadCloser) Read(p []byte) (int, error) {
 type MessageRequest struct {
 	// 請求的 http url
 	URL string
-	// 請求 方法
+	// 請求 方法，可以是任何符合 RFC 7230 token 定義的方法，爲空則使用 GET
 	Method string
 	// 添加的 header
 	Header http.Header
-	// body 內容
+	// body 內容，任何方法只要 BodyLen 不爲 0 都會發送 body
 	Body io.Reader
 	// body 大小
 	BodyLen uint64
+	// 如果爲 true 會等待服務器(或上游)驗證請求後才發送 body，
+	// 如果請求被拒絕則不會發送 body，這可以避免在受限網路上浪費流量
+	ExpectContinue bool
 }
 
 type MessageResponse struct {
@@ -202,4 +340,12 @@ type MessageResponse struct {
 	Body io.ReadCloser
 	// 響應 body 內容長度
 	BodyLen uint64
+	// 如果爲 true 則 body 以 chunked 方式傳輸，其長度未知，需要讀取到 EOF
+	Chunked bool
+	// 響應的 trailer，在 Body 讀取到 EOF 後被設置，如果服務器沒有返回 trailer 則爲 nil
+	Trailer http.Header
+	// 如果爲 true 則 Body 已經被客戶端自動解壓，此時 Header 中的 Content-Encoding 和 Content-Length 被刪除
+	Uncompressed bool
+	// tcp/ws 通道數據流使用的壓縮編碼，爲空表示沒有壓縮
+	Compress string
 }
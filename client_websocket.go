@@ -11,7 +11,7 @@ import (
 )
 
 // 請求代理訪問一個 websocket
-func (c *Client) Websocket(ctx context.Context, u string, header http.Header) (ws *Websocket, resp *MessageResponse, e error) {
+func (c *Client) Websocket(ctx context.Context, u string, header http.Header, opt ...ConnectOption) (ws *Websocket, resp *MessageResponse, e error) {
 	uri, e := url.Parse(u)
 	if e != nil {
 		return
@@ -20,9 +20,15 @@ func (c *Client) Websocket(ctx context.Context, u string, header http.Header) (w
 		return
 	}
 
+	var opts connectOptions
+	for _, o := range opt {
+		o.Apply(&opts)
+	}
 	cc, resp, e := c.unary(ctx, nil, 0, &core.ClientMetadata{
-		URL:    u,
-		Header: header,
+		URL:      u,
+		Header:   header,
+		Compress: opts.compress,
+		Control:  true,
 	})
 	if e != nil {
 		return
@@ -40,6 +46,14 @@ func (c *Client) Websocket(ctx context.Context, u string, header http.Header) (w
 		}
 		return
 	}
-	ws = &Websocket{c: cc}
+	cc, e = newStreamConn(cc, resp)
+	if e != nil {
+		return
+	}
+	ws = &Websocket{
+		c:      cc,
+		header: resp.Header,
+		writer: make(chan struct{}, 1),
+	}
 	return
 }
@@ -47,7 +47,17 @@ func client() *cobra.Command {
 		Short: "httpadapter client, It can be used to send requests to the httpadapter server",
 		Run: func(cmd *cobra.Command, args []string) {
 			var opts []httpadapter.ClientOption
-			if usetls {
+			if strings.HasPrefix(server, `ws://`) || strings.HasPrefix(server, `wss://`) {
+				opts = append(opts, httpadapter.WithDialer(httpadapter.WebsocketClientDialer{
+					Dialer: &websocket.Dialer{
+						Proxy:            http.ProxyFromEnvironment,
+						HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+						TLSClientConfig: &tls.Config{
+							InsecureSkipVerify: insecure,
+						},
+					},
+				}))
+			} else if usetls {
 				opts = append(opts, httpadapter.WithDialer(&tls.Dialer{
 					Config: &tls.Config{
 						InsecureSkipVerify: insecure,
@@ -156,7 +166,7 @@ func client() *cobra.Command {
 	flags.StringVarP(&uri, `url`, `u`, ``, `requested interface url`)
 	flags.StringVarP(&method, `method`, `M`, http.MethodGet, `request method`)
 	flags.StringSliceVarP(&header, `header`, `H`, nil, `request header key=val`)
-	flags.StringVarP(&server, `server`, `s`, ``, `httpadapter server host:port`)
+	flags.StringVarP(&server, `server`, `s`, ``, `httpadapter server host:port or ws(s)://host:port/path`)
 	flags.BoolVar(&usetls, `tls`, false, `connect use tls`)
 	flags.BoolVarP(&insecure, `insecure`, `k`, false, `allow insecure server connections when using SSL`)
 	return cmd
@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/google/go-jsonnet"
+	"github.com/powerpuffpenguin/httpadapter"
+	"github.com/powerpuffpenguin/httpadapter/rewriter"
 )
 
 type Server struct {
@@ -16,6 +18,8 @@ type Server struct {
 	Options  struct {
 		// 後端服務地址
 		Backend string
+		// 如果設置則在內置 web 的此路徑上接受通過 websocket 建立的 tcp-chain，例如 '/httpadapter'，設置了 Backend 時無效
+		Chain string
 
 		// 服務器窗口大小
 		Window uint32
@@ -29,11 +33,81 @@ type Server struct {
 		Channels int
 		// 一段時間內沒有數據流動就發送 ping 驗證 tcp 連接是否還有效
 		Ping time.Duration
+		// 如果爲 true 要求連接以 PROXY protocol v1/v2 頭開始，用於位於 L4 負載均衡器之後時獲取客戶端真實地址
+		ProxyProtocol bool
+		// 允許發送 PROXY protocol 頭的來源網段(負載均衡器的地址)，不設置則信任所有來源
+		ProxyProtocolTrusted []string
+		// 向 tcp:// 上游與 Backend 發送的 PROXY protocol 頭版本(1 或 2)，0 則不發送
+		UpstreamProxyProtocol int
+		// 轉發 websocket 的限制
+		Websocket struct {
+			// 單個消息的最大字節數，<1 則不限制
+			MessageLimit int64
+			// 客戶端每秒允許發送的幀數量，<1 則不限制
+			FrameRate int
+			// 客戶端每秒允許發送的字節數，<1 則不限制
+			ByteRate int
+			// 兩個方向都沒有幀時的空閒超時，<1 則不限制
+			IdleTimeout time.Duration
+		}
+		// 限流設定，Rate 是每秒允許的數量，Burst 是允許的突發數量，<1 則不限制
+		Limits struct {
+			// 每個來源 ip 建立 tcp-chain 的速率，超過時 hello 返回服務器繁忙
+			Chain httpadapter.RateLimit
+			// 每個 tcp-chain 創建 channel 的速率
+			Channel httpadapter.RateLimit
+			// 每個 ip 的請求速率，超過時返回 429
+			Request httpadapter.RateLimit
+			// 每個 ip 每天允許的流量字節數，<1 則不限制
+			DailyQuota int64
+		}
+		// 發送數據的帶寬限制，單位是每秒字節數，<1 則不限制
+		Bandwidth struct {
+			// 每個 channel
+			Channel int
+			// 每個 tcp-chain
+			Chain int
+			// 所有 tcp-chain 的總和
+			Server int
+		}
+		// 服務器資源上限，超過時拒絕新的 tcp-chain 與 channel，各項 <1 則不限制
+		Admission httpadapter.Admission
+		// 超時設定，<1 則不限制
+		Timeouts struct {
+			// tcp-chain 上沒有任何 channel 多久後關閉 tcp-chain
+			ChainIdle time.Duration
+			// channel 在兩個方向都沒有數據流動多久後被重置
+			ChannelIdle time.Duration
+			// 按照 scheme(例如 tcp ws http) 設置 channel 最長可以存在多久，空字符串的 key 設置所有 channel 的默認值
+			Lifetime map[string]time.Duration
+			// 一元請求的最長時間
+			Unary time.Duration
+		}
 	}
-	Rewriter []Rewriter
+	// 端口多路復用規則，按照先後順序匹配 httpadapter 之外的連接，沒有匹配的連接交給 Options.Backend 或內置的 web
+	Routes []Route
+	// 轉發前按照先後順序匹配的 url 重寫規則，詳細字段見 rewriter.Rule
+	Rewriter []rewriter.Rule
+	// 如果設置則在撥號時檢查上游 ip，防止通過服務器訪問本機或區域網路
+	Guard *Guard
 	// 對這些 Host 值使用 h2c 連接上游服務
 	H2C H2C
 }
+type Route struct {
+	// 要匹配的協議 tls ssh http h2c unknown
+	Protocol string
+	// 對 tls 匹配 SNI，對 http 匹配 Host，支持 'example.com' '*.example.com' '*'，不設置則匹配任意值
+	// 服務器啓用 tls 時 tls 規則在終止 tls 之前匹配，匹配的連接不解密直接轉發
+	Hosts []string
+	// 將連接轉發到此後端地址
+	Backend string
+}
+type Guard struct {
+	// 總是允許訪問的網段
+	Allow []string
+	// 禁止訪問的網段，不設置則使用 httpadapter.DefaultDenyCIDRs
+	Deny []string
+}
 type H2C struct {
 	// Host 匹配規則，不設置則不進行匹配
 	// 詳細匹配規則和Schemes相同
@@ -42,30 +116,6 @@ type H2C struct {
 	// 詳細匹配規則和Schemes相同
 	Hostnames []string
 }
-type Rewriter struct {
-	// Scheme 匹配規則，不設置則匹配任意 Scheme
-	// 數組中任意一個匹配則任務匹配重寫條件
-	// * 'abc.com' 字符串完全匹配
-	// * '*' * 標記匹配任意內容
-	// * '^http' ^ 標記匹配字符串前綴
-	// * 's$' $ 標記匹配字符串後綴
-	// * '@(https)|(wss)' @ 標記使用正在表達式進行匹配
-	Schemes []string
-	// Host 匹配規則，不設置則匹配任意 Host
-	// 詳細匹配規則和Schemes相同
-	Hosts []string
-	// Hostname 匹配規則，不設置則匹配任意 Hostname
-	// 詳細匹配規則和Schemes相同
-	Hostnames []string
-	// 如果爲 true 則拒絕對此地址的轉發
-	Reject bool
-
-	// 要 修改的 Scheme 如果不設置則 不改變
-	// tcp/tls/ws/wss/http/https
-	Scheme string
-	// 要 修改的 Host 如果不設置則 不改變
-	Host string
-}
 
 func loadObject(filename string, obj any) (e error) {
 	vm := jsonnet.MakeVM()
@@ -107,6 +157,19 @@ type Tunnel struct {
 
 	// 一段時間內沒有數據流動就發送 ping 驗證 tcp 連接是否還有效
 	Ping time.Duration
+	// 請求服務器對 tcp-chain 使用 crc32c 校驗，用於可能損壞數據的鏈路
+	Checksum bool
+	// 發送數據的帶寬限制，單位是每秒字節數，<1 則不限制
+	Bandwidth struct {
+		// 每個 channel
+		Channel int
+		// 每個 tcp-chain
+		Chain int
+	}
+	// tcp-chain 上沒有任何 channel 多久後關閉 tcp-chain，<1 則不限制
+	ChainIdleTimeout time.Duration
+	// channel 在兩個方向都沒有數據流動多久後被重置，<1 則不限制
+	ChannelIdleTimeout time.Duration
 }
 
 func LoadTunnel(filename string) (cnf []Tunnel, e error) {
@@ -10,6 +10,7 @@ func main() {
 		tunnel(),
 		client(),
 		echo(),
+		stdio(),
 	)
 	root.Execute()
 }
@@ -1,22 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
-	"errors"
-	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/powerpuffpenguin/httpadapter"
+	"github.com/powerpuffpenguin/httpadapter/rewriter"
 	"github.com/spf13/cobra"
 	"golang.org/x/net/http2"
 )
@@ -58,171 +54,36 @@ func server() *cobra.Command {
 			if addr != `` {
 				cnf.Listen = addr
 			}
-			var l net.Listener
-			if cnf.CertFile != `` && cnf.KeyFile != `` {
-				cert, e := tls.LoadX509KeyPair(cnf.CertFile, cnf.KeyFile)
+			useTLS := cnf.CertFile != `` && cnf.KeyFile != ``
+			if useTLS {
+				// 儘早驗證證書
+				_, e = tls.LoadX509KeyPair(cnf.CertFile, cnf.KeyFile)
 				if e != nil {
 					log.Fatalln(e)
 				}
-				l, e = tls.Listen(`tcp`, cnf.Listen, &tls.Config{
-					//配置 證書
-					Certificates: []tls.Certificate{cert},
-				})
-				if e != nil {
-					log.Fatalln(e)
-				}
-
+			}
+			l, e := net.Listen(`tcp`, cnf.Listen)
+			if e != nil {
+				log.Fatalln(e)
+			}
+			if useTLS {
 				log.Println(`server tls listen:`, cnf.Listen)
 			} else {
-				l, e = net.Listen(`tcp`, cnf.Listen)
-				if e != nil {
-					log.Fatalln(e)
-				}
 				log.Println(`server tcp listen:`, cnf.Listen)
 			}
-			var opts []httpadapter.ServerOption
-			if cnf.Options.Backend == `` {
-				opts = append(opts, httpadapter.ServerHTTP(registerWeb(gin.Default())))
-			} else {
-				opts = append(opts,
-					httpadapter.ServerBackend(
-						httpadapter.NewTCPBackend(cnf.Options.Backend),
-					),
-				)
-			}
-			if cnf.Options.Window > 0 {
-				opts = append(opts,
-					httpadapter.ServerWindow(
-						cnf.Options.Window,
-					),
-				)
-			}
-			if cnf.Options.Timeout > 0 {
-				opts = append(opts,
-					httpadapter.ServerTimeout(
-						cnf.Options.Timeout,
-					),
-				)
-			}
-			if cnf.Options.ReadBuffer > 0 {
-				opts = append(opts,
-					httpadapter.ServerReadBuffer(
-						cnf.Options.ReadBuffer,
-					),
-				)
-			}
-			if cnf.Options.WriteBuffer > 0 {
-				opts = append(opts,
-					httpadapter.ServerReadBuffer(
-						cnf.Options.WriteBuffer,
-					),
-				)
+			opts, chain := newServerOptions(cnf)
+			server := httpadapter.NewServer(opts...)
+			if chain != nil {
+				chain.Server = server
 			}
-			if cnf.Options.Channels > 0 {
-				opts = append(opts,
-					httpadapter.ServerChannels(
-						cnf.Options.Channels,
-					),
-				)
-			}
-			if cnf.Options.Ping > 0 {
-				opts = append(opts,
-					httpadapter.ServerPing(
-						cnf.Options.Ping,
-					),
-				)
-			}
-			// rewriter
-			if len(cnf.Rewriter) != 0 {
-				rewriter := make([]*UnaryRewriter, 0, len(cnf.Rewriter))
-				for _, o := range cnf.Rewriter {
-					r := newUnaryRewriter(&o)
-					rewriter = append(rewriter, r)
-					log.Println(r)
-				}
-				errAllowed := errors.New(`url not allowed`)
-				opts = append(opts, httpadapter.ServerHookURL(httpadapter.HookURLFunc(func(u *url.URL) (nu *url.URL, e error) {
-					for _, r := range rewriter {
-						if r.Match(u) {
-							if r.Reject {
-								e = errAllowed
-								return
-							}
-							if r.Scheme != `` {
-								u.Scheme = r.Scheme
-							}
-							if r.Host != `` {
-								u.Host = r.Host
-							}
-							nu = u
-							return
-						}
-					}
-					nu = u
-					return
-				})))
-			}
-			// h2c
-			var (
-				h2cHosts     []Matcher
-				h2cHostnames []Matcher
-				client       = &http.Client{
-					CheckRedirect: func(req *http.Request, via []*http.Request) error {
-						return http.ErrUseLastResponse
-					},
-				}
-				h2cClient *http.Client
-			)
-			for _, s := range cnf.H2C.Hosts {
-				m := newMatcher(s)
-				h2cHosts = append(h2cHosts, m)
-				log.Println(`h2c host`, m)
-			}
-			for _, s := range cnf.H2C.Hostnames {
-				m := newMatcher(s)
-				h2cHostnames = append(h2cHostnames, m)
-				log.Println(`h2c hostname`, m)
+			if useTLS {
+				e = server.ServeTLS(l, cnf.CertFile, cnf.KeyFile)
+			} else {
+				e = server.Serve(l)
 			}
-			if len(h2cHosts) != 0 || len(h2cHostnames) != 0 {
-				h2cClient = &http.Client{
-					Transport: &http2.Transport{
-						DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-							return net.Dial(network, addr)
-						},
-						AllowHTTP: true,
-					},
-					CheckRedirect: func(req *http.Request, via []*http.Request) error {
-						return http.ErrUseLastResponse
-					},
-				}
+			if e != nil {
+				log.Fatalln(e)
 			}
-			opts = append(opts, httpadapter.ServerHookDo(httpadapter.HookDoFunc(func(req *http.Request) (resp *http.Response, e error) {
-				useh2c := false
-				if h2cClient != nil {
-					for _, m := range h2cHosts {
-						if m.Match(req.URL.Host) {
-							useh2c = true
-							break
-						}
-					}
-					if !useh2c {
-						s := req.URL.Hostname()
-						for _, m := range h2cHostnames {
-							if m.Match(s) {
-								useh2c = true
-								break
-							}
-						}
-					}
-				}
-				if useh2c {
-					resp, e = h2cClient.Do(req)
-				} else {
-					resp, e = client.Do(req)
-				}
-				return
-			})))
-			httpadapter.NewServer(opts...).Serve(l)
 		},
 	}
 	flags := cmd.Flags()
@@ -231,154 +92,284 @@ func server() *cobra.Command {
 	return cmd
 }
 
-type Matcher interface {
-	Match(s string) bool
-}
-
-func newMatcher(s string) Matcher {
-	if s == `*` {
-		return matcherAny{}
-	} else if strings.HasPrefix(s, `^`) {
-		return matcherPrefix(s[1:])
-	} else if strings.HasSuffix(s, `$`) {
-		return matcherSuffix(s[:len(s)-1])
-	} else if strings.HasPrefix(s, `@`) {
-		r, e := regexp.Compile(s[1:])
-		if e != nil {
-			log.Fatalln(e)
-		}
-		return &matcherRegexp{
-			r: r,
-			s: s[1:],
+// 按照配置創建服務器選項，如果設置了 Chain 需要在服務器創建後設置 chain.Server
+func newServerOptions(cnf *Server) (opts []httpadapter.ServerOption, chain *httpadapter.WebsocketHandler) {
+	if cnf.Options.Backend == `` {
+		web := registerWeb(gin.Default())
+		if cnf.Options.Chain != `` {
+			// 服務器創建後再設置
+			chain = &httpadapter.WebsocketHandler{}
+			mux := http.NewServeMux()
+			mux.Handle(`/`, web)
+			mux.Handle(cnf.Options.Chain, chain)
+			web = mux
+			log.Println(`websocket chain:`, cnf.Options.Chain)
 		}
+		opts = append(opts, httpadapter.ServerHTTP(web))
+	} else {
+		opts = append(opts,
+			httpadapter.ServerBackend(
+				httpadapter.NewTCPBackend(cnf.Options.Backend),
+			),
+		)
 	}
-	return matcherEqual(s)
-}
-
-type matcherAny struct{}
-
-func (matcherAny) Match(s string) bool {
-	return true
-}
-func (matcherAny) String() string {
-	return `any: *`
-}
-
-type matcherPrefix string
-
-func (m matcherPrefix) Match(s string) bool {
-	return strings.HasPrefix(s, string(m))
-}
-func (m matcherPrefix) String() string {
-	return `prefix: ` + string(m)
-}
-
-type matcherSuffix string
-
-func (m matcherSuffix) Match(s string) bool {
-	return strings.HasSuffix(s, string(m))
-}
-func (m matcherSuffix) String() string {
-	return `suffix: ` + string(m)
-}
-
-type matcherEqual string
-
-func (m matcherEqual) Match(s string) bool {
-	return s == string(m)
-}
-func (m matcherEqual) String() string {
-	return `equal: ` + string(m)
-}
-
-type matcherRegexp struct {
-	r *regexp.Regexp
-	s string
-}
-
-func (m *matcherRegexp) Match(s string) bool {
-	return m.r.MatchString(s)
-}
-func (m *matcherRegexp) String() string {
-	return `regexp: ` + m.s
-}
-
-type UnaryRewriter struct {
-	Reject       bool
-	Scheme, Host string
-
-	Schemes, Hosts, Hostnames []Matcher
-}
-
-func newUnaryRewriter(o *Rewriter) *UnaryRewriter {
-	var (
-		schemes   = make([]Matcher, 0, len(o.Schemes))
-		hosts     = make([]Matcher, 0, len(o.Hosts))
-		hostnames = make([]Matcher, 0, len(o.Hostnames))
-	)
-	for _, s := range o.Schemes {
-		schemes = append(schemes, newMatcher(s))
+	if cnf.Options.Window > 0 {
+		opts = append(opts,
+			httpadapter.ServerWindow(
+				cnf.Options.Window,
+			),
+		)
 	}
-	for _, s := range o.Hosts {
-		hosts = append(hosts, newMatcher(s))
+	if cnf.Options.Timeout > 0 {
+		opts = append(opts,
+			httpadapter.ServerTimeout(
+				cnf.Options.Timeout,
+			),
+		)
 	}
-	for _, s := range o.Hostnames {
-		hostnames = append(hostnames, newMatcher(s))
+	if cnf.Options.ReadBuffer > 0 {
+		opts = append(opts,
+			httpadapter.ServerReadBuffer(
+				cnf.Options.ReadBuffer,
+			),
+		)
 	}
-
-	return &UnaryRewriter{
-		Reject:    o.Reject,
-		Scheme:    o.Scheme,
-		Host:      o.Host,
-		Schemes:   schemes,
-		Hosts:     hosts,
-		Hostnames: hostnames,
+	if cnf.Options.WriteBuffer > 0 {
+		opts = append(opts,
+			httpadapter.ServerReadBuffer(
+				cnf.Options.WriteBuffer,
+			),
+		)
 	}
-}
-func (r *UnaryRewriter) match(ms []Matcher, s string) bool {
-	for _, m := range ms {
-		if m.Match(s) {
-			return true
+	if cnf.Options.Channels > 0 {
+		opts = append(opts,
+			httpadapter.ServerChannels(
+				cnf.Options.Channels,
+			),
+		)
+	}
+	if cnf.Options.Ping > 0 {
+		opts = append(opts,
+			httpadapter.ServerPing(
+				cnf.Options.Ping,
+			),
+		)
+	}
+	if cnf.Options.Websocket.MessageLimit > 0 {
+		opts = append(opts,
+			httpadapter.ServerWebsocketMessageLimit(
+				cnf.Options.Websocket.MessageLimit,
+			),
+		)
+	}
+	if cnf.Options.Websocket.FrameRate > 0 || cnf.Options.Websocket.ByteRate > 0 {
+		opts = append(opts,
+			httpadapter.ServerWebsocketRateLimit(
+				cnf.Options.Websocket.FrameRate,
+				cnf.Options.Websocket.ByteRate,
+			),
+		)
+	}
+	if cnf.Options.Websocket.IdleTimeout > 0 {
+		opts = append(opts,
+			httpadapter.ServerWebsocketIdleTimeout(
+				cnf.Options.Websocket.IdleTimeout,
+			),
+		)
+	}
+	if cnf.Options.Limits.Chain.Rate > 0 {
+		opts = append(opts,
+			httpadapter.ServerChainRate(
+				cnf.Options.Limits.Chain,
+			),
+		)
+	}
+	if cnf.Options.Limits.Channel.Rate > 0 {
+		opts = append(opts,
+			httpadapter.ServerChannelRate(
+				cnf.Options.Limits.Channel,
+			),
+		)
+	}
+	if cnf.Options.Limits.Request.Rate > 0 {
+		opts = append(opts,
+			httpadapter.ServerRequestRate(
+				cnf.Options.Limits.Request,
+			),
+		)
+	}
+	if cnf.Options.Limits.DailyQuota > 0 {
+		opts = append(opts,
+			httpadapter.ServerDailyQuota(
+				cnf.Options.Limits.DailyQuota,
+			),
+		)
+	}
+	if cnf.Options.Bandwidth.Channel > 0 ||
+		cnf.Options.Bandwidth.Chain > 0 ||
+		cnf.Options.Bandwidth.Server > 0 {
+		opts = append(opts,
+			httpadapter.ServerBandwidth(
+				cnf.Options.Bandwidth.Channel,
+				cnf.Options.Bandwidth.Chain,
+				cnf.Options.Bandwidth.Server,
+			),
+		)
+	}
+	if cnf.Options.Admission != (httpadapter.Admission{}) {
+		opts = append(opts,
+			httpadapter.ServerAdmission(
+				cnf.Options.Admission,
+			),
+		)
+	}
+	if cnf.Options.Timeouts.ChainIdle > 0 {
+		opts = append(opts,
+			httpadapter.ServerChainIdleTimeout(
+				cnf.Options.Timeouts.ChainIdle,
+			),
+		)
+	}
+	if cnf.Options.Timeouts.ChannelIdle > 0 {
+		opts = append(opts,
+			httpadapter.ServerChannelIdleTimeout(
+				cnf.Options.Timeouts.ChannelIdle,
+			),
+		)
+	}
+	for scheme, lifetime := range cnf.Options.Timeouts.Lifetime {
+		opts = append(opts,
+			httpadapter.ServerChannelLifetime(scheme, lifetime),
+		)
+	}
+	if cnf.Options.Timeouts.Unary > 0 {
+		opts = append(opts,
+			httpadapter.ServerUnaryTimeout(
+				cnf.Options.Timeouts.Unary,
+			),
+		)
+	}
+	if cnf.Options.ProxyProtocol {
+		opts = append(opts, httpadapter.ServerProxyProtocol(true))
+	}
+	if len(cnf.Options.ProxyProtocolTrusted) != 0 {
+		for _, cidr := range cnf.Options.ProxyProtocolTrusted {
+			_, _, e := net.ParseCIDR(cidr)
+			if e != nil {
+				log.Fatalln(e)
+			}
 		}
+		opts = append(opts, httpadapter.ServerProxyProtocolTrusted(cnf.Options.ProxyProtocolTrusted...))
 	}
-	return false
-}
-func (r *UnaryRewriter) Match(u *url.URL) bool {
-	if len(r.Schemes) != 0 && !r.match(r.Schemes, u.Scheme) {
-		return false
+	if cnf.Options.UpstreamProxyProtocol != 0 {
+		opts = append(opts,
+			httpadapter.ServerUpstreamProxyProtocol(
+				cnf.Options.UpstreamProxyProtocol,
+			),
+		)
 	}
-	if len(r.Hosts) != 0 && !r.match(r.Hosts, u.Host) {
-		return false
+	// routes
+	for _, route := range cnf.Routes {
+		opts = append(opts, httpadapter.ServerRoute(httpadapter.MuxRoute{
+			Protocol: httpadapter.MuxProtocol(route.Protocol),
+			Hosts:    route.Hosts,
+			Backend:  httpadapter.NewTCPBackend(route.Backend),
+		}))
 	}
-	if len(r.Hostnames) != 0 {
-		s := u.Hostname()
-		if !r.match(r.Hostnames, s) {
-			return false
+	// rewriter
+	if len(cnf.Rewriter) != 0 {
+		r, e := rewriter.New(cnf.Rewriter...)
+		if e != nil {
+			log.Fatalln(e)
 		}
+		log.Println(r)
+		opts = append(opts, httpadapter.ServerHookURL(r))
 	}
-	return true
-}
-func (r *UnaryRewriter) String() string {
-	b := bytes.NewBufferString(`rewriter`)
-	if r.Reject {
-		b.WriteString(` reject`)
-	} else if r.Scheme != `` {
-		if r.Host == `` {
-			b.WriteString(` ` + r.Scheme)
-		} else {
-			b.WriteString(` ` + r.Scheme + `://` + r.Host)
+	// guard
+	var guard *httpadapter.DestinationGuard
+	if cnf.Guard != nil {
+		var e error
+		guard, e = httpadapter.NewDestinationGuard(cnf.Guard.Allow, cnf.Guard.Deny)
+		if e != nil {
+			log.Fatalln(e)
 		}
-	} else if r.Host != `` {
-		b.WriteString(` ` + r.Host)
+		opts = append(opts, httpadapter.ServerDestinationGuard(guard))
 	}
-	if len(r.Schemes) != 0 {
-		b.WriteString(fmt.Sprintf(` schemes=%v`, r.Schemes))
+	// h2c
+	var (
+		h2cHosts     []rewriter.Matcher
+		h2cHostnames []rewriter.Matcher
+		client       = &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		h2cClient *http.Client
+	)
+	for _, s := range cnf.H2C.Hosts {
+		m, e := rewriter.NewMatcher(s)
+		if e != nil {
+			log.Fatalln(e)
+		}
+		h2cHosts = append(h2cHosts, m)
+		log.Println(`h2c host`, m)
+	}
+	for _, s := range cnf.H2C.Hostnames {
+		m, e := rewriter.NewMatcher(s)
+		if e != nil {
+			log.Fatalln(e)
+		}
+		h2cHostnames = append(h2cHostnames, m)
+		log.Println(`h2c hostname`, m)
 	}
-	if len(r.Hosts) != 0 {
-		b.WriteString(fmt.Sprintf(` hosts=%v`, r.Hosts))
+	if guard != nil {
+		// 自定義的 HookDo 需要自己使用 guard 撥號
+		client = guard.HTTPClient()
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
 	}
-	if len(r.Hostnames) != 0 {
-		b.WriteString(fmt.Sprintf(` hostnames=%v`, r.Hostnames))
+	if len(h2cHosts) != 0 || len(h2cHostnames) != 0 {
+		h2cClient = &http.Client{
+			Transport: &http2.Transport{
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					if guard != nil {
+						return guard.DialContext(context.Background(), network, addr)
+					}
+					return net.Dial(network, addr)
+				},
+				AllowHTTP: true,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
 	}
-	return b.String()
+	opts = append(opts, httpadapter.ServerHookDo(httpadapter.HookDoFunc(func(req *http.Request) (resp *http.Response, e error) {
+		useh2c := false
+		if h2cClient != nil {
+			for _, m := range h2cHosts {
+				if m.Match(req.URL.Host) {
+					useh2c = true
+					break
+				}
+			}
+			if !useh2c {
+				s := req.URL.Hostname()
+				for _, m := range h2cHostnames {
+					if m.Match(s) {
+						useh2c = true
+						break
+					}
+				}
+			}
+		}
+		if useh2c {
+			resp, e = h2cClient.Do(req)
+		} else {
+			resp, e = client.Do(req)
+		}
+		return
+	})))
+	return
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/powerpuffpenguin/httpadapter"
+	"github.com/spf13/cobra"
+)
+
+// 由 stdin 與 stdout 組成的數據流
+type stdioStream struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdioStream) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+func stdio() *cobra.Command {
+	var (
+		cnfpath string
+	)
+	cmd := &cobra.Command{
+		Use:   "stdio",
+		Short: "run http adapter server on stdin and stdout, e.g. as an ssh subsystem",
+		Run: func(cmd *cobra.Command, args []string) {
+			// stdout 用於傳輸數據，日誌只能寫到 stderr
+			gin.DefaultWriter = os.Stderr
+			log.SetOutput(os.Stderr)
+
+			var cnf *Server
+			var e error
+			if cnfpath == `` {
+				cnf = &Server{}
+			} else {
+				cnf, e = LoadServer(cnfpath)
+				if e != nil {
+					log.Fatalln(e)
+				}
+			}
+			opts, chain := newServerOptions(cnf)
+			server := httpadapter.NewServer(opts...)
+			if chain != nil {
+				chain.Server = server
+			}
+			e = server.ServeConn(context.Background(), stdioStream{
+				Reader: os.Stdin,
+				Writer: os.Stdout,
+			})
+			if e != nil {
+				log.Fatalln(e)
+			}
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&cnfpath, `cnf`, `c`, filepath.Join(BasePath(), `etc`, `server.jsonnet`), `configure file`)
+	return cmd
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"sync"
 
 	"github.com/gin-gonic/gin"
@@ -103,6 +104,18 @@ func NewTunnelServer(cnf *Tunnel, keys map[string]*httpadapter.Client) (srv *Tun
 	if cnf.Ping > 0 {
 		opts = append(opts, httpadapter.WithPing(cnf.Ping))
 	}
+	if cnf.Checksum {
+		opts = append(opts, httpadapter.WithChecksum(true))
+	}
+	if cnf.Bandwidth.Channel > 0 || cnf.Bandwidth.Chain > 0 {
+		opts = append(opts, httpadapter.WithBandwidth(cnf.Bandwidth.Channel, cnf.Bandwidth.Chain))
+	}
+	if cnf.ChainIdleTimeout > 0 {
+		opts = append(opts, httpadapter.WithChainIdleTimeout(cnf.ChainIdleTimeout))
+	}
+	if cnf.ChannelIdleTimeout > 0 {
+		opts = append(opts, httpadapter.WithChannelIdleTimeout(cnf.ChannelIdleTimeout))
+	}
 	b, e := json.Marshal(cnf.Server)
 	if e != nil {
 		return
@@ -123,6 +136,13 @@ func NewTunnelServer(cnf *Tunnel, keys map[string]*httpadapter.Client) (srv *Tun
 	} else {
 		key += `-0-0`
 	}
+	if cnf.Checksum {
+		key += `-1`
+	} else {
+		key += `-0`
+	}
+	key += `-` + strconv.Itoa(cnf.Bandwidth.Channel) + `-` + strconv.Itoa(cnf.Bandwidth.Chain)
+	key += `-` + cnf.ChainIdleTimeout.String() + `-` + cnf.ChannelIdleTimeout.String()
 	client, ok := keys[key]
 	if !ok {
 		client = httpadapter.NewClient(cnf.Server, opts...)
@@ -0,0 +1,91 @@
+package httpadapter
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+var errUnsupportedEncoding = errors.New(`unsupported encoding`)
+
+// 服務器能夠編碼/解碼的壓縮格式，按照優先順序排列
+var supportedEncodings = []string{
+	core.EncodingZstd,
+	core.EncodingGzip,
+	core.EncodingDeflate,
+}
+
+// 返回是否支持此壓縮編碼
+func isSupportedEncoding(encoding string) bool {
+	for _, s := range supportedEncodings {
+		if s == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// 規範化 Content-Encoding
+func normalizeEncoding(encoding string) string {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == `x-gzip` {
+		encoding = core.EncodingGzip
+	}
+	return encoding
+}
+
+// 可以刷新的壓縮寫入器
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// 創建一個壓縮寫入器，Close 會寫入壓縮尾但不會關閉 w
+func newCompressWriter(encoding string, w io.Writer) (compressWriter, error) {
+	switch encoding {
+	case core.EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case core.EncodingDeflate:
+		return zlib.NewWriter(w), nil
+	case core.EncodingZstd:
+		// 每個響應與通道都會創建一個寫入器，使用單線程與較小的窗口以減少內存佔用
+		return zstd.NewWriter(w,
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(1024*256),
+		)
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// 創建一個解壓讀取器
+func newDecompressReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case core.EncodingGzip:
+		return gzip.NewReader(r)
+	case core.EncodingDeflate:
+		// 部分 http 服務器會返回沒有 zlib 頭的 deflate 數據
+		br := bufio.NewReader(r)
+		b, e := br.Peek(2)
+		if e != nil && e != io.EOF {
+			return nil, e
+		}
+		if len(b) == 2 && b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case core.EncodingZstd:
+		d, e := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if e != nil {
+			return nil, e
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, errUnsupportedEncoding
+}
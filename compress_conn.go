@@ -0,0 +1,136 @@
+package httpadapter
+
+import (
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+var errCompressConnClosed = errors.New(`compress conn closed`)
+
+// 關閉時寫入壓縮尾的最長時間，對端不讀取數據時不應該讓 Close 永遠阻塞
+const compressTrailerTimeout = time.Second
+
+// 返回是否支持對 tcp/ws 通道數據流進行此壓縮
+func isSupportedStreamEncoding(encoding string) bool {
+	return encoding == core.EncodingDeflate || encoding == core.EncodingZstd
+}
+
+// 對通道數據流進行壓縮的 net.Conn，每次 Write 後都會刷新壓縮數據以免影響交互延遲
+type compressConn struct {
+	net.Conn
+	encoding string
+
+	r    io.ReadCloser
+	rerr error
+
+	w      compressWriter
+	locker sync.Mutex
+	closed int32
+}
+
+func newCompressConn(c net.Conn, encoding string) (*compressConn, error) {
+	var (
+		w compressWriter
+		e error
+	)
+	switch encoding {
+	case core.EncodingDeflate, core.EncodingZstd:
+		w, e = newCompressWriter(encoding, c)
+		if e != nil {
+			return nil, e
+		}
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	return &compressConn{
+		Conn:     c,
+		encoding: encoding,
+		w:        w,
+	}, nil
+}
+
+// 解壓讀取器在首次讀取時才創建，因爲創建時會阻塞讀取壓縮頭
+func (c *compressConn) Read(b []byte) (n int, e error) {
+	if c.r == nil {
+		if c.rerr != nil {
+			e = c.rerr
+			return
+		}
+		switch c.encoding {
+		case core.EncodingDeflate:
+			c.r, e = zlib.NewReader(c.Conn)
+		default:
+			var d *zstd.Decoder
+			d, e = zstd.NewReader(c.Conn,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderLowmem(true),
+			)
+			if e == nil {
+				c.r = d.IOReadCloser()
+			}
+		}
+		if e != nil {
+			c.rerr = e
+			return
+		}
+	}
+	return c.r.Read(b)
+}
+func (c *compressConn) Write(b []byte) (n int, e error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if atomic.LoadInt32(&c.closed) != 0 {
+		e = errCompressConnClosed
+		return
+	}
+	n, e = c.w.Write(b)
+	if e != nil {
+		return
+	}
+	e = c.w.Flush()
+	return
+}
+
+// 如果 Write 正被對端的流量控制阻塞則不寫入壓縮尾，直接關閉通道以解除 Write 的阻塞
+func (c *compressConn) Close() (e error) {
+	if atomic.SwapInt32(&c.closed, 1) != 0 {
+		e = errCompressConnClosed
+		return
+	}
+	if c.locker.TryLock() {
+		// 寫入壓縮尾，讓對端能夠讀取到 io.EOF
+		c.Conn.SetWriteDeadline(time.Now().Add(compressTrailerTimeout))
+		c.w.Close()
+		c.locker.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+// 在服務器端包裝 forwardConn 使用的通道
+type compressChannel struct {
+	*compressConn
+	c Conn
+}
+
+func newCompressChannel(c Conn, encoding string) (Conn, error) {
+	cc, e := newCompressConn(c, encoding)
+	if e != nil {
+		return nil, e
+	}
+	return compressChannel{
+		compressConn: cc,
+		c:            c,
+	}, nil
+}
+func (c compressChannel) Context() context.Context {
+	return c.c.Context()
+}
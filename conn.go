@@ -2,10 +2,55 @@ package httpadapter
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
+	"time"
 )
 
+var errRWCDeadline = errors.New(`httpadapter: stream conn does not support deadline`)
+
 type Conn interface {
 	net.Conn
 	Context() context.Context
 }
+
+// 數據流沒有網路地址
+type rwcAddr struct{}
+
+func (rwcAddr) Network() string {
+	return `stream`
+}
+func (rwcAddr) String() string {
+	return `stream`
+}
+
+// 將任意的數據流適配爲 net.Conn，不支持截止時間
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+// 如果 rwc 已經是 net.Conn 則直接返回
+func newRWCConn(rwc io.ReadWriteCloser) net.Conn {
+	if c, ok := rwc.(net.Conn); ok {
+		return c
+	}
+	return rwcConn{
+		ReadWriteCloser: rwc,
+	}
+}
+func (c rwcConn) LocalAddr() net.Addr {
+	return rwcAddr{}
+}
+func (c rwcConn) RemoteAddr() net.Addr {
+	return rwcAddr{}
+}
+func (c rwcConn) SetDeadline(t time.Time) error {
+	return errRWCDeadline
+}
+func (c rwcConn) SetReadDeadline(t time.Time) error {
+	return errRWCDeadline
+}
+func (c rwcConn) SetWriteDeadline(t time.Time) error {
+	return errRWCDeadline
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/textproto"
+)
+
+// 如果 Message 的 bodylen 爲此值，則 body 以 chunked 方式傳輸
+//
+// 每個 chunk 由 len(2 字節)+data 組成，len 爲 0 的 chunk 表示 body 結束
+const BodyChunked uint64 = math.MaxUint64
+
+var errTrailerTooLarge = errors.New(`trailer too large`)
+
+// 從 chunked body 中讀取數據，讀取到結束 chunk 後返回 io.EOF
+type ChunkedReader struct {
+	r   io.Reader
+	n   int
+	b   [2]byte
+	err error
+}
+
+func NewChunkedReader(r io.Reader) *ChunkedReader {
+	return &ChunkedReader{
+		r: r,
+	}
+}
+func (r *ChunkedReader) Read(p []byte) (n int, e error) {
+	if r.err != nil {
+		e = r.err
+		return
+	} else if len(p) == 0 {
+		return
+	}
+	for r.n == 0 {
+		_, e = io.ReadFull(r.r, r.b[:])
+		if e != nil {
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			r.err = e
+			return
+		}
+		r.n = int(ByteOrder.Uint16(r.b[:]))
+		if r.n == 0 {
+			e = io.EOF
+			r.err = e
+			return
+		}
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, e = r.r.Read(p)
+	r.n -= n
+	if e == io.EOF {
+		if r.n != 0 {
+			e = io.ErrUnexpectedEOF
+			r.err = e
+		} else {
+			e = nil
+		}
+	} else if e != nil {
+		r.err = e
+	}
+	return
+}
+
+// 將數據以 chunked 方式寫入，Close 時寫入結束 chunk
+type ChunkedWriter struct {
+	w      io.Writer
+	b      []byte
+	closed bool
+}
+
+func NewChunkedWriter(w io.Writer) *ChunkedWriter {
+	return &ChunkedWriter{
+		w: w,
+	}
+}
+func (w *ChunkedWriter) Write(p []byte) (n int, e error) {
+	if w.closed {
+		e = io.ErrClosedPipe
+		return
+	}
+	var size int
+	for len(p) != 0 {
+		size = len(p)
+		if size > math.MaxUint16 {
+			size = math.MaxUint16
+		}
+		if cap(w.b) < 2+size {
+			w.b = make([]byte, 2+size)
+		}
+		b := w.b[:2+size]
+		ByteOrder.PutUint16(b, uint16(size))
+		copy(b[2:], p[:size])
+		_, e = w.w.Write(b)
+		if e != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+// 寫入結束 chunk
+func (w *ChunkedWriter) Close() (e error) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	_, e = w.w.Write([]byte{0, 0})
+	return
+}
+
+// 寫入 trailer 塊，由 len(2 字節)+json 組成
+func WriteTrailer(w io.Writer, trailer http.Header) (e error) {
+	b := make([]byte, 2, 128)
+	if len(trailer) != 0 {
+		var data []byte
+		data, e = json.Marshal(trailer)
+		if e != nil {
+			return
+		} else if len(data) > math.MaxUint16 {
+			e = errTrailerTooLarge
+			return
+		}
+		b = append(b, data...)
+	}
+	ByteOrder.PutUint16(b, uint16(len(b)-2))
+	_, e = w.Write(b)
+	return
+}
+
+// 讀取 trailer 塊
+func ReadTrailer(r io.Reader) (trailer http.Header, e error) {
+	var b [2]byte
+	_, e = io.ReadFull(r, b[:])
+	if e != nil {
+		return
+	}
+	size := int(ByteOrder.Uint16(b[:]))
+	if size == 0 {
+		trailer = make(http.Header)
+		return
+	}
+	data := make([]byte, size)
+	_, e = io.ReadFull(r, data)
+	if e != nil {
+		return
+	}
+	var tmp http.Header
+	e = json.Unmarshal(data, &tmp)
+	if e != nil {
+		return
+	}
+	trailer = make(http.Header, len(tmp))
+	for k, v := range tmp {
+		trailer[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	return
+}
@@ -0,0 +1,9 @@
+package core
+
+// 中轉層支持的壓縮編碼
+const (
+	EncodingIdentity = `identity`
+	EncodingDeflate  = `deflate`
+	EncodingGzip     = `gzip`
+	EncodingZstd     = `zstd`
+)
@@ -0,0 +1,57 @@
+package core
+
+import "strconv"
+
+// 中轉層的錯誤代碼，用於區分是服務器拒絕了請求還是上游返回了 http 錯誤
+type ErrorCode uint16
+
+const (
+	// 請求的元信息無效
+	ErrorBadRequest ErrorCode = 1
+	// 請求被服務器的轉發策略拒絕
+	ErrorRejectedByPolicy ErrorCode = 2
+	// 服務器不支持請求的 scheme/method/mode
+	ErrorUnsupported ErrorCode = 3
+	// 請求 body 超過了服務器限制
+	ErrorBodyTooLarge ErrorCode = 4
+	// 服務器無法連接上游
+	ErrorUpstreamUnreachable ErrorCode = 5
+	// 上游的響應無法被轉發，例如沒有設置 content-length 或者讀取響應失敗
+	ErrorUpstreamError ErrorCode = 6
+	// 超過了服務器的請求速率或流量配額
+	ErrorRateLimited ErrorCode = 7
+	// 上游沒有在服務器限制的時間內響應
+	ErrorTimeout ErrorCode = 8
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorBadRequest:
+		return `Bad Request`
+	case ErrorRejectedByPolicy:
+		return `Rejected By Policy`
+	case ErrorUnsupported:
+		return `Unsupported`
+	case ErrorBodyTooLarge:
+		return `Body Too Large`
+	case ErrorUpstreamUnreachable:
+		return `Upstream Unreachable`
+	case ErrorUpstreamError:
+		return `Upstream Error`
+	case ErrorRateLimited:
+		return `Rate Limited`
+	case ErrorTimeout:
+		return `Timeout`
+	}
+	return `Unknow Error(` + strconv.Itoa(int(c)) + `)`
+}
+
+// 服務器返回的結構化錯誤
+type Error struct {
+	// 錯誤代碼
+	Code ErrorCode `json:"code"`
+	// 錯誤描述
+	Message string `json:"message"`
+	// 可選的錯誤詳情
+	Details map[string]string `json:"details,omitempty"`
+}
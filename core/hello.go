@@ -6,6 +6,7 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var ErrUnknowProtocol = errors.New("unknow protocol")
@@ -45,6 +46,33 @@ func (e HelloError) Error() string {
 	return Hello(e).String()
 }
 
+// hello message 中重試提示的前綴
+const retryAfterPrefix = `; retry-after=`
+
+// 返回帶有重試提示的 hello message，例如 'Server Busy; retry-after=5'，提示以秒爲單位並向上取整
+func RetryAfterMessage(h Hello, retryAfter time.Duration) string {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return h.String() + retryAfterPrefix + strconv.FormatInt(seconds, 10)
+}
+
+// 解析 hello message 中的重試提示
+func ParseRetryAfter(message string) (retryAfter time.Duration, ok bool) {
+	i := strings.LastIndex(message, retryAfterPrefix)
+	if i < 0 {
+		return
+	}
+	seconds, e := strconv.ParseInt(message[i+len(retryAfterPrefix):], 10, 64)
+	if e != nil || seconds < 1 {
+		return
+	}
+	retryAfter = time.Duration(seconds) * time.Second
+	ok = true
+	return
+}
+
 // 客戶端發送的 hello 消息
 type ClientHello struct {
 	// Flag string = Flag
@@ -6,11 +6,32 @@ import (
 	"net/textproto"
 )
 
+const (
+	// 一元請求
+	ModeUnary = ``
+	// Server-Sent Events 請求
+	ModeEvent = `sse`
+	// 全雙工的 http 流請求，請求和響應 body 都以 chunked 方式傳輸
+	ModeStream = `stream`
+)
+
 // 客戶端發送的元信息
 type ClientMetadata struct {
 	URL    string      `json:"url"`
 	Method string      `json:"method"`
 	Header http.Header `json:"header"`
+	// 如何轉發 http/https 請求，默認爲一元請求
+	Mode string `json:"mode,omitempty"`
+	// 要求服務器在響應 body 之後返回 trailer 塊
+	Trailer bool `json:"trailer,omitempty"`
+	// 如果爲 true 客戶端會等待服務器返回 100 響應後才發送 body
+	Continue bool `json:"continue,omitempty"`
+	// 客戶端能夠解碼的響應壓縮編碼，按照優先順序排列，設置後響應 body 可能以 chunked 方式傳輸
+	Encoding []string `json:"encoding,omitempty"`
+	// 要求服務器使用此編碼壓縮 tcp/ws 通道的數據流，支持 deflate 與 zstd
+	Compress string `json:"compress,omitempty"`
+	// 客戶端能夠處理 websocket 控制幀，服務器會轉發 ping pong close 並進行完整的關閉握手
+	Control bool `json:"control,omitempty"`
 }
 
 func (m *ClientMetadata) Unmarshal(data []byte) (e error) {
@@ -34,8 +55,55 @@ func (m *ClientMetadata) Unmarshal(data []byte) (e error) {
 	return
 }
 
+// 服務器在 Server-Sent Events 請求中轉發的事件
+type Event struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data,omitempty"`
+	// 重連等待毫秒數，爲 0 表示上游沒有設置
+	Retry int64 `json:"retry,omitempty"`
+	// 事件是否包含了 id 字段，包含 id 的事件會更新 Last-Event-ID
+	HasID bool `json:"hasID,omitempty"`
+	// 事件是否包含了 data 字段，只有包含 data 的事件需要派發給使用者
+	HasData bool `json:"hasData,omitempty"`
+}
+
+// 事件幀的最大長度
+const MaxEventSize = 1024 * 1024
+
 // 服務器發送的元信息
 type ServerMetadata struct {
 	Status int         `json:"status"`
 	Header http.Header `json:"header"`
+	// 如果爲 true 則 body 之後會跟隨一個 trailer 塊
+	Trailer bool `json:"trailer,omitempty"`
+	// 如果不爲 nil 則表示請求沒有被轉發到上游或轉發失敗，body 是錯誤描述的文本
+	Error *Error `json:"error,omitempty"`
+	// 101 響應之後通道數據流使用的壓縮編碼，爲空表示沒有壓縮
+	Compress string `json:"compress,omitempty"`
+}
+
+// 返回 method 是否是一個符合 RFC 7230 token 定義的 http 方法
+func ValidMethod(method string) bool {
+	if method == `` {
+		return false
+	}
+	for i := 0; i < len(method); i++ {
+		if !isTokenChar(method[i]) {
+			return false
+		}
+	}
+	return true
+}
+func isTokenChar(c byte) bool {
+	if c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' {
+		return true
+	}
+	switch c {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
 }
@@ -5,3 +5,6 @@ const Version = "v0.0.2"
 
 // 協議版本
 const ProtocolVersion = "1.0"
+
+// 在協議版本上增加 crc32c 幀校驗，客戶端在 hello 中將它放在 ProtocolVersion 之前以請求服務器啓用校驗
+const ProtocolVersionCRC32C = ProtocolVersion + "+crc32c"
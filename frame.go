@@ -0,0 +1,169 @@
+package httpadapter
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+var errFrameLost = errors.New(`httpadapter: tcp-chain frame lost`)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 幀開始標記，用於在數據損壞後重新同步
+var frameMagic = [2]byte{0xa5, 0xc3}
+
+const (
+	// magic(2) + length(4) + id(8) + seq(4) + crc32c(4)
+	frameHeaderSize = 2 + 4 + 8 + 4 + 4
+	// 最大的指令是帶有 64k 數據的 Write
+	maxFramePayload = 1 + 8 + 2 + math.MaxUint16
+)
+
+// 返回指令所屬的 channel，ping 與 pong 返回 0
+func frameID(b []byte) uint64 {
+	if len(b) >= 9 {
+		switch core.Command(b[0]) {
+		case core.CommandCreate, core.CommandClose, core.CommandWrite, core.CommandConfirm:
+			return core.ByteOrder.Uint64(b[1:])
+		}
+	}
+	return 0
+}
+
+// 將每個指令寫入爲一個帶有 crc32c 校驗的幀
+//
+//	| magic 2 | length 4 | id 8 | seq 4 | header crc32c 4 | payload length | payload crc32c 4 |
+type frameWriter struct {
+	header [frameHeaderSize + 4]byte
+	seq    uint32
+}
+
+func (f *frameWriter) write(w io.Writer, b []byte) (e error) {
+	header := f.header[:frameHeaderSize]
+	copy(header, frameMagic[:])
+	core.ByteOrder.PutUint32(header[2:], uint32(len(b)))
+	core.ByteOrder.PutUint64(header[6:], frameID(b))
+	core.ByteOrder.PutUint32(header[14:], f.seq)
+	f.seq++
+	core.ByteOrder.PutUint32(header[18:], crc32.Checksum(header[:18], crc32cTable))
+	_, e = w.Write(header)
+	if e != nil {
+		return
+	}
+	_, e = w.Write(b)
+	if e != nil {
+		return
+	}
+	sum := f.header[frameHeaderSize:]
+	core.ByteOrder.PutUint32(sum, crc32.Checksum(b, crc32cTable))
+	_, e = w.Write(sum)
+	return
+}
+
+// 讀取 frameWriter 寫入的幀，將有效幀的指令作爲連續的數據流返回
+//
+// 頭損壞時丟棄 magic 並向後查找下一個幀；數據損壞時丟棄此幀並調用 reset 重置幀所屬的 channel；
+// 如果發現序號不連續，說明有頭損壞的幀被丟棄而無法知道它屬於哪個 channel，此時返回 errFrameLost
+type frameReader struct {
+	r io.Reader
+	// 重新查找幀時需要再次掃描的數據
+	pending []byte
+	// 當前幀還沒有讀取的指令數據
+	payload []byte
+	buf     []byte
+	header  [frameHeaderSize]byte
+	seq     uint32
+	reset   func(id uint64)
+}
+
+func newFrameReader(r io.Reader, reset func(id uint64)) *frameReader {
+	return &frameReader{
+		r:     r,
+		reset: reset,
+	}
+}
+func (f *frameReader) Read(b []byte) (n int, e error) {
+	for len(f.payload) == 0 {
+		e = f.next()
+		if e != nil {
+			return
+		}
+	}
+	n = copy(b, f.payload)
+	f.payload = f.payload[n:]
+	return
+}
+
+// 優先讀取需要重新掃描的數據
+func (f *frameReader) readFull(b []byte) (e error) {
+	n := copy(b, f.pending)
+	f.pending = f.pending[n:]
+	if n < len(b) {
+		_, e = io.ReadFull(f.r, b[n:])
+	}
+	return
+}
+
+// 將數據放回以便重新掃描
+func (f *frameReader) unread(b []byte) {
+	pending := make([]byte, len(b)+len(f.pending))
+	copy(pending, b)
+	copy(pending[len(b):], f.pending)
+	f.pending = pending
+}
+
+// 讀取下一個幀，損壞的幀被丟棄時 payload 爲空
+func (f *frameReader) next() (e error) {
+	header := f.header[:]
+	e = f.readFull(header[:2])
+	if e != nil {
+		return
+	}
+	for header[0] != frameMagic[0] || header[1] != frameMagic[1] {
+		header[0] = header[1]
+		e = f.readFull(header[1:2])
+		if e != nil {
+			return
+		}
+	}
+	e = f.readFull(header[2:])
+	if e != nil {
+		return
+	}
+	size := core.ByteOrder.Uint32(header[2:])
+	if core.ByteOrder.Uint32(header[18:]) != crc32.Checksum(header[:18], crc32cTable) ||
+		size == 0 || size > maxFramePayload {
+		Logger.Println(`tcp-chain frame header corrupted, resynchronizing`)
+		f.unread(header[1:])
+		return
+	}
+	id := core.ByteOrder.Uint64(header[6:])
+	seq := core.ByteOrder.Uint32(header[14:])
+	if seq != f.seq {
+		e = errFrameLost
+		return
+	}
+	f.seq++
+
+	if cap(f.buf) < int(size)+4 {
+		f.buf = make([]byte, size+4)
+	}
+	b := f.buf[:size+4]
+	e = f.readFull(b)
+	if e != nil {
+		return
+	}
+	if core.ByteOrder.Uint32(b[size:]) != crc32.Checksum(b[:size], crc32cTable) {
+		Logger.Printf("tcp-chain frame of channel(%v) corrupted\n", id)
+		if id != 0 && f.reset != nil {
+			f.reset(id)
+		}
+		return
+	}
+	f.payload = b[:size]
+	return
+}
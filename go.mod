@@ -4,12 +4,15 @@ go 1.19
 
 require (
 	github.com/gorilla/websocket v1.5.0
+	github.com/klauspost/compress v1.16.7
 	github.com/powerpuffpenguin/easygo v0.0.0-20230316080029-33289e841b52
 	github.com/stretchr/testify v1.8.2
+	golang.org/x/net v0.9.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,178 @@
+package httpadapter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrDestinationDenied = errors.New("httpadapter: destination denied")
+
+// 默認禁止訪問的網段，包括本機、區域網路、鏈路本地(雲服務商的 metadata 接口) 與保留地址
+//
+// NAT64(64:ff9b::/96) 與 6to4(2002::/16) 地址由 DestinationGuard 提取內嵌的 ipv4 後再次檢查，
+// 而站點自定義的 NAT64 前綴 64:ff9b:1::/48 無法確定內嵌位置所以全部禁止
+var DefaultDenyCIDRs = []string{
+	`0.0.0.0/8`,
+	`10.0.0.0/8`,
+	`100.64.0.0/10`,
+	`127.0.0.0/8`,
+	`169.254.0.0/16`,
+	`172.16.0.0/12`,
+	`192.0.0.0/24`,
+	`192.168.0.0/16`,
+	`198.18.0.0/15`,
+	`224.0.0.0/4`,
+	`240.0.0.0/4`,
+	`::/128`,
+	`::1/128`,
+	`64:ff9b:1::/48`,
+	`fc00::/7`,
+	`fe80::/10`,
+	`ff00::/8`,
+}
+
+// 目標地址守衛
+//
+// 它在撥號時(dns 解析之後)檢查實際連接的 ip，所以無法通過 DNS rebinding 繞過，
+// 在 allow 中的 ip 總是被允許，否則在 deny 中的 ip 會被拒絕
+type DestinationGuard struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// 創建一個目標地址守衛，如果 deny 爲 nil 則使用 DefaultDenyCIDRs
+func NewDestinationGuard(allow, deny []string) (g *DestinationGuard, e error) {
+	if deny == nil {
+		deny = DefaultDenyCIDRs
+	}
+	var tmp DestinationGuard
+	tmp.allow, e = parseCIDRs(allow)
+	if e != nil {
+		return
+	}
+	tmp.deny, e = parseCIDRs(deny)
+	if e != nil {
+		return
+	}
+	g = &tmp
+	return
+}
+func parseCIDRs(strs []string) (nets []*net.IPNet, e error) {
+	if len(strs) == 0 {
+		return
+	}
+	nets = make([]*net.IPNet, 0, len(strs))
+	var ipnet *net.IPNet
+	for _, s := range strs {
+		_, ipnet, e = net.ParseCIDR(s)
+		if e != nil {
+			return
+		}
+		nets = append(nets, ipnet)
+	}
+	return
+}
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回是否允許連接此 ip
+//
+// 對於內嵌了 ipv4 的 NAT64 與 6to4 地址，內嵌的 ipv4 也必須被允許，
+// 否則可以通過例如 64:ff9b::a00:1 訪問到 10.0.0.1
+func (g *DestinationGuard) Allowed(ip net.IP) bool {
+	if containsIP(g.allow, ip) {
+		return true
+	} else if containsIP(g.deny, ip) {
+		return false
+	}
+	if v4 := embeddedIPv4(ip); v4 != nil {
+		return g.Allowed(v4)
+	}
+	return true
+}
+
+var nat64Prefix = net.IP{0, 0x64, 0xff, 0x9b, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// 返回 NAT64(64:ff9b::/96) 或 6to4(2002::/16) 地址內嵌的 ipv4，其它地址返回 nil
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return nil
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+	if nat64Prefix.Equal(ip[:12]) {
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+	} else if ip[0] == 0x20 && ip[1] == 0x02 {
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5])
+	}
+	return nil
+}
+
+// 可以作爲 net.Dialer.Control 使用，address 是已經解析過的 ip:port
+func (g *DestinationGuard) Control(network, address string, c syscall.RawConn) error {
+	host, _, e := net.SplitHostPort(address)
+	if e != nil {
+		return e
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !g.Allowed(ip) {
+		return &DestinationError{Address: address}
+	}
+	return nil
+}
+
+// 使用守衛撥號
+func (g *DestinationGuard) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   g.Control,
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// 返回一個使用守衛撥號的 http.Client
+//
+// 它不會使用環境變量中的代理，因爲通過代理撥號時守衛只能檢查代理地址
+func (g *DestinationGuard) HTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = g.DialContext
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
+// 返回一個使用守衛撥號的 websocket.Dialer，同樣不會使用代理
+func (g *DestinationGuard) WebsocketDialer() *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDialContext:   g.DialContext,
+		HandshakeTimeout: 45 * time.Second,
+	}
+}
+
+// 目標地址被守衛拒絕
+type DestinationError struct {
+	Address string
+}
+
+func (e *DestinationError) Error() string {
+	return ErrDestinationDenied.Error() + `: ` + e.Address
+}
+func (e *DestinationError) Unwrap() error {
+	return ErrDestinationDenied
+}
@@ -2,9 +2,23 @@ package httpadapter
 
 import (
 	"net"
+	"net/http"
 	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// 創建兼容 http 使用的服務器，除了 http/1.1 還支持 h2c(prior knowledge 與 Upgrade) 以及 tls 協商的 h2
+func newHTTPServer(handler http.Handler) *http.Server {
+	h2 := &http2.Server{}
+	srv := &http.Server{
+		Handler: h2c.NewHandler(handler, h2),
+	}
+	http2.ConfigureServer(srv, h2)
+	return srv
+}
+
 type httpListner struct {
 	done chan struct{}
 	ch   chan net.Conn
@@ -21,6 +35,15 @@ func (l *httpListner) Accept() (net.Conn, error) {
 	}
 }
 
+// 將連接交給 http.Serve 處理
+func (l *httpListner) serve(c net.Conn) {
+	select {
+	case l.ch <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
 // Close closes the listener.
 // Any blocked Accept operations will be unblocked and return errors.
 func (l *httpListner) Close() error {
@@ -0,0 +1,281 @@
+package httpadapter
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+// 令牌桶限流設定，Rate 是每秒補充的令牌數量，Burst 是桶的容量
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// 返回是否啓用了限流
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// 令牌桶，不是 goroutine 安全的
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+// 補充令牌，返回桶是否已滿
+func (b *tokenBucket) refill(now time.Time) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.limit.Rate
+		b.last = now
+	}
+	burst := float64(b.limit.Burst)
+	if b.tokens >= burst {
+		b.tokens = burst
+		return true
+	}
+	return false
+}
+
+// 嘗試取出一個令牌
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 按照鍵值區分的令牌桶，定期刪除已經補滿的桶以免佔用內存
+type keyedLimiter struct {
+	limit RateLimit
+	sync.Mutex
+	keys  map[string]*tokenBucket
+	sweep time.Time
+}
+
+func newKeyedLimiter(limit RateLimit) *keyedLimiter {
+	if !limit.enabled() {
+		return nil
+	}
+	return &keyedLimiter{
+		limit: limit,
+		keys:  make(map[string]*tokenBucket),
+		sweep: time.Now(),
+	}
+}
+func (l *keyedLimiter) allow(key string) (ok bool) {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.Lock()
+	if now.Sub(l.sweep) > time.Minute {
+		l.sweep = now
+		for k, b := range l.keys {
+			if b.refill(now) {
+				delete(l.keys, k)
+			}
+		}
+	}
+	b, exists := l.keys[key]
+	if !exists {
+		b = newTokenBucket(l.limit, now)
+		l.keys[key] = b
+	}
+	ok = b.allow(now)
+	l.Unlock()
+	return
+}
+
+// 按照身份統計每天的流量配額，以本地時間的日期區分每一天
+type dailyQuota struct {
+	limit int64
+	sync.Mutex
+	day  int
+	used map[string]int64
+}
+
+func newDailyQuota(limit int64) *dailyQuota {
+	if limit < 1 {
+		return nil
+	}
+	return &dailyQuota{
+		limit: limit,
+		used:  make(map[string]int64),
+	}
+}
+
+// 返回今天的編號
+func quotaDay(now time.Time) int {
+	y, m, d := now.Date()
+	return y*10000 + int(m)*100 + d
+}
+
+// 記錄使用的流量，返回是否還沒有超過配額
+func (q *dailyQuota) add(key string, n int64) (ok bool) {
+	if q == nil {
+		return true
+	}
+	day := quotaDay(time.Now())
+	q.Lock()
+	if q.day != day {
+		// 新的一天清除所有記錄
+		q.day = day
+		q.used = make(map[string]int64)
+	}
+	used := q.used[key] + n
+	q.used[key] = used
+	ok = used < q.limit
+	q.Unlock()
+	return
+}
+
+// 服務器運行時的限流狀態
+type serverLimits struct {
+	// 每個來源 ip 建立 tcp-chain 的速率
+	chains *keyedLimiter
+	// 每個身份的請求速率
+	requests *keyedLimiter
+	// 每個身份每天的流量
+	quota *dailyQuota
+}
+
+func newServerLimits(opts *serverOptions) *serverLimits {
+	return &serverLimits{
+		chains:   newKeyedLimiter(opts.chainRate),
+		requests: newKeyedLimiter(opts.requestRate),
+		quota:    newDailyQuota(opts.dailyQuota),
+	}
+}
+
+// 返回是否允許此地址建立新的 tcp-chain
+func (l *serverLimits) allowChain(addr net.Addr) bool {
+	if l.chains == nil {
+		return true
+	}
+	return l.chains.allow(addrHost(addr))
+}
+
+// 返回被 chain 速率拒絕的客戶端應該等待多久，即補充一個令牌需要的時間
+func (l *serverLimits) chainRetryAfter() time.Duration {
+	if l.chains == nil {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / l.chains.limit.Rate)
+}
+
+// 返回地址中的主機部分，無法解析時返回完整的地址
+func addrHost(addr net.Addr) string {
+	if addr == nil {
+		return ``
+	}
+	s := addr.String()
+	if host, _, e := net.SplitHostPort(s); e == nil {
+		return host
+	}
+	return s
+}
+
+// 返回請求者的身份，用於按照身份限流與統計流量配額
+type HookIdentity interface {
+	Identity(c Conn, md *core.ClientMetadata) string
+}
+type hookIdentityFunc struct {
+	f func(c Conn, md *core.ClientMetadata) string
+}
+
+func HookIdentityFunc(f func(c Conn, md *core.ClientMetadata) string) HookIdentity {
+	return hookIdentityFunc{
+		f: f,
+	}
+}
+func (h hookIdentityFunc) Identity(c Conn, md *core.ClientMetadata) string {
+	return h.f(c, md)
+}
+
+// 默認使用客戶端的 ip 作爲身份
+var defaultIdentity = HookIdentityFunc(func(c Conn, md *core.ClientMetadata) string {
+	return addrHost(c.RemoteAddr())
+})
+
+// 統計流量的 channel，配額用完後的寫入會關閉 channel
+type quotaConn struct {
+	Conn
+	quota    *dailyQuota
+	identity string
+}
+
+// 讀取只計數，響應寫完後服務器可能還會讀取 channel 等待客戶端關閉，此時不應該關閉 channel
+func (c *quotaConn) Read(b []byte) (n int, e error) {
+	n, e = c.Conn.Read(b)
+	if n > 0 {
+		c.quota.add(c.identity, int64(n))
+	}
+	return
+}
+
+// 寫入前計數，以便對面收到數據時流量已經被記錄
+func (c *quotaConn) Write(b []byte) (n int, e error) {
+	if !c.quota.add(c.identity, 0) {
+		c.Conn.Close()
+		e = ErrChannelClosed
+		return
+	}
+	c.quota.add(c.identity, int64(len(b)))
+	n, e = c.Conn.Write(b)
+	return
+}
+
+// 檢查請求速率與流量配額，超過限制時返回 429 並返回 false，否則之後的流量都會計入配額
+func (f *forwardConn) checkLimits(opts *serverOptions, md *core.ClientMetadata) bool {
+	l := f.limits
+	if l == nil || (l.requests == nil && l.quota == nil) {
+		return true
+	}
+	identity := opts.identity.Identity(f.c, md)
+	if !l.requests.allow(identity) {
+		f.sendErrorDetails(http.StatusTooManyRequests, &core.Error{
+			Code:    core.ErrorRateLimited,
+			Message: `request rate limit exceeded`,
+			Details: map[string]string{
+				`limit`: `request rate`,
+				`rate`:  strconv.FormatFloat(opts.requestRate.Rate, 'f', -1, 64),
+			},
+		})
+		return false
+	}
+	if l.quota != nil {
+		if !l.quota.add(identity, 0) {
+			f.sendErrorDetails(http.StatusTooManyRequests, &core.Error{
+				Code:    core.ErrorRateLimited,
+				Message: `daily quota exceeded`,
+				Details: map[string]string{
+					`limit`: `daily quota`,
+					`quota`: strconv.FormatInt(opts.dailyQuota, 10),
+				},
+			})
+			return false
+		}
+		f.c = &quotaConn{
+			Conn:     f.c,
+			quota:    l.quota,
+			identity: identity,
+		}
+	}
+	return true
+}
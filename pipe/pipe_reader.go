@@ -1,10 +1,12 @@
 package pipe
 
 import (
+	"context"
 	"errors"
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var ErrReaderClosed = errors.New(`PipeReader closed`)
@@ -15,6 +17,11 @@ type PipeReader struct {
 	cond   *sync.Cond
 	closed int32
 	wait   int
+
+	// 讀取截止時間，每次設置都會增加 generation 使舊的定時器失效
+	timer      *time.Timer
+	generation uint64
+	expired    bool
 }
 
 func NewPipeReader(size int) (pipe *PipeReader) {
@@ -35,6 +42,42 @@ func (p *PipeReader) Close() {
 		}
 	}
 }
+
+// 設置讀取截止時間，到期後如果沒有可讀數據 Read 返回 context.DeadlineExceeded，零值表示沒有截止時間
+//
+// 已經緩存的數據不會丟失，重新設置截止時間後可以繼續讀取
+func (p *PipeReader) SetReadDeadline(t time.Time) {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.generation++
+	p.expired = false
+	if t.IsZero() {
+		return
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		p.expired = true
+		if p.wait != 0 {
+			p.cond.Broadcast()
+		}
+		return
+	}
+	generation := p.generation
+	p.timer = time.AfterFunc(d, func() {
+		p.cond.L.Lock()
+		if p.generation == generation {
+			p.expired = true
+			if p.wait != 0 {
+				p.cond.Broadcast()
+			}
+		}
+		p.cond.L.Unlock()
+	})
+}
 func (p *PipeReader) Write(b []byte) (n int, e error) {
 	p.cond.L.Lock()
 	defer p.cond.L.Unlock()
@@ -72,6 +115,9 @@ func (p *PipeReader) Read(b []byte) (n int, e error) {
 		if p.closed != 0 {
 			e = io.EOF
 			return
+		} else if p.expired {
+			e = context.DeadlineExceeded
+			return
 		}
 		p.wait++
 		p.cond.Wait()
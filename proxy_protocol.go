@@ -0,0 +1,233 @@
+package httpadapter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var errProxyProtocol = errors.New(`httpadapter: invalid PROXY protocol header`)
+var errProxyUntrusted = errors.New(`httpadapter: PROXY protocol header from untrusted peer`)
+
+// PROXY protocol v2 的簽名
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1 頭的最大長度，包括結尾的 \r\n
+const proxyProtocolV1MaxSize = 107
+
+// 解析了 PROXY protocol 頭的連接，地址使用頭中記錄的客戶端地址
+type proxyConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// 返回是否允許 addr 發送 PROXY protocol 頭，nets 爲空則信任所有來源
+func trustedProxy(nets []*net.IPNet, addr net.Addr) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && containsIP(nets, tcp.IP)
+}
+
+// 從 c 中讀取 PROXY protocol v1 或 v2 頭，返回使用真實地址的連接
+//
+// 只會讀取頭本身的數據，之後的數據留在 c 中。
+// 如果頭表示 LOCAL 或 UNKNOWN 連接或者地址不是 tcp 則使用 c 原本的地址
+func readProxyProtocol(c net.Conn) (conn net.Conn, e error) {
+	b := make([]byte, 16, proxyProtocolV1MaxSize)
+	_, e = io.ReadFull(c, b[:5])
+	if e != nil {
+		return
+	}
+	var local, remote net.Addr
+	if string(b[:5]) == `PROXY` {
+		local, remote, e = readProxyProtocolV1(c, b[:5])
+	} else if bytes.Equal(b[:5], proxyProtocolSignature[:5]) {
+		local, remote, e = readProxyProtocolV2(c, b)
+	} else {
+		e = errProxyProtocol
+	}
+	if e != nil {
+		return
+	}
+	if local == nil || remote == nil {
+		conn = c
+		return
+	}
+	conn = &proxyConn{
+		Conn:       c,
+		localAddr:  local,
+		remoteAddr: remote,
+	}
+	return
+}
+
+// 解析 'PROXY TCP4 src dst sport dport\r\n'
+func readProxyProtocolV1(c net.Conn, b []byte) (local, remote net.Addr, e error) {
+	// 逐字節讀取以免讀取到頭之後的數據
+	one := make([]byte, 1)
+	for !bytes.HasSuffix(b, []byte("\r\n")) {
+		if len(b) >= proxyProtocolV1MaxSize {
+			e = errProxyProtocol
+			return
+		}
+		_, e = io.ReadFull(c, one)
+		if e != nil {
+			return
+		}
+		b = append(b, one[0])
+	}
+	fields := strings.Split(string(b[:len(b)-2]), ` `)
+	if len(fields) < 2 {
+		e = errProxyProtocol
+		return
+	}
+	switch fields[1] {
+	case `UNKNOWN`:
+		return
+	case `TCP4`, `TCP6`:
+		if len(fields) != 6 {
+			e = errProxyProtocol
+			return
+		}
+	default:
+		e = errProxyProtocol
+		return
+	}
+	src := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	sport, e0 := strconv.ParseUint(fields[4], 10, 16)
+	dport, e1 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || e0 != nil || e1 != nil ||
+		(fields[1] == `TCP4` && (src.To4() == nil || dst.To4() == nil)) {
+		e = errProxyProtocol
+		return
+	}
+	remote = &net.TCPAddr{IP: src, Port: int(sport)}
+	local = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return
+}
+
+// 解析 v2 的二進制頭
+func readProxyProtocolV2(c net.Conn, b []byte) (local, remote net.Addr, e error) {
+	_, e = io.ReadFull(c, b[5:16])
+	if e != nil {
+		return
+	} else if !bytes.Equal(b[:12], proxyProtocolSignature) || b[12]>>4 != 2 {
+		e = errProxyProtocol
+		return
+	}
+	command := b[12] & 0xf
+	family := b[13]
+	size := int(binary.BigEndian.Uint16(b[14:]))
+	data := make([]byte, size)
+	_, e = io.ReadFull(c, data)
+	if e != nil {
+		return
+	}
+	switch command {
+	case 0: // LOCAL
+		return
+	case 1: // PROXY
+	default:
+		e = errProxyProtocol
+		return
+	}
+	var ipsize int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipsize = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipsize = net.IPv6len
+	default:
+		// 其它協議不影響連接地址
+		return
+	}
+	if size < ipsize*2+4 {
+		e = errProxyProtocol
+		return
+	}
+	remote = &net.TCPAddr{
+		IP:   net.IP(data[:ipsize]),
+		Port: int(binary.BigEndian.Uint16(data[ipsize*2:])),
+	}
+	local = &net.TCPAddr{
+		IP:   net.IP(data[ipsize : ipsize*2]),
+		Port: int(binary.BigEndian.Uint16(data[ipsize*2+2:])),
+	}
+	return
+}
+
+// 返回一個 PROXY protocol 頭，告訴上游 src 是真實的客戶端地址而 dst 是服務器連接上游使用的目標地址
+//
+// 如果地址不是 tcp 地址則返回 UNKNOWN(v1) 或 LOCAL(v2) 頭
+func formatProxyProtocol(version int, src, dst net.Addr) []byte {
+	srcAddr, ok0 := src.(*net.TCPAddr)
+	dstAddr, ok1 := dst.(*net.TCPAddr)
+	known := ok0 && ok1
+	var srcIP, dstIP net.IP
+	v4 := false
+	if known {
+		srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4()
+		if srcIP != nil && dstIP != nil {
+			v4 = true
+		} else {
+			// 地址族不同時都使用 ipv6 表示
+			srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+			known = srcIP != nil && dstIP != nil
+		}
+	}
+	if version == 2 {
+		b := make([]byte, 16, 16+net.IPv6len*2+4)
+		copy(b, proxyProtocolSignature)
+		if !known {
+			b[12] = 0x20
+			return b
+		}
+		b[12] = 0x21
+		if v4 {
+			b[13] = 0x11
+		} else {
+			b[13] = 0x21
+		}
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		b = binary.BigEndian.AppendUint16(b, uint16(srcAddr.Port))
+		b = binary.BigEndian.AppendUint16(b, uint16(dstAddr.Port))
+		binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+		return b
+	}
+	if !known {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := `TCP6`
+	if v4 {
+		family = `TCP4`
+	}
+	return []byte(`PROXY ` + family + ` ` +
+		formatProxyIP(srcIP, v4) + ` ` + formatProxyIP(dstIP, v4) + ` ` +
+		strconv.Itoa(srcAddr.Port) + ` ` + strconv.Itoa(dstAddr.Port) + "\r\n",
+	)
+}
+
+// TCP6 中的 ipv4 地址需要使用 ipv6 的格式 '::ffff:a.b.c.d'，net.IP.String 會將其輸出爲 ipv4
+func formatProxyIP(ip net.IP, v4 bool) string {
+	if v4 {
+		return ip.String()
+	}
+	return netip.AddrFrom16(*(*[16]byte)(ip)).String()
+}
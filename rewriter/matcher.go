@@ -0,0 +1,125 @@
+package rewriter
+
+import (
+	"regexp"
+	"strings"
+)
+
+// 字符串匹配器
+type Matcher interface {
+	Match(s string) bool
+}
+
+// 創建一個匹配器，支持如下規則
+//   - 'abc.com' 字符串完全匹配
+//   - '*' * 標記匹配任意內容
+//   - '^http' ^ 標記匹配字符串前綴
+//   - 's$' $ 標記匹配字符串後綴
+//   - '@(https)|(wss)' @ 標記使用正則表達式進行匹配
+func NewMatcher(s string) (Matcher, error) {
+	if s == `*` {
+		return matcherAny{}, nil
+	} else if strings.HasPrefix(s, `^`) {
+		return matcherPrefix(s[1:]), nil
+	} else if strings.HasPrefix(s, `@`) {
+		// 先於後綴判斷，這樣正則表達式可以使用 $ 結尾
+		r, e := regexp.Compile(s[1:])
+		if e != nil {
+			return nil, e
+		}
+		return &matcherRegexp{
+			r: r,
+			s: s[1:],
+		}, nil
+	} else if strings.HasSuffix(s, `$`) {
+		return matcherSuffix(s[:len(s)-1]), nil
+	}
+	return matcherEqual(s), nil
+}
+func newMatchers(strs []string) (ms []Matcher, e error) {
+	if len(strs) == 0 {
+		return
+	}
+	ms = make([]Matcher, 0, len(strs))
+	var m Matcher
+	for _, s := range strs {
+		m, e = NewMatcher(s)
+		if e != nil {
+			return
+		}
+		ms = append(ms, m)
+	}
+	return
+}
+
+// 返回第一個匹配 s 的匹配器
+func matchAny(ms []Matcher, s string) (Matcher, bool) {
+	for _, m := range ms {
+		if m.Match(s) {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+type matcherAny struct{}
+
+func (matcherAny) Match(s string) bool {
+	return true
+}
+func (matcherAny) String() string {
+	return `any: *`
+}
+
+type matcherPrefix string
+
+func (m matcherPrefix) Match(s string) bool {
+	return strings.HasPrefix(s, string(m))
+}
+func (m matcherPrefix) String() string {
+	return `prefix: ` + string(m)
+}
+
+type matcherSuffix string
+
+func (m matcherSuffix) Match(s string) bool {
+	return strings.HasSuffix(s, string(m))
+}
+func (m matcherSuffix) String() string {
+	return `suffix: ` + string(m)
+}
+
+type matcherEqual string
+
+func (m matcherEqual) Match(s string) bool {
+	return s == string(m)
+}
+func (m matcherEqual) String() string {
+	return `equal: ` + string(m)
+}
+
+type matcherRegexp struct {
+	r *regexp.Regexp
+	s string
+}
+
+func (m *matcherRegexp) Match(s string) bool {
+	return m.r.MatchString(s)
+}
+func (m *matcherRegexp) String() string {
+	return `regexp: ` + m.s
+}
+
+// 使用 m 匹配 src 得到的捕獲組展開 template，
+// 如果 m 不是正則匹配器則原樣返回 template
+func expand(m Matcher, template, src string) string {
+	r, ok := m.(*matcherRegexp)
+	if !ok {
+		return template
+	}
+	match := r.r.FindStringSubmatchIndex(src)
+	if match == nil {
+		return template
+	}
+	return string(r.r.ExpandString(nil, template, src, match))
+}
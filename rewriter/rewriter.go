@@ -0,0 +1,86 @@
+// rewriter 提供了可以直接作爲 httpadapter.ServerHookURL 使用的 url 重寫與轉發策略
+package rewriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrRejected = errors.New(`url not allowed`)
+
+// CIDRs 規則解析 Hostname 失敗，此時無法判斷規則是否匹配所以拒絕轉發
+var ErrLookup = errors.New(`lookup hostname failed`)
+
+// 默認的 dns 解析超時時間
+const DefaultLookupTimeout = time.Second * 5
+
+// 按照先後順序進行匹配，一旦一個規則被匹配就不會再處理後續規則，沒有規則匹配時 url 保持不變
+//
+// 它實現了 httpadapter.HookURL 與 httpadapter.HookURLHeader
+type Rewriter struct {
+	rules []*rule
+	// 用於解析 CIDRs 規則的 dns 解析器，爲 nil 則使用 net.DefaultResolver
+	Resolver *net.Resolver
+	// 解析 CIDRs 規則的超時時間，<1 則使用 DefaultLookupTimeout
+	LookupTimeout time.Duration
+}
+
+func New(rules ...Rule) (*Rewriter, error) {
+	r := &Rewriter{
+		rules: make([]*rule, 0, len(rules)),
+	}
+	for i := range rules {
+		o, e := newRule(&rules[i])
+		if e != nil {
+			return nil, e
+		}
+		r.rules = append(r.rules, o)
+	}
+	return r, nil
+}
+func (r *Rewriter) Hook(u *url.URL) (*url.URL, error) {
+	u, _, e := r.HookHeader(context.Background(), u, nil)
+	return u, e
+}
+
+// 改寫 url 與要轉發的 http header，返回的 header 可能是 header 的副本
+//
+// ctx 與 LookupTimeout 限制了 CIDRs 規則的 dns 解析時間，
+// 解析失敗時返回包裝了 ErrLookup 的錯誤，以免 Reject 規則因爲解析失敗而被跳過
+func (r *Rewriter) HookHeader(ctx context.Context, u *url.URL, header http.Header) (*url.URL, http.Header, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeout := r.LookupTimeout
+	if timeout < 1 {
+		timeout = DefaultLookupTimeout
+	}
+	for _, o := range r.rules {
+		m, ok, e := o.match(ctx, resolver, timeout, u)
+		if e != nil {
+			return nil, nil, fmt.Errorf(`%w: %s: %v`, ErrLookup, u.Hostname(), e)
+		} else if !ok {
+			continue
+		}
+		if o.reject {
+			return nil, nil, ErrRejected
+		}
+		header = o.rewrite(&m, u, header)
+		break
+	}
+	return u, header, nil
+}
+func (r *Rewriter) String() string {
+	strs := make([]string, len(r.rules))
+	for i, o := range r.rules {
+		strs[i] = o.String()
+	}
+	return strings.Join(strs, "\n")
+}
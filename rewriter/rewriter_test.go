@@ -0,0 +1,225 @@
+package rewriter_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/httpadapter"
+	"github.com/powerpuffpenguin/httpadapter/rewriter"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ httpadapter.HookURLHeader = (*rewriter.Rewriter)(nil)
+
+func newRewriter(t *testing.T, rules ...rewriter.Rule) *rewriter.Rewriter {
+	r, e := rewriter.New(rules...)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	return r
+}
+func hook(t *testing.T, r *rewriter.Rewriter, s string) string {
+	u, e := url.Parse(s)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	u, e = r.Hook(u)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	return u.String()
+}
+func TestMatch(t *testing.T) {
+	r := newRewriter(t,
+		rewriter.Rule{
+			Schemes: []string{`tcp`, `tls`},
+			Reject:  true,
+		},
+		rewriter.Rule{
+			Hostnames: []string{`^api.`},
+			Ports:     []string{`443`},
+			Paths:     []string{`^/v1/`},
+			Host:      `v1.example.com`,
+		},
+		rewriter.Rule{
+			Hostnames: []string{`example.com$`},
+			Ports:     []string{`80`},
+			Scheme:    `https`,
+		},
+	)
+	for _, s := range []string{`tcp://127.0.0.1:80`, `tls://example.com:443`} {
+		u, _ := url.Parse(s)
+		_, e := r.Hook(u)
+		if !assert.ErrorIs(t, e, rewriter.ErrRejected) {
+			t.FailNow()
+		}
+	}
+	items := [][2]string{
+		{`https://api.example.com/v1/users`, `https://v1.example.com/v1/users`},
+		{`https://api.example.com:443/v1/users`, `https://v1.example.com/v1/users`},
+		{`https://api.example.com/v2/users`, `https://api.example.com/v2/users`},
+		{`https://api.example.com:8443/v1/users`, `https://api.example.com:8443/v1/users`},
+		{`http://www.example.com/index`, `https://www.example.com/index`},
+		{`http://www.example.com:8080/index`, `http://www.example.com:8080/index`},
+		{`http://www.example.org/index`, `http://www.example.org/index`},
+	}
+	for _, item := range items {
+		if !assert.Equal(t, item[1], hook(t, r, item[0]), item[0]) {
+			t.FailNow()
+		}
+	}
+}
+func TestCIDR(t *testing.T) {
+	r := newRewriter(t,
+		rewriter.Rule{
+			CIDRs:  []string{`127.0.0.0/8`, `10.0.0.0/8`, `::1/128`},
+			Reject: true,
+		},
+	)
+	for _, s := range []string{`http://127.0.0.1/`, `http://10.1.2.3:8080/`, `ws://[::1]:80/`} {
+		u, _ := url.Parse(s)
+		_, e := r.Hook(u)
+		if !assert.ErrorIs(t, e, rewriter.ErrRejected, s) {
+			t.FailNow()
+		}
+	}
+	if !assert.Equal(t, `http://192.168.1.1/`, hook(t, r, `http://192.168.1.1/`)) {
+		t.FailNow()
+	}
+
+	_, e := rewriter.New(rewriter.Rule{
+		CIDRs: []string{`10.0.0.0`},
+	})
+	if !assert.NotNil(t, e) {
+		t.FailNow()
+	}
+}
+func TestCIDRLookupFailed(t *testing.T) {
+	r := newRewriter(t,
+		rewriter.Rule{
+			CIDRs:  []string{`10.0.0.0/8`},
+			Reject: true,
+		},
+	)
+	// 解析失敗不能當作不匹配而跳過 Reject 規則
+	r.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New(`dns unavailable`)
+		},
+	}
+	u, _ := url.Parse(`http://internal.httpadapter.test/`)
+	_, e := r.Hook(u)
+	if !assert.ErrorIs(t, e, rewriter.ErrLookup) {
+		t.FailNow()
+	}
+
+	// 沒有響應的 dns 服務器被 LookupTimeout 限制
+	r.LookupTimeout = time.Millisecond * 100
+	r.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	at := time.Now()
+	_, e = r.Hook(u)
+	if !assert.ErrorIs(t, e, rewriter.ErrLookup) {
+		t.FailNow()
+	}
+	if !assert.Less(t, time.Since(at), time.Second) {
+		t.FailNow()
+	}
+
+	// 取消的 ctx 同樣終止解析
+	r.LookupTimeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, e = r.HookHeader(ctx, u, nil)
+	if !assert.ErrorIs(t, e, rewriter.ErrLookup) {
+		t.FailNow()
+	}
+
+	// ip 不需要解析
+	if !assert.Equal(t, `http://192.168.1.1/`, hook(t, r, `http://192.168.1.1/`)) {
+		t.FailNow()
+	}
+}
+func TestExpand(t *testing.T) {
+	r := newRewriter(t,
+		rewriter.Rule{
+			Hostnames: []string{`@^(\w+)\.svc\.local$`},
+			Paths:     []string{`@^/api(?P<path>/.*)$`},
+			Scheme:    `http`,
+			Host:      `$1.internal:8080`,
+			Path:      `${path}`,
+		},
+		rewriter.Rule{
+			Hosts: []string{`@^(\w+)\.example\.com:(\d+)$`},
+			Host:  `${1}-$2.example.net`,
+		},
+	)
+	items := [][2]string{
+		{`https://users.svc.local/api/v1/list?id=1`, `http://users.internal:8080/v1/list?id=1`},
+		{`https://users.svc.local/other`, `https://users.svc.local/other`},
+		{`ws://chat.example.com:9000/ws`, `ws://chat-9000.example.net/ws`},
+	}
+	for _, item := range items {
+		if !assert.Equal(t, item[1], hook(t, r, item[0]), item[0]) {
+			t.FailNow()
+		}
+	}
+
+	_, e := rewriter.New(rewriter.Rule{
+		Paths: []string{`@(`},
+	})
+	if !assert.NotNil(t, e) {
+		t.FailNow()
+	}
+}
+func TestHeader(t *testing.T) {
+	r := newRewriter(t,
+		rewriter.Rule{
+			Hostnames: []string{`example.com`},
+			DelHeader: []string{`Cookie`, `Authorization`},
+			AddHeader: http.Header{
+				`X-Forwarded-By`: []string{`httpadapter`},
+			},
+		},
+	)
+	header := http.Header{
+		`Cookie`:        []string{`id=1`},
+		`Authorization`: []string{`Bearer 123`},
+		`Accept`:        []string{`*/*`},
+	}
+	u, _ := url.Parse(`https://example.com/`)
+	_, h, e := r.HookHeader(context.Background(), u, header)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, http.Header{
+		`Accept`:         []string{`*/*`},
+		`X-Forwarded-By`: []string{`httpadapter`},
+	}, h) {
+		t.FailNow()
+	}
+	// 原 header 不被修改
+	if !assert.Equal(t, `id=1`, header.Get(`Cookie`)) {
+		t.FailNow()
+	}
+
+	u, _ = url.Parse(`https://example.org/`)
+	_, h, e = r.HookHeader(context.Background(), u, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	if !assert.Nil(t, h) {
+		t.FailNow()
+	}
+}
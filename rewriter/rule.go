@@ -0,0 +1,281 @@
+package rewriter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 一條重寫規則，所有設置了的匹配條件都滿足時規則才會被匹配
+type Rule struct {
+	// Scheme 匹配規則，不設置則匹配任意 Scheme
+	// 數組中任意一個匹配則認爲匹配重寫條件
+	// * 'abc.com' 字符串完全匹配
+	// * '*' * 標記匹配任意內容
+	// * '^http' ^ 標記匹配字符串前綴
+	// * 's$' $ 標記匹配字符串後綴
+	// * '@(https)|(wss)' @ 標記使用正則表達式進行匹配
+	Schemes []string
+	// Host 匹配規則，不設置則匹配任意 Host
+	// 詳細匹配規則和Schemes相同
+	Hosts []string
+	// Hostname 匹配規則，不設置則匹配任意 Hostname
+	// 詳細匹配規則和Schemes相同
+	Hostnames []string
+	// 端口匹配規則，不設置則匹配任意端口，url 沒有端口時使用 scheme 的默認端口
+	// 詳細匹配規則和Schemes相同
+	Ports []string
+	// Path 匹配規則，不設置則匹配任意 Path，通常使用 '^/api/' 匹配路徑前綴
+	// 詳細匹配規則和Schemes相同
+	Paths []string
+	// 如果設置則解析 Hostname，只要有一個 ip 在這些網段中才匹配，例如 '10.0.0.0/8'
+	// 解析失敗時 Rewriter 返回錯誤拒絕轉發，而不是當作不匹配
+	CIDRs []string
+
+	// 如果爲 true 則拒絕對此地址的轉發
+	Reject bool
+
+	// 要 修改的 Scheme 如果不設置則 不改變
+	// tcp/tls/ws/wss/http/https
+	Scheme string
+	// 要 修改的 Host 如果不設置則 不改變
+	//
+	// 可以使用 $1 或 ${name} 引用 Hosts(如果沒有匹配則使用 Hostnames) 中正則匹配的捕獲組
+	Host string
+	// 要 修改的 Path 如果不設置則 不改變
+	//
+	// 可以使用 $1 或 ${name} 引用 Paths 中正則匹配的捕獲組
+	Path string
+
+	// 轉發前從 http header 中刪除這些屬性
+	DelHeader []string
+	// 轉發前添加到 http header 的屬性
+	AddHeader http.Header
+}
+
+// 編譯後的規則
+type rule struct {
+	reject bool
+	scheme string
+	host   string
+	path   string
+
+	schemes, hosts, hostnames, ports, paths []Matcher
+	cidrs                                   []*net.IPNet
+
+	delHeader []string
+	addHeader http.Header
+}
+
+func newRule(o *Rule) (r *rule, e error) {
+	r = &rule{
+		reject:    o.Reject,
+		scheme:    o.Scheme,
+		host:      o.Host,
+		path:      o.Path,
+		delHeader: o.DelHeader,
+		addHeader: o.AddHeader,
+	}
+	r.schemes, e = newMatchers(o.Schemes)
+	if e != nil {
+		return
+	}
+	r.hosts, e = newMatchers(o.Hosts)
+	if e != nil {
+		return
+	}
+	r.hostnames, e = newMatchers(o.Hostnames)
+	if e != nil {
+		return
+	}
+	r.ports, e = newMatchers(o.Ports)
+	if e != nil {
+		return
+	}
+	r.paths, e = newMatchers(o.Paths)
+	if e != nil {
+		return
+	}
+	if len(o.CIDRs) != 0 {
+		r.cidrs = make([]*net.IPNet, 0, len(o.CIDRs))
+		for _, s := range o.CIDRs {
+			var ipnet *net.IPNet
+			_, ipnet, e = net.ParseCIDR(s)
+			if e != nil {
+				return
+			}
+			r.cidrs = append(r.cidrs, ipnet)
+		}
+	}
+	return
+}
+
+// 匹配結果，記錄了匹配成功的匹配器以便展開捕獲組
+type match struct {
+	host     Matcher
+	hostname Matcher
+	path     Matcher
+}
+
+func (r *rule) match(ctx context.Context, resolver *net.Resolver, timeout time.Duration, u *url.URL) (m match, ok bool, e error) {
+	if len(r.schemes) != 0 {
+		if _, ok = matchAny(r.schemes, u.Scheme); !ok {
+			return
+		}
+	}
+	if len(r.hosts) != 0 {
+		if m.host, ok = matchAny(r.hosts, u.Host); !ok {
+			return
+		}
+	}
+	hostname := u.Hostname()
+	if len(r.hostnames) != 0 {
+		if m.hostname, ok = matchAny(r.hostnames, hostname); !ok {
+			return
+		}
+	}
+	if len(r.ports) != 0 {
+		if _, ok = matchAny(r.ports, port(u)); !ok {
+			return
+		}
+	}
+	if len(r.paths) != 0 {
+		if m.path, ok = matchAny(r.paths, u.Path); !ok {
+			return
+		}
+	}
+	if len(r.cidrs) != 0 {
+		// 解析最耗時所以放到最後
+		if ok, e = r.matchCIDR(ctx, resolver, timeout, hostname); !ok {
+			return
+		}
+	}
+	ok = true
+	return
+}
+func (r *rule) matchCIDR(ctx context.Context, resolver *net.Resolver, timeout time.Duration, hostname string) (ok bool, e error) {
+	var ips []net.IP
+	if ip := net.ParseIP(hostname); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		addrs, err := resolver.LookupIPAddr(ctx, hostname)
+		cancel()
+		if err != nil {
+			e = err
+			return
+		}
+		ips = make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+	}
+	for _, ip := range ips {
+		for _, ipnet := range r.cidrs {
+			if ipnet.Contains(ip) {
+				ok = true
+				return
+			}
+		}
+	}
+	return
+}
+
+// 按照規則改寫 url 與 header
+func (r *rule) rewrite(m *match, u *url.URL, header http.Header) http.Header {
+	if r.host != `` {
+		if m.host != nil {
+			u.Host = expand(m.host, r.host, u.Host)
+		} else if m.hostname != nil {
+			u.Host = expand(m.hostname, r.host, u.Hostname())
+		} else {
+			u.Host = r.host
+		}
+	}
+	if r.path != `` {
+		if m.path != nil {
+			u.Path = expand(m.path, r.path, u.Path)
+		} else {
+			u.Path = r.path
+		}
+		u.RawPath = ``
+	}
+	if r.scheme != `` {
+		u.Scheme = r.scheme
+	}
+	if len(r.delHeader) == 0 && len(r.addHeader) == 0 {
+		return header
+	}
+	if header == nil {
+		header = make(http.Header, len(r.addHeader))
+	} else {
+		header = header.Clone()
+	}
+	for _, k := range r.delHeader {
+		header.Del(k)
+	}
+	for k, vs := range r.addHeader {
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+	return header
+}
+
+func (r *rule) String() string {
+	b := bytes.NewBufferString(`rewriter`)
+	if r.reject {
+		b.WriteString(` reject`)
+	} else {
+		if r.scheme != `` {
+			if r.host == `` {
+				b.WriteString(` ` + r.scheme)
+			} else {
+				b.WriteString(` ` + r.scheme + `://` + r.host)
+			}
+		} else if r.host != `` {
+			b.WriteString(` ` + r.host)
+		}
+		if r.path != `` {
+			b.WriteString(` path=` + r.path)
+		}
+	}
+	if len(r.schemes) != 0 {
+		b.WriteString(fmt.Sprintf(` schemes=%v`, r.schemes))
+	}
+	if len(r.hosts) != 0 {
+		b.WriteString(fmt.Sprintf(` hosts=%v`, r.hosts))
+	}
+	if len(r.hostnames) != 0 {
+		b.WriteString(fmt.Sprintf(` hostnames=%v`, r.hostnames))
+	}
+	if len(r.ports) != 0 {
+		b.WriteString(fmt.Sprintf(` ports=%v`, r.ports))
+	}
+	if len(r.paths) != 0 {
+		b.WriteString(fmt.Sprintf(` paths=%v`, r.paths))
+	}
+	if len(r.cidrs) != 0 {
+		b.WriteString(fmt.Sprintf(` cidrs=%v`, r.cidrs))
+	}
+	return b.String()
+}
+
+// 返回 url 的端口，沒有設置時返回 scheme 的默認端口
+func port(u *url.URL) string {
+	p := u.Port()
+	if p != `` {
+		return p
+	}
+	switch u.Scheme {
+	case `http`, `ws`:
+		return `80`
+	case `https`, `wss`:
+		return `443`
+	}
+	return ``
+}
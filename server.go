@@ -7,10 +7,12 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/powerpuffpenguin/httpadapter/core"
 	"github.com/powerpuffpenguin/httpadapter/pipe"
 )
@@ -19,11 +21,22 @@ var ErrServerClosed = errors.New("httpadapter: Server closed")
 var ErrChannelClosed = errors.New("httpadapter: Channel closed")
 var ErrTCPClosed = errors.New("httpadapter: TCp closed")
 
+// tls ALPN 中 httpadapter 協議的 id，客戶端在 tls.Config.NextProtos 中設置它則服務器不再嗅探協議
+const ALPNProtocol = `httpadapter`
+
+// hello 返回的 route，表示連接已經通過 ALPN 協商了 h2 需要交給 ServerHTTP
+const routeHTTP2 = -2
+
 // httpadapter 服務器
 type Server struct {
 	opts   serverOptions
 	done   chan struct{}
 	closed int32
+	limits *serverLimits
+	// 帶寬限制
+	bandwidth *bandwidthLimits
+	// 資源統計
+	admission *admission
 }
 
 // 創建一個 適配 服務器
@@ -32,9 +45,31 @@ func NewServer(opt ...ServerOption) *Server {
 	for _, o := range opt {
 		o.Apply(&opts)
 	}
+	if opts.guard == nil {
+		if opts.websocketDialer == nil {
+			opts.websocketDialer = websocket.DefaultDialer
+		}
+	} else {
+		if d, ok := opts.tcpDialer.(DefaultTCPDialer); ok && d.Guard == nil {
+			d.Guard = opts.guard
+			opts.tcpDialer = d
+		}
+		if opts.websocketDialer == nil {
+			opts.websocketDialer = opts.guard.WebsocketDialer()
+		}
+		if opts.hookDo == nil {
+			opts.hookDo = opts.guard.HTTPClient()
+		}
+	}
 	return &Server{
-		opts: opts,
-		done: make(chan struct{}),
+		opts:   opts,
+		done:   make(chan struct{}),
+		limits: newServerLimits(&opts),
+		bandwidth: newBandwidthLimits(opts.channelBandwidth,
+			opts.chainBandwidth,
+			opts.serverBandwidth,
+		),
+		admission: newAdmission(opts.admission),
 	}
 }
 
@@ -64,20 +99,60 @@ func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) (e error) {
 	if e != nil {
 		return
 	}
+	e = s.ServeTLS(l, certFile, keyFile)
+	return
+}
+
+// 在監聽器上運行 tls
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) (e error) {
 	var config tls.Config
 	config.Certificates = make([]tls.Certificate, 1)
 	config.Certificates[0], e = tls.LoadX509KeyPair(certFile, keyFile)
 	if e != nil {
+		l.Close()
 		return
 	}
-
-	tlsListener := tls.NewListener(l, &config)
-	e = s.Serve(tlsListener)
+	// 只有設置了 ServerHTTP 才能處理 h2，http/1.1 總是存在以兼容只提供了它的客戶端
+	if s.opts.handler == nil {
+		config.NextProtos = []string{ALPNProtocol, `http/1.1`}
+	} else {
+		config.NextProtos = []string{ALPNProtocol, `h2`, `http/1.1`}
+	}
+	e = s.serveListener(l, &config)
 	return
 }
 
 // 在監聽器上運行
 func (s *Server) Serve(l net.Listener) (e error) {
+	return s.serveListener(l, nil)
+}
+
+// 在任意的數據流上運行 tcp-chain，例如 stdio、管道或串口，阻塞直到 tcp-chain 結束
+//
+// 數據流上不會解析 PROXY 頭也不會嗅探其它協議，如果 rwc 實現了 net.Conn 則使用它的地址。
+// ctx 被取消時會關閉 rwc 並返回 ctx.Err()，否則返回 hello 的錯誤，tcp-chain 正常結束時返回 nil
+func (s *Server) ServeConn(ctx context.Context, rwc io.ReadWriteCloser) (e error) {
+	c := newRWCConn(rwc)
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Close()
+			case <-done:
+			}
+		}()
+	}
+	e = s.serveChain(c)
+	if ctx.Err() != nil {
+		e = ctx.Err()
+	}
+	return
+}
+
+// 如果 config 不爲 nil，在解析完 PROXY 頭後建立 tls 連接
+func (s *Server) serveListener(l net.Listener, config *tls.Config) (e error) {
 	var wait sync.WaitGroup
 	var hl *httpListner
 	if s.opts.handler != nil {
@@ -87,10 +162,27 @@ func (s *Server) Serve(l net.Listener) (e error) {
 		}
 		wait.Add(1)
 		go func() {
-			http.Serve(hl, s.opts.handler)
+			newHTTPServer(s.opts.handler).Serve(hl)
 			wait.Done()
 		}()
 	}
+	// 多路復用規則中的 http.Handler
+	routes := make([]*httpListner, len(s.opts.routes))
+	for i := range s.opts.routes {
+		handler := s.opts.routes[i].handler()
+		if handler == nil {
+			continue
+		}
+		routes[i] = &httpListner{
+			done: s.done,
+			ch:   make(chan net.Conn),
+		}
+		wait.Add(1)
+		go func(l *httpListner) {
+			newHTTPServer(handler).Serve(l)
+			wait.Done()
+		}(routes[i])
+	}
 	wait.Add(1)
 	go func() {
 		<-s.done
@@ -125,7 +217,7 @@ SS:
 			break
 		}
 		tempDelay = 0
-		go s.serve(hl, rw)
+		go s.serve(hl, routes, rw, config)
 	}
 
 	wait.Wait()
@@ -133,48 +225,18 @@ SS:
 }
 
 type asyncHello struct {
+	rw      net.Conn
 	backend net.Conn
+	route   int
 	code    core.Hello
 	version string
 	window  uint32
 	e       error
 }
 
-func (s *Server) serve(l *httpListner, rw net.Conn) {
-	var (
-		backend net.Conn
-		e       error
-		b       = make([]byte, 256)
-		code    core.Hello
-		version string
-		window  uint32
-	)
-	if s.opts.timeout > 0 {
-		timer := time.NewTimer(s.opts.timeout)
-		ch := make(chan *asyncHello, 1)
-		go func() {
-			backend, code, version, window, e := s.hello(rw, b)
-			obj := &asyncHello{
-				backend: backend,
-				code:    code,
-				version: version,
-				window:  window,
-				e:       e,
-			}
-			ch <- obj
-		}()
-		select {
-		case <-timer.C:
-			e = context.DeadlineExceeded
-		case obj := <-ch:
-			if !timer.Stop() {
-				<-timer.C
-			}
-			backend, code, version, window, e = obj.backend, obj.code, obj.version, obj.window, obj.e
-		}
-	} else {
-		backend, code, version, window, e = s.hello(rw, b)
-	}
+func (s *Server) serve(l *httpListner, routes []*httpListner, rw net.Conn, config *tls.Config) {
+	b := make([]byte, 256)
+	rw, backend, route, code, version, window, e := s.readHello(rw, b, config, true)
 	// hello 錯誤
 	if e != nil {
 		rw.Close()
@@ -182,26 +244,29 @@ func (s *Server) serve(l *httpListner, rw net.Conn) {
 	}
 
 	if backend != nil {
-		// 轉發到後端
-		if s.opts.backend != nil {
-			dst, e := s.opts.backend.Dial()
-			if e == nil {
-				go pipe.Copy(dst, backend, nil)
-				pipe.Copy(backend, dst, nil)
+		// tls 協商的 h2，http.Server 需要原始的 *tls.Conn 才能識別
+		if route == routeHTTP2 {
+			l.serve(backend)
+			return
+		}
+		// 匹配了多路復用規則
+		if route >= 0 {
+			if routes[route] != nil {
+				routes[route].serve(backend)
 			} else {
-				backend.Close()
+				s.serveBackend(backend, s.opts.routes[route].Backend)
 			}
 			return
 		}
+		// 轉發到後端
+		if s.opts.backend != nil {
+			s.serveBackend(backend, s.opts.backend)
+			return
+		}
 		// 兼容 http
 		if l != nil {
-			select {
-			case l.ch <- backend:
-				return
-			case <-l.done:
-				backend.Close()
-				return
-			}
+			l.serve(backend)
+			return
 		}
 		// 返回協議未知
 		e = s.sendHello(rw, b, core.HelloInvalidProtocol, ``)
@@ -213,10 +278,41 @@ func (s *Server) serve(l *httpListner, rw net.Conn) {
 		rw.Close()
 		return
 	}
-	// 連接成功
-	e = s.sendHello(rw, b, code, version)
-	if e != nil || code != 0 {
+	s.serveTransport(rw, b, code, version, window)
+}
+
+// 在已經建立的連接上運行 tcp-chain，不會嗅探協議，返回 hello 的錯誤
+func (s *Server) serveChain(rw net.Conn) (e error) {
+	b := make([]byte, 256)
+	rw, _, _, code, version, window, e := s.readHello(rw, b, nil, false)
+	if e != nil {
+		rw.Close()
+		return
+	}
+	e = s.serveTransport(rw, b, code, version, window)
+	return
+}
+
+// 響應 hello，成功則執行轉發
+func (s *Server) serveTransport(rw net.Conn, b []byte, code core.Hello, version string, window uint32) (e error) {
+	message := version
+	if code == core.HelloOk {
+		if !s.limits.allowChain(rw.RemoteAddr()) {
+			code = core.HelloBusy
+			message = core.RetryAfterMessage(code, s.limits.chainRetryAfter())
+		} else if !s.admission.acquireChain() {
+			code = core.HelloBusy
+			message = core.RetryAfterMessage(code, s.admission.limit.RetryAfter)
+		} else {
+			defer s.admission.releaseChain()
+		}
+	}
+	e = s.sendHello(rw, b, code, message)
+	if e != nil || code != core.HelloOk {
 		rw.Close()
+		if e == nil {
+			e = core.HelloError(code)
+		}
 		return
 	}
 
@@ -224,16 +320,73 @@ func (s *Server) serve(l *httpListner, rw net.Conn) {
 	newServerTransport(s,
 		rw,
 		window,
+		version == core.ProtocolVersionCRC32C,
 	).Serve(b)
+	return
 }
-func (s *Server) sendHello(rw net.Conn, b []byte, hello core.Hello, version string) (e error) {
-	msg := core.ServerHello{
-		Code:   hello,
-		Window: s.opts.window,
+
+// 讀取 hello，如果設置了超時則在超時後返回 context.DeadlineExceeded
+func (s *Server) readHello(rw net.Conn, b []byte, config *tls.Config, accepted bool) (c net.Conn, backend net.Conn, route int, code core.Hello, version string, window uint32, e error) {
+	if s.opts.timeout <= 0 {
+		return s.hello(rw, b, config, accepted)
+	}
+	c = rw
+	timer := time.NewTimer(s.opts.timeout)
+	ch := make(chan *asyncHello, 1)
+	go func() {
+		rw, backend, route, code, version, window, e := s.hello(rw, b, config, accepted)
+		obj := &asyncHello{
+			rw:      rw,
+			backend: backend,
+			route:   route,
+			code:    code,
+			version: version,
+			window:  window,
+			e:       e,
+		}
+		ch <- obj
+	}()
+	select {
+	case <-timer.C:
+		e = context.DeadlineExceeded
+	case obj := <-ch:
+		if !timer.Stop() {
+			<-timer.C
+		}
+		c, backend, route, code, version, window, e = obj.rw, obj.backend, obj.route, obj.code, obj.version, obj.window, obj.e
+	}
+	return
+}
+
+// 將連接轉發到後端
+func (s *Server) serveBackend(c net.Conn, backend Backend) {
+	if backend == nil {
+		c.Close()
+		return
 	}
-	if hello == core.HelloOk {
-		msg.Message = version
+	dst, e := backend.Dial()
+	if e == nil && s.opts.upstreamProxyProtocol != 0 {
+		_, e = dst.Write(formatProxyProtocol(s.opts.upstreamProxyProtocol, c.RemoteAddr(), dst.RemoteAddr()))
+		if e != nil {
+			dst.Close()
+		}
+	}
+	if e == nil {
+		go pipe.Copy(dst, c, nil)
+		pipe.Copy(c, dst, nil)
 	} else {
+		c.Close()
+	}
+}
+
+// 發送 hello 響應，成功時 message 是選擇的協議版本，失敗時爲空則使用錯誤代碼的描述
+func (s *Server) sendHello(rw net.Conn, b []byte, hello core.Hello, message string) (e error) {
+	msg := core.ServerHello{
+		Code:    hello,
+		Window:  s.opts.window,
+		Message: message,
+	}
+	if hello != core.HelloOk && message == `` {
 		msg.Message = hello.String()
 	}
 	data, e := msg.MarshalTo(b)
@@ -243,12 +396,53 @@ func (s *Server) sendHello(rw net.Conn, b []byte, hello core.Hello, version stri
 	_, e = rw.Write(data)
 	return
 }
-func (s *Server) hello(rw net.Conn, b []byte) (backend net.Conn, code core.Hello, version string, window uint32, e error) {
+
+// 解析 PROXY 頭並建立 tls 後讀取客戶端 hello，返回的 c 是之後用於通信的連接
+//
+// accepted 表示連接來自監聽器，只有這樣的連接才會解析 PROXY 頭與嗅探其它協議
+func (s *Server) hello(rw net.Conn, b []byte, config *tls.Config, accepted bool) (c net.Conn, backend net.Conn, route int, code core.Hello, version string, window uint32, e error) {
+	c = rw
+	route = -1
+	if accepted && s.opts.proxyProtocol {
+		if !trustedProxy(s.opts.proxyTrustedNets, c.RemoteAddr()) {
+			e = errProxyUntrusted
+			return
+		}
+		c, e = readProxyProtocol(c)
+		if e != nil {
+			c = rw
+			return
+		}
+	}
+	var alpn string
+	if config != nil {
+		if accepted {
+			// 在終止 tls 之前按照 SNI 匹配規則，匹配的連接不解密直接交給後端
+			c, route = s.routeTLS(c)
+			if route >= 0 {
+				backend = c
+				return
+			}
+		}
+		tc := tls.Server(c, config)
+		c = tc
+		e = tc.Handshake()
+		if e != nil {
+			return
+		}
+		alpn = tc.ConnectionState().NegotiatedProtocol
+		if alpn == `h2` {
+			backend = tc
+			route = routeHTTP2
+			return
+		}
+	}
+	rw = c
 	msg, code, flag, e := core.ReadClientHello(rw, b)
 	if code == core.HelloInvalidProtocol {
-		backend = &httpConn{
-			Conn: rw,
-			b:    flag,
+		// 通過 ALPN 選擇了 httpadapter 則不再嗅探
+		if accepted && alpn != ALPNProtocol {
+			backend, route = s.route(rw, flag)
 		}
 		return
 	}
@@ -261,13 +455,19 @@ func (s *Server) hello(rw net.Conn, b []byte) (backend net.Conn, code core.Hello
 	} else if code != core.HelloOk {
 		return
 	}
+	// msg.Version 引用了 b 中的數據，而 b 之後會被用於寫入響應，所以返回常量
 	for _, v := range msg.Version {
-		if v == core.ProtocolVersion {
-			code = core.HelloOk
-			window = msg.Window
+		switch v {
+		case core.ProtocolVersion:
 			version = core.ProtocolVersion
-			return
+		case core.ProtocolVersionCRC32C:
+			version = core.ProtocolVersionCRC32C
+		default:
+			continue
 		}
+		code = core.HelloOk
+		window = msg.Window
+		return
 	}
 	code = core.HelloInvalidVersion
 	return
@@ -332,3 +532,130 @@ func (s *Server) HookURL() HookURL {
 func (s *Server) HookDo() HookDo {
 	return s.opts.hookDo
 }
+
+// 返回服務器是否允許轉發此 http 方法
+func (s *Server) AllowMethod(method string) bool {
+	return core.ValidMethod(method) && s.opts.allowMethod(method)
+}
+
+// 返回允許轉發的最大請求 body，<1 則不限制
+func (s *Server) BodyLimit() int64 {
+	return s.opts.bodyLimit
+}
+
+// 返回是否向上游轉發 Expect: 100-continue
+func (s *Server) ExpectContinue() bool {
+	return s.opts.expectContinue
+}
+
+// 返回目標地址守衛，沒有設置時返回 nil
+func (s *Server) DestinationGuard() *DestinationGuard {
+	return s.opts.guard
+}
+
+// 返回在進程內處理此 url 的 http.Handler，沒有匹配時返回 nil
+func (s *Server) LocalHandler(u *url.URL) http.Handler {
+	return s.opts.matchLocal(u)
+}
+
+// 返回服務器是否要求連接以 PROXY protocol 頭開始
+func (s *Server) ProxyProtocol() bool {
+	return s.opts.proxyProtocol
+}
+
+// 返回允許發送 PROXY protocol 頭的來源網段，nil 表示信任所有來源
+func (s *Server) ProxyProtocolTrusted() []string {
+	return s.opts.proxyTrusted
+}
+
+// 返回向 tcp:// 上游與 Backend 發送的 PROXY protocol 頭版本，0 表示不發送
+func (s *Server) UpstreamProxyProtocol() int {
+	return s.opts.upstreamProxyProtocol
+}
+
+// 返回端口多路復用規則
+func (s *Server) Routes() []MuxRoute {
+	routes := make([]MuxRoute, len(s.opts.routes))
+	copy(routes, s.opts.routes)
+	return routes
+}
+
+// 返回服務器如何連接轉發的 websocket
+func (s *Server) WebsocketDialer() WebsocketDialer {
+	return s.opts.websocketDialer
+}
+
+// 返回轉發 websocket 時單個消息的最大長度，<1 則不限制
+func (s *Server) WebsocketMessageLimit() int64 {
+	return s.opts.websocketMessageLimit
+}
+
+// 返回轉發 websocket 時每個 channel 上客戶端每秒允許發送的幀數量與字節數，<1 則不限制
+func (s *Server) WebsocketRateLimit() (frames, bytes int) {
+	return s.opts.websocketFrameRate, s.opts.websocketByteRate
+}
+
+// 返回轉發 websocket 時的空閒超時，<1 則不限制
+func (s *Server) WebsocketIdleTimeout() time.Duration {
+	return s.opts.websocketIdleTimeout
+}
+
+// 返回每個來源 ip 建立 tcp-chain 的速率限制
+func (s *Server) ChainRate() RateLimit {
+	return s.opts.chainRate
+}
+
+// 返回每個 tcp-chain 上創建 channel 的速率限制
+func (s *Server) ChannelRate() RateLimit {
+	return s.opts.channelRate
+}
+
+// 返回每個身份發送請求的速率限制
+func (s *Server) RequestRate() RateLimit {
+	return s.opts.requestRate
+}
+
+// 返回每個身份每天允許轉發的字節數，<1 則不限制
+func (s *Server) DailyQuota() int64 {
+	return s.opts.dailyQuota
+}
+
+// 返回如何確定請求者的身份
+func (s *Server) Identity() HookIdentity {
+	return s.opts.identity
+}
+
+// 返回服務器發送數據的帶寬限制，單位是每秒字節數，<1 則不限制
+func (s *Server) Bandwidth() (channel, chain, server int) {
+	return s.bandwidth.get()
+}
+
+// 在運行時調整服務器發送數據的帶寬限制，對已經存在的 channel 與 tcp-chain 也會生效，<1 則不限制
+func (s *Server) SetBandwidth(channel, chain, server int) {
+	s.bandwidth.set(channel, chain, server)
+}
+
+// 返回服務器資源的上限
+func (s *Server) Admission() Admission {
+	return s.admission.limit
+}
+
+// 返回 tcp-chain 上沒有任何 channel 多久後關閉 tcp-chain，<1 則不限制
+func (s *Server) ChainIdleTimeout() time.Duration {
+	return s.opts.chainIdleTimeout
+}
+
+// 返回 channel 在兩個方向都沒有數據流動多久後被重置，<1 則不限制
+func (s *Server) ChannelIdleTimeout() time.Duration {
+	return s.opts.channelIdleTimeout
+}
+
+// 返回轉發 scheme 的 channel 最長可以存在多久，<1 則不限制
+func (s *Server) ChannelLifetime(scheme string) time.Duration {
+	return s.opts.lifetimes[scheme]
+}
+
+// 返回一元請求的最長時間，<1 則不限制
+func (s *Server) UnaryTimeout() time.Duration {
+	return s.opts.unaryTimeout
+}
@@ -0,0 +1,92 @@
+package httpadapter
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+// 以客戶端支持的壓縮編碼返回響應，body 以 chunked 方式傳輸
+func (f *forwardConn) compressResponse(resp *http.Response) {
+	var (
+		header = resp.Header.Clone()
+		src    = normalizeEncoding(header.Get(`Content-Encoding`))
+		body   io.Reader
+		dst    string
+	)
+	header.Del(`Content-Length`)
+	if src == `` || src == core.EncodingIdentity {
+		body = resp.Body
+	} else if f.acceptEncoding(src) {
+		// 客戶端可以直接解碼上游數據
+		f.sendChunked(resp, header, resp.Body, ``)
+		return
+	} else {
+		r, e := newDecompressReader(src, resp.Body)
+		if e != nil {
+			// 無法解碼，原樣返回
+			f.sendChunked(resp, header, resp.Body, ``)
+			return
+		}
+		defer r.Close()
+		body = r
+		header.Del(`Content-Encoding`)
+	}
+	for _, encoding := range f.encoding {
+		if isSupportedEncoding(encoding) {
+			dst = encoding
+			break
+		}
+	}
+	if dst != `` {
+		header.Set(`Content-Encoding`, dst)
+	}
+	f.sendChunked(resp, header, body, dst)
+}
+
+// 返回客戶端是否支持此編碼
+func (f *forwardConn) acceptEncoding(encoding string) bool {
+	for _, s := range f.encoding {
+		if s == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// 以 chunked 方式返回響應，如果 encoding 不爲空則使用它壓縮 body
+func (f *forwardConn) sendChunked(resp *http.Response, header http.Header, body io.Reader, encoding string) {
+	e := f.sendMetadata(resp.StatusCode, header, core.BodyChunked, f.trailer)
+	if e != nil {
+		return
+	}
+	cw := core.NewChunkedWriter(f.c)
+	if encoding == `` {
+		_, e = io.CopyBuffer(cw, body, f.getBuffer(1024))
+	} else {
+		var w compressWriter
+		w, e = newCompressWriter(encoding, cw)
+		if e != nil {
+			return
+		}
+		_, e = io.CopyBuffer(w, body, f.getBuffer(1024))
+		if e == nil {
+			e = w.Close()
+		}
+	}
+	if e != nil {
+		return
+	}
+	e = cw.Close()
+	if e != nil {
+		return
+	}
+	if f.trailer {
+		e = core.WriteTrailer(f.c, resp.Trailer)
+		if e != nil {
+			return
+		}
+	}
+	f.delayWait()
+}
@@ -0,0 +1,181 @@
+package httpadapter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+var errEventTooLarge = errors.New(`event too large`)
+
+// 轉發 Server-Sent Events
+func (f *forwardConn) event(client HookDo, md *core.ClientMetadata, bodylen int64) {
+	req, e := f.newRequest(md, bodylen)
+	if e != nil {
+		f.sendError(http.StatusBadRequest, core.ErrorBadRequest, e.Error())
+		return
+	}
+	if req.Header.Get(`Accept`) == `` {
+		req.Header.Set(`Accept`, `text/event-stream`)
+	}
+	if req.Header.Get(`Cache-Control`) == `` {
+		req.Header.Set(`Cache-Control`, `no-cache`)
+	}
+	resp, e := f.do(client, req)
+	if e != nil {
+		f.sendDialError(e)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !isEventStream(resp.Header.Get(`Content-Type`)) {
+		// 不是事件流，作爲一元請求返回
+		f.response(resp)
+		return
+	}
+	e = f.sendOk(resp.StatusCode, resp.Header, nil, 0)
+	if e != nil {
+		return
+	}
+
+	var (
+		r     = eventLineReader{r: bufio.NewReader(resp.Body)}
+		w     = bytes.NewBuffer(make([]byte, 0, 1024))
+		event core.Event
+		data  strings.Builder
+	)
+	for {
+		line, e := r.readLine()
+		if e != nil {
+			if e == errEventTooLarge {
+				Logger.Println(`sse:`, e, md.URL)
+			}
+			break
+		}
+		if len(line) == 0 {
+			// 派發事件
+			if event.HasData {
+				event.Data = strings.TrimSuffix(data.String(), "\n")
+			}
+			if event.HasData || event.HasID || event.Retry > 0 {
+				if f.writeEvent(w, &event) != nil {
+					break
+				}
+			}
+			event = core.Event{}
+			data.Reset()
+			continue
+		} else if line[0] == ':' { // 註釋
+			continue
+		}
+		var field, value string
+		if i := strings.IndexByte(line, ':'); i < 0 {
+			field = line
+		} else {
+			field = line[:i]
+			value = strings.TrimPrefix(line[i+1:], ` `)
+		}
+		switch field {
+		case `event`:
+			event.Event = value
+		case `data`:
+			if data.Len()+len(value) > core.MaxEventSize {
+				Logger.Println(`sse:`, errEventTooLarge, md.URL)
+				return
+			}
+			event.HasData = true
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case `id`:
+			if !strings.Contains(value, "\x00") {
+				event.ID = value
+				event.HasID = true
+			}
+		case `retry`:
+			retry, e := strconv.ParseInt(value, 10, 64)
+			if e == nil && retry > 0 {
+				event.Retry = retry
+			}
+		}
+	}
+}
+
+// 將事件編碼爲 len(4 字節)+json 寫入 channel
+func (f *forwardConn) writeEvent(w *bytes.Buffer, event *core.Event) (e error) {
+	w.Reset()
+	w.Write([]byte{0, 0, 0, 0})
+	e = json.NewEncoder(w).Encode(event)
+	if e != nil {
+		return
+	}
+	b := w.Bytes()
+	if len(b)-4 > core.MaxEventSize {
+		e = errEventTooLarge
+		return
+	}
+	core.ByteOrder.PutUint32(b, uint32(len(b)-4))
+	_, e = f.c.Write(b)
+	return
+}
+
+// 按照 Server-Sent Events 規範讀取行，CRLF、單獨的 LF 與單獨的 CR 都是行尾
+type eventLineReader struct {
+	r *bufio.Reader
+	// 上一行以 CR 結束，如果下一個字節是 LF 則它屬於上一行的 CRLF
+	//
+	// 不在讀取到 CR 時等待下一個字節，以免上游暫停發送時延遲事件
+	cr bool
+}
+
+// 讀取一行事件流，行尾的換行符不會被返回
+func (l *eventLineReader) readLine() (line string, e error) {
+	var b []byte
+	for {
+		// 在已經緩存的數據中查找行尾，沒有緩存數據時等待上游
+		n := l.r.Buffered()
+		if n == 0 {
+			_, e = l.r.Peek(1)
+			if e != nil {
+				return
+			}
+			n = l.r.Buffered()
+		}
+		buf, _ := l.r.Peek(n)
+		if l.cr {
+			l.cr = false
+			if buf[0] == '\n' {
+				l.r.Discard(1)
+				continue
+			}
+		}
+		i := bytes.IndexAny(buf, "\r\n")
+		if i < 0 {
+			i = n
+		}
+		if len(b)+i > core.MaxEventSize {
+			e = errEventTooLarge
+			return
+		}
+		b = append(b, buf[:i]...)
+		if i == n {
+			l.r.Discard(n)
+			continue
+		}
+		l.cr = buf[i] == '\r'
+		l.r.Discard(i + 1)
+		break
+	}
+	line = string(b)
+	return
+}
+
+func isEventStream(contentType string) bool {
+	mediatype, _, e := mime.ParseMediaType(contentType)
+	return e == nil && mediatype == `text/event-stream`
+}
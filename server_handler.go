@@ -2,7 +2,9 @@ package httpadapter
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"math"
 	"net/http"
@@ -12,7 +14,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/powerpuffpenguin/httpadapter/core"
 	"github.com/powerpuffpenguin/httpadapter/pipe"
 )
@@ -44,7 +45,8 @@ type channelHandler struct {
 }
 
 func (h channelHandler) ServeChannel(srv *Server, c Conn) {
-	f := &forwardConn{c: c}
+	f := &forwardConn{c: c, limits: srv.limits}
+	f.channel, _ = c.(*ioChannel)
 	defer f.Close()
 	f.Serve(&srv.opts)
 }
@@ -52,6 +54,25 @@ func (h channelHandler) ServeChannel(srv *Server, c Conn) {
 type forwardConn struct {
 	c   Conn
 	buf any
+	// 原始的 channel，用於按照 scheme 設置生存時間，自定義的 Conn 爲 nil
+	channel *ioChannel
+	// 服務器的限流狀態
+	limits *serverLimits
+	// 客戶端要求在響應 body 之後返回 trailer
+	trailer bool
+	// 客戶端能夠解碼的壓縮編碼
+	encoding []string
+	// tcp/ws 通道數據流使用的壓縮編碼
+	compress string
+
+	// 允許的最大請求 body，chunked 傳輸的 body 在讀取時計數
+	bodyLimit int64
+
+	// 100-continue 狀態，保證 100 響應不會在最終響應之後發送
+	continueLocker sync.Mutex
+	continueState  int
+	// chunked 傳輸的請求 body 超過了 bodyLimit
+	bodyExceeded bool
 }
 
 func (f *forwardConn) Close() {
@@ -112,223 +133,248 @@ func (f *forwardConn) Serve(opts *serverOptions) {
 	var metadata core.ClientMetadata
 	err := metadata.Unmarshal(b)
 	if err != nil {
-		f.sendText(http.StatusBadRequest, err.Error())
+		f.sendError(http.StatusBadRequest, core.ErrorBadRequest, err.Error())
 		return
 	}
-	if bodylen > math.MaxInt64 {
-		f.sendText(http.StatusBadRequest, "bodylen too large")
+	f.trailer = metadata.Trailer
+	f.encoding = metadata.Encoding
+	if !f.checkLimits(opts, &metadata) {
+		return
+	}
+	if bodylen > math.MaxInt64 && bodylen != core.BodyChunked {
+		f.sendError(http.StatusBadRequest, core.ErrorBadRequest, "bodylen too large")
+		return
+	} else if opts.bodyLimit > 0 && bodylen != core.BodyChunked && bodylen > uint64(opts.bodyLimit) {
+		f.sendErrorDetails(http.StatusRequestEntityTooLarge, bodyTooLargeError(`bodylen too large: `+strconv.FormatUint(bodylen, 10), opts.bodyLimit))
 		return
 	}
+	// chunked 傳輸的 body 長度未知，在讀取時檢查
+	f.bodyLimit = opts.bodyLimit
 	// 驗證 url
 	uri, err := url.Parse(metadata.URL)
 	if err != nil {
-		f.sendText(http.StatusBadRequest, err.Error())
+		f.sendError(http.StatusBadRequest, core.ErrorBadRequest, err.Error())
 		return
 	}
 	if opts.hookURL != nil {
-		uri, err = opts.hookURL.Hook(uri)
+		if hook, ok := opts.hookURL.(HookURLHeader); ok {
+			uri, metadata.Header, err = hook.HookHeader(f.c.Context(), uri, metadata.Header)
+		} else {
+			uri, err = opts.hookURL.Hook(uri)
+		}
 		if err != nil {
-			f.sendText(http.StatusBadRequest, err.Error())
+			f.sendError(http.StatusBadRequest, core.ErrorRejectedByPolicy, err.Error())
 			return
 		}
 		metadata.URL = uri.String()
 	}
+	if lifetime, ok := opts.lifetimes[uri.Scheme]; ok && f.channel != nil {
+		// 轉發 scheme 的生存時間覆蓋 serverTransport 設置的默認值
+		f.channel.setLifetime(lifetime)
+	}
 	switch uri.Scheme {
 	case "tcp", "tls":
 		f.tcp(opts, uri, &metadata, int64(bodylen))
 	case "ws", "wss":
-		f.websocket(&metadata, int64(bodylen))
+		f.websocket(opts, &metadata, int64(bodylen))
 	case "http", "https":
-		switch metadata.Method {
-		case http.MethodGet,
-			http.MethodPost,
-			http.MethodHead,
-			http.MethodPut,
-			http.MethodPatch,
-			http.MethodDelete:
-			f.unary(opts.hookDo, &metadata, int64(bodylen))
+		if metadata.Method == `` {
+			metadata.Method = http.MethodGet
+		}
+		if !core.ValidMethod(metadata.Method) {
+			f.sendError(http.StatusBadRequest, core.ErrorBadRequest, `invalid method: `+metadata.Method)
+			return
+		} else if !opts.allowMethod(metadata.Method) {
+			f.sendErrorDetails(http.StatusBadRequest, &core.Error{
+				Code:    core.ErrorRejectedByPolicy,
+				Message: `not support method: ` + metadata.Method,
+				Details: map[string]string{
+					`method`: metadata.Method,
+				},
+			})
+			return
+		}
+		switch metadata.Mode {
+		case core.ModeUnary:
+			f.unary(opts, &metadata, int64(bodylen))
+		case core.ModeEvent:
+			f.event(opts.hookDo, &metadata, int64(bodylen))
+		case core.ModeStream:
+			f.stream(opts.hookDo, &metadata, int64(bodylen))
 		default:
-			f.sendText(http.StatusBadRequest, `not support method: `+metadata.Method)
+			f.sendErrorDetails(http.StatusBadRequest, &core.Error{
+				Code:    core.ErrorUnsupported,
+				Message: `not support mode: ` + metadata.Mode,
+				Details: map[string]string{
+					`mode`: metadata.Mode,
+				},
+			})
 		}
 	default:
-		f.sendText(http.StatusBadRequest, `not support scheme: `+uri.Scheme)
+		f.sendErrorDetails(http.StatusBadRequest, &core.Error{
+			Code:    core.ErrorUnsupported,
+			Message: `not support scheme: ` + uri.Scheme,
+			Details: map[string]string{
+				`scheme`: uri.Scheme,
+			},
+		})
 	}
 }
 func (f *forwardConn) tcp(opts *serverOptions, uri *url.URL, md *core.ClientMetadata, bodylen int64) {
 	if bodylen != 0 {
-		f.sendText(http.StatusBadRequest, `bodylen invalid`)
+		f.sendError(http.StatusBadRequest, core.ErrorBadRequest, `bodylen invalid`)
+		return
+	} else if !f.checkCompress(md) {
 		return
 	}
 	ctx := f.c.Context()
 	c, e := opts.tcpDialer.DialContext(ctx, uri.Host, uri.Scheme == `tls`)
 	if e != nil {
-		f.sendText(http.StatusBadGateway, e.Error())
+		f.sendDialError(e)
 		return
 	}
 	defer c.Close()
-	e = f.sendOk(http.StatusSwitchingProtocols, nil, nil, 0)
+	if opts.upstreamProxyProtocol != 0 && uri.Scheme == `tcp` {
+		// 告訴上游真實的客戶端地址
+		_, e = c.Write(formatProxyProtocol(opts.upstreamProxyProtocol, f.c.RemoteAddr(), c.RemoteAddr()))
+		if e != nil {
+			f.sendDialError(e)
+			return
+		}
+	}
+	e = f.switchingProtocols(md, nil)
 	if e != nil {
 		return
 	}
 	go pipe.Copy(c, f.c, nil)
 	pipe.Copy(f.c, c, nil)
 }
-func (f *forwardConn) websocket(md *core.ClientMetadata, bodylen int64) {
-	if bodylen != 0 {
-		f.sendText(http.StatusBadRequest, `bodylen invalid`)
-		return
-	}
-	ctx := f.c.Context()
-	ws, _, e := websocket.DefaultDialer.DialContext(ctx, md.URL, md.Header)
-	if e != nil {
-		f.sendText(http.StatusBadGateway, e.Error())
-		return
-	}
-	defer ws.Close()
-	e = f.sendOk(http.StatusSwitchingProtocols, nil, nil, 0)
-	if e != nil {
-		return
-	}
 
-	go func() {
-		var (
-			b      = make([]byte, 1024*32)
-			closed bool
-			e      error
-		)
-		for {
-			closed, e = f.readWS(ws, b)
-			if e != nil {
-				if closed {
-					f.c.Close()
-					time.Sleep(time.Second * 3)
-					ws.Close()
-				} else {
-					ws.Close()
-					if f.c.Context().Err() == nil {
-						time.Sleep(time.Second * 3)
-						f.c.Close()
-					}
-				}
-				break
-			}
-		}
-	}()
-	var (
-		b      = f.getBuffer(4)
-		closed bool
-	)
-	for {
-		closed, e = f.writeWS(ws, b)
-		if e != nil {
-			if closed {
-				f.c.Close()
-				time.Sleep(time.Second * 3)
-				ws.Close()
-			} else {
-				ws.Close()
-				if f.c.Context().Err() == nil {
-					time.Sleep(time.Second * 3)
-					f.c.Close()
-				}
-			}
-			break
-		}
-	}
+// 驗證客戶端要求的通道壓縮編碼，不支持時返回錯誤並返回 false
+func (f *forwardConn) checkCompress(md *core.ClientMetadata) bool {
+	if md.Compress == `` || isSupportedStreamEncoding(md.Compress) {
+		return true
+	}
+	f.sendErrorDetails(http.StatusBadRequest, &core.Error{
+		Code:    core.ErrorUnsupported,
+		Message: `not support compress: ` + md.Compress,
+		Details: map[string]string{
+			`compress`: md.Compress,
+		},
+	})
+	return false
 }
-func (f *forwardConn) readWS(ws *websocket.Conn, b []byte) (closed bool, e error) {
-	t, r, e := ws.NextReader()
-	if e != nil {
-		return
-	}
-	n, e := r.Read(b[4:])
-	if e != nil {
-		if e == io.EOF {
-			e = nil
-		}
+
+// 返回 101 響應，如果客戶端要求壓縮則之後通道上的數據流都會經過壓縮
+func (f *forwardConn) switchingProtocols(md *core.ClientMetadata, header http.Header) (e error) {
+	f.compress = md.Compress
+	e = f.sendOk(http.StatusSwitchingProtocols, header, nil, 0)
+	if e != nil || f.compress == `` {
 		return
 	}
-	b[0] = byte(t)
-	b[1] = 0
-	core.ByteOrder.PutUint16(b[2:], uint16(n))
-	_, e = f.c.Write(b[:4+n])
+	c, e := newCompressChannel(f.c, f.compress)
 	if e != nil {
-		closed = true
 		return
 	}
-	for {
-		n, e = r.Read(b[3:])
-		if e != nil {
-			if e == io.EOF {
-				b[0] = 1
-				core.ByteOrder.PutUint16(b[1:], uint16(n))
-				_, e = f.c.Write(b[:3+n])
-				if e != nil {
-					closed = true
-					return
-				}
-			}
-			break
-		}
-		b[0] = 0
-		core.ByteOrder.PutUint16(b[1:], uint16(n))
-		_, e = f.c.Write(b[:3+n])
-		if e != nil {
-			closed = true
-			return
-		}
-	}
+	f.c = c
 	return
 }
-func (f *forwardConn) writeWS(ws *websocket.Conn, b []byte) (closed bool, e error) {
-	_, e = io.ReadFull(f.c, b[:4])
+func (f *forwardConn) unary(opts *serverOptions, md *core.ClientMetadata, bodylen int64) {
+	// 創建 request
+	req, e := f.newRequest(md, bodylen)
 	if e != nil {
-		closed = true
+		f.sendError(http.StatusBadRequest, core.ErrorBadRequest, e.Error())
 		return
 	}
-	var (
-		t   = b[0]
-		end = b[1] == 1
-		l   = core.ByteOrder.Uint16(b[2:])
-	)
-	w, e := ws.NextWriter(int(t))
-	if e != nil {
+	if opts.unaryTimeout > 0 {
+		// 讀取 body 與發送響應超時會返回錯誤，之後 channel 被關閉
+		deadline := time.Now().Add(opts.unaryTimeout)
+		f.c.SetDeadline(deadline)
+		ctx, cancel := context.WithDeadline(req.Context(), deadline)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	if handler := opts.matchLocal(req.URL); handler != nil {
+		if md.Continue && bodylen > 0 {
+			// 在 handler 第一次讀取 body 時通知客戶端發送 body
+			req.Body = io.NopCloser(&continueReader{
+				f: f,
+				r: req.Body,
+			})
+		}
+		f.local(handler, req)
 		return
 	}
-	defer w.Close()
-	if l != 0 {
-		_, e = io.Copy(w, io.LimitReader(f.c, int64(l)))
-		if e != nil {
+	// 客戶端等待服務器允許後才會發送 body
+	if md.Continue && bodylen > 0 {
+		if opts.expectContinue {
+			// 由上游決定是否接收 body
+			req.Header.Set(`Expect`, `100-continue`)
+			req.Body = io.NopCloser(&continueReader{
+				f: f,
+				r: req.Body,
+			})
+		} else if f.sendContinue() != nil {
 			return
 		}
 	}
-	for !end {
-		_, e = io.ReadFull(f.c, b[:3])
-		if e != nil {
-			closed = true
-			return
-		}
-		end = b[0] == 1
-		l = core.ByteOrder.Uint16(b[1:])
-		if l != 0 {
-			_, e = io.Copy(w, io.LimitReader(f.c, int64(l)))
-			if e != nil {
-				return
-			}
+	// 請求上游返回服務器可以解碼的壓縮數據
+	if len(f.encoding) != 0 && req.Header.Get(`Accept-Encoding`) == `` {
+		req.Header.Set(`Accept-Encoding`, strings.Join(supportedEncodings, `, `))
+	}
+	// 發送請求
+	resp, e := f.do(opts.hookDo, req)
+	if e != nil {
+		if opts.unaryTimeout > 0 && req.Context().Err() == context.DeadlineExceeded {
+			f.sendTimeout(opts.unaryTimeout)
+		} else {
+			f.sendDialError(e)
 		}
+		return
 	}
-	e = w.Close()
-	return
+	defer resp.Body.Close()
+	f.response(resp)
 }
 
-func (f *forwardConn) unary(client HookDo, md *core.ClientMetadata, bodylen int64) {
-	// 創建 request
+// 上游沒有在 timeout 內響應，清除截止時間以便返回 504
+func (f *forwardConn) sendTimeout(timeout time.Duration) {
+	f.c.SetDeadline(time.Time{})
+	f.sendErrorDetails(http.StatusGatewayTimeout, &core.Error{
+		Code:    core.ErrorTimeout,
+		Message: `unary request timeout`,
+		Details: map[string]string{
+			`timeout`: timeout.String(),
+		},
+	})
+}
+
+// 依據元信息創建要轉發的 http 請求，bodylen < 0 表示 body 以 chunked 方式傳輸
+func (f *forwardConn) newRequest(md *core.ClientMetadata, bodylen int64) (req *http.Request, e error) {
 	ctx := f.c.Context()
-	req, e := http.NewRequestWithContext(ctx, md.Method, md.URL, io.LimitReader(f.c, bodylen))
+	var body io.Reader
+	if bodylen < 0 {
+		body = core.NewChunkedReader(f.c)
+		if f.bodyLimit > 0 {
+			body = &bodyLimitReader{
+				f: f,
+				r: body,
+				n: f.bodyLimit,
+			}
+		}
+	} else if bodylen > 0 {
+		body = io.LimitReader(f.c, bodylen)
+	} else {
+		body = http.NoBody
+	}
+	req, e = http.NewRequestWithContext(ctx, md.Method, md.URL, body)
 	if e != nil {
-		f.sendText(http.StatusBadRequest, e.Error())
 		return
 	}
+	if bodylen < 0 {
+		req.ContentLength = -1
+	} else {
+		req.ContentLength = bodylen
+	}
 	// 設置 header
 	for k, v := range md.Header {
 		k0 := strings.ToLower(k)
@@ -338,58 +384,93 @@ func (f *forwardConn) unary(client HookDo, md *core.ClientMetadata, bodylen int6
 		}
 		req.Header[k] = v
 	}
-	if bodylen > 0 {
+	if bodylen != 0 {
 		if req.Header.Get(`Content-Type`) == `` {
 			req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
 		}
 	}
-	// 發送請求
-	var resp *http.Response
+	return
+}
+
+// 發送 http 請求
+func (f *forwardConn) do(client HookDo, req *http.Request) (*http.Response, error) {
 	if client == nil {
-		resp, e = http.DefaultClient.Do(req)
-	} else {
-		resp, e = client.Do(req)
+		return http.DefaultClient.Do(req)
 	}
-	if e != nil {
-		f.sendText(http.StatusBadGateway, e.Error())
+	return client.Do(req)
+}
+
+// 將 http 響應作爲 Message 返回給客戶端
+func (f *forwardConn) response(resp *http.Response) {
+	if len(f.encoding) != 0 && resp.ContentLength != 0 &&
+		resp.Request.Method != http.MethodHead &&
+		resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusNotModified {
+		f.compressResponse(resp)
 		return
 	}
-	defer resp.Body.Close()
 	// 解析數據
 	s := resp.Header.Get(`content-length`)
 	if s == `` {
 		b, e := io.ReadAll(io.LimitReader(resp.Body, 1024*32))
 		if e != nil {
-			f.sendText(http.StatusBadGateway, e.Error())
+			f.sendError(http.StatusBadGateway, core.ErrorUpstreamError, e.Error())
 			return
 		}
 		if len(b) == 1024*32 {
-			f.sendText(http.StatusBadGateway, `http response(`+strconv.Itoa(resp.StatusCode)+`) not set header: content-length`)
+			f.sendErrorDetails(http.StatusBadGateway, &core.Error{
+				Code:    core.ErrorUpstreamError,
+				Message: `http response(` + strconv.Itoa(resp.StatusCode) + `) not set header: content-length`,
+				Details: map[string]string{
+					`status`: strconv.Itoa(resp.StatusCode),
+				},
+			})
 		} else {
-			f.sendResponse(resp.StatusCode, resp.Header, bytes.NewReader(b), uint64(len(b)))
+			f.sendResponse(resp, bytes.NewReader(b), uint64(len(b)))
 		}
 		return
 	}
 	length, e := strconv.ParseUint(s, 10, 64)
 	if e != nil {
-		f.sendText(http.StatusBadGateway, `content-length error: `+e.Error())
+		f.sendError(http.StatusBadGateway, core.ErrorUpstreamError, `content-length error: `+e.Error())
 		return
 	} else if length > math.MaxInt64 {
-		f.sendText(http.StatusBadGateway, `content-length too large: `+strconv.FormatUint(length, 10))
+		f.sendError(http.StatusBadGateway, core.ErrorUpstreamError, `content-length too large: `+strconv.FormatUint(length, 10))
 		return
 	}
 
 	// 返回數據
-	f.sendResponse(resp.StatusCode, resp.Header, resp.Body, uint64(length))
+	f.sendResponse(resp, resp.Body, uint64(length))
 }
 func (f *forwardConn) sendOk(status int, header http.Header, body io.Reader, bodylen uint64) (e error) {
+	e = f.sendMetadata(status, header, bodylen, false)
+	if e != nil {
+		return
+	}
+	if bodylen != 0 {
+		_, e = io.Copy(f.c, body)
+	}
+	return
+}
+
+// 發送 Message 頭，如果 trailer 爲 true 則表示 body 之後會發送 trailer 塊
+func (f *forwardConn) sendMetadata(status int, header http.Header, bodylen uint64, trailer bool) (e error) {
 	e = f.c.Context().Err()
 	if e != nil {
 		return
 	}
+	if f.finalResponse() {
+		// 請求 body 超過限制，以 413 代替原本的響應
+		f.sendErrorDetails(http.StatusRequestEntityTooLarge, bodyTooLargeError(`chunked body too large`, f.bodyLimit))
+		e = errBodyTooLarge
+		return
+	}
 	md := core.ServerMetadata{
-		Status: status,
-		Header: header,
+		Status:  status,
+		Header:  header,
+		Trailer: trailer,
+		// 只有在 101 響應中才有意義，通知客戶端之後的數據流已經被壓縮
+		Compress: f.compress,
 	}
 
 	w := f.getBytes(10)
@@ -404,30 +485,66 @@ func (f *forwardConn) sendOk(status int, header http.Header, body io.Reader, bod
 	core.ByteOrder.PutUint16(data, uint16(metalen))
 	core.ByteOrder.PutUint64(data[2:], uint64(bodylen))
 	_, e = f.c.Write(data)
+	return
+}
+
+func (f *forwardConn) sendResponse(resp *http.Response, body io.Reader, bodylen uint64) {
+	e := f.sendMetadata(resp.StatusCode, resp.Header, bodylen, f.trailer)
 	if e != nil {
 		return
 	}
 	if bodylen != 0 {
 		_, e = io.Copy(f.c, body)
+		if e != nil {
+			return
+		}
 	}
-	return
+	if f.trailer {
+		// 上游的 trailer 在 body 讀取到 EOF 後才被設置
+		if bodylen == 0 {
+			io.Copy(io.Discard, io.LimitReader(body, 1))
+		}
+		e = core.WriteTrailer(f.c, resp.Trailer)
+		if e != nil {
+			return
+		}
+	}
+	f.delayWait()
 }
 
-func (f *forwardConn) sendResponse(status int, header http.Header, body io.Reader, bodylen uint64) {
-	e := f.sendOk(status, header, body, bodylen)
-	if e != nil {
-		return
+// 返回連接上游失敗的錯誤，被 DestinationGuard 拒絕的連接返回 rejected by policy
+func (f *forwardConn) sendDialError(e error) {
+	if errors.Is(e, ErrDestinationDenied) {
+		f.sendError(http.StatusForbidden, core.ErrorRejectedByPolicy, e.Error())
+	} else {
+		f.sendError(http.StatusBadGateway, core.ErrorUpstreamUnreachable, e.Error())
 	}
-	f.delayWait()
 }
-func (f *forwardConn) sendText(status int, body string) {
+
+// 返回一個錯誤，錯誤描述同時作爲 text/plain 的 body 返回以便簡單的客戶端可以直接顯示
+func (f *forwardConn) sendError(status int, code core.ErrorCode, message string) {
+	f.sendErrorDetails(status, &core.Error{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// 返回一個攜帶詳情的錯誤
+func (f *forwardConn) sendErrorDetails(status int, err *core.Error) {
 	if f.c.Context().Err() != nil {
 		return
 	}
+	if f.finalResponse() && err.Code != core.ErrorBodyTooLarge {
+		// 上游因爲讀取 body 失敗而返回的錯誤，實際原因是 body 超過限制
+		status = http.StatusRequestEntityTooLarge
+		err = bodyTooLargeError(`chunked body too large`, f.bodyLimit)
+	}
 
+	body := err.Message
 	md := core.ServerMetadata{
 		Status: status,
 		Header: make(http.Header),
+		Error:  err,
 	}
 	md.Header.Set(`Content-Type`, `text/plain; charset=utf-8`)
 	w := f.getBytes(10)
@@ -466,3 +583,107 @@ func (f *forwardConn) delayWait() {
 		}
 	}
 }
+
+// 標記開始發送最終響應，此後不會再發送 100 響應，如果請求 body 已經超過限制則返回 true
+func (f *forwardConn) finalResponse() (exceeded bool) {
+	f.continueLocker.Lock()
+	f.continueState = 2
+	exceeded = f.bodyExceeded
+	f.continueLocker.Unlock()
+	return
+}
+
+// 標記請求 body 超過限制，如果已經開始發送最終響應則無法再返回 413，只能重置 channel
+func (f *forwardConn) exceedBody() {
+	f.continueLocker.Lock()
+	f.bodyExceeded = true
+	started := f.continueState == 2
+	f.continueLocker.Unlock()
+	if started {
+		f.c.Close()
+	}
+}
+
+var errBodyTooLarge = errors.New(`body too large`)
+
+func bodyTooLargeError(message string, limit int64) *core.Error {
+	return &core.Error{
+		Code:    core.ErrorBodyTooLarge,
+		Message: message,
+		Details: map[string]string{
+			`limit`: strconv.FormatInt(limit, 10),
+		},
+	}
+}
+
+// 限制 chunked 傳輸的請求 body 長度
+type bodyLimitReader struct {
+	f   *forwardConn
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *bodyLimitReader) Read(p []byte) (n int, e error) {
+	if r.err != nil {
+		e = r.err
+		return
+	}
+	n, e = r.r.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		n = 0
+		e = errBodyTooLarge
+		r.err = e
+		r.f.exceedBody()
+	}
+	return
+}
+
+// 發送 100 響應通知客戶端可以發送 body 了
+func (f *forwardConn) sendContinue() (e error) {
+	f.continueLocker.Lock()
+	defer f.continueLocker.Unlock()
+	switch f.continueState {
+	case 1:
+		return
+	case 2:
+		e = errContinueFinal
+		return
+	}
+	f.continueState = 1
+
+	// 可能與最終響應併發，所以不使用 f.buf
+	w := bytes.NewBuffer(make([]byte, 10, 64))
+	e = json.NewEncoder(w).Encode(core.ServerMetadata{
+		Status: http.StatusContinue,
+	})
+	if e != nil {
+		return
+	}
+	data := w.Bytes()
+	core.ByteOrder.PutUint16(data, uint16(len(data)-10))
+	core.ByteOrder.PutUint64(data[2:], 0)
+	_, e = f.c.Write(data)
+	return
+}
+
+var errContinueFinal = errors.New(`final response already sent`)
+
+// 在上游第一次讀取 body 時通知客戶端發送 body
+type continueReader struct {
+	f   *forwardConn
+	r   io.Reader
+	err error
+}
+
+func (r *continueReader) Read(p []byte) (n int, e error) {
+	if r.err == nil {
+		r.err = r.f.sendContinue()
+	}
+	if r.err != nil {
+		e = r.err
+		return
+	}
+	return r.r.Read(p)
+}
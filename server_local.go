@@ -0,0 +1,355 @@
+package httpadapter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+// 沒有設置 Content-Length 時緩存的最大響應 body，超過後以 chunked 方式傳輸
+const localBufferSize = 1024 * 32
+
+// 在進程內處理請求的 http.Handler
+type localHandler struct {
+	// 匹配 Host 或 Hostname
+	host string
+	// 匹配 url 前綴
+	prefix  *url.URL
+	handler http.Handler
+}
+
+func newLocalHandler(pattern string, handler http.Handler) (h *localHandler, e error) {
+	if handler == nil {
+		e = errors.New(`httpadapter: nil local handler for pattern ` + pattern)
+		return
+	} else if pattern == `` {
+		e = errors.New(`httpadapter: empty local pattern`)
+		return
+	} else if !strings.Contains(pattern, `://`) {
+		h = &localHandler{
+			host:    pattern,
+			handler: handler,
+		}
+		return
+	}
+	prefix, e := url.Parse(pattern)
+	if e != nil {
+		e = errors.New(`httpadapter: invalid local pattern ` + pattern + `: ` + e.Error())
+		return
+	} else if (prefix.Scheme != `http` && prefix.Scheme != `https`) || prefix.Host == `` {
+		e = errors.New(`httpadapter: invalid local pattern ` + pattern + `: url must be http(s)://host[/path]`)
+		return
+	}
+	h = &localHandler{
+		prefix:  prefix,
+		handler: handler,
+	}
+	return
+}
+func (h *localHandler) match(u *url.URL) bool {
+	if h.prefix == nil {
+		return strings.EqualFold(u.Host, h.host) ||
+			(u.Port() == `` || !strings.Contains(h.host, `:`)) && strings.EqualFold(u.Hostname(), h.host)
+	}
+	if u.Scheme != h.prefix.Scheme || !strings.EqualFold(u.Host, h.prefix.Host) {
+		return false
+	}
+	// 前綴不以 / 結尾時只匹配完整的路徑段，例如 /v1 匹配 /v1 與 /v1/x 但不匹配 /v1x
+	path := h.prefix.Path
+	if path == `` || strings.HasSuffix(path, `/`) {
+		return strings.HasPrefix(u.Path, path)
+	}
+	return u.Path == path || strings.HasPrefix(u.Path, path+`/`)
+}
+
+// 返回處理此 url 的本地 http.Handler，沒有匹配時返回 nil
+func (opts *serverOptions) matchLocal(u *url.URL) http.Handler {
+	for _, h := range opts.locals {
+		if h.match(u) {
+			return h.handler
+		}
+	}
+	return nil
+}
+
+// 在進程內處理請求，響應直接寫入 channel
+func (f *forwardConn) local(handler http.Handler, req *http.Request) {
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = f.c.RemoteAddr().String()
+	w := &localResponseWriter{
+		f:      f,
+		req:    req,
+		header: make(http.Header),
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				Logger.Println(`local handler panic:`, v)
+			}
+			if !w.committed {
+				f.sendError(http.StatusInternalServerError, core.ErrorUpstreamError, fmt.Sprint(v))
+			}
+			return
+		}
+		w.finish()
+	}()
+	handler.ServeHTTP(w, req)
+}
+
+// 返回客戶端是否能夠接收 chunked body
+func (f *forwardConn) acceptChunked() bool {
+	return f.trailer || len(f.encoding) != 0
+}
+
+// 將響應直接寫入 channel 的 http.ResponseWriter
+//
+// 在 body 超過 localBufferSize 或調用 Flush 之前都會緩存響應以便返回準確的 body 長度，
+// 如果設置了 Content-Length 則直接以此長度發送
+type localResponseWriter struct {
+	f      *forwardConn
+	req    *http.Request
+	header http.Header
+	status int
+
+	buf       bytes.Buffer
+	committed bool
+	// 已發送給客戶端的 body 長度，-1 表示 chunked
+	length   int64
+	written  int64
+	w        io.Writer
+	cw       *core.ChunkedWriter
+	compress compressWriter
+	err      error
+}
+
+func (w *localResponseWriter) Header() http.Header {
+	return w.header
+}
+func (w *localResponseWriter) WriteHeader(status int) {
+	// 100 響應由 continueReader 在讀取 body 時發送
+	if w.status != 0 || w.committed || status < 200 {
+		return
+	}
+	w.status = status
+}
+func (w *localResponseWriter) bodyAllowed() bool {
+	return w.req.Method != http.MethodHead &&
+		w.status != http.StatusNoContent &&
+		w.status != http.StatusNotModified
+}
+
+// 返回 handler 設置的 Content-Length
+func (w *localResponseWriter) contentLength() (int64, bool) {
+	s := w.header.Get(`Content-Length`)
+	if s == `` {
+		return 0, false
+	}
+	length, e := strconv.ParseInt(s, 10, 64)
+	if e != nil || length < 0 {
+		return 0, false
+	}
+	return length, true
+}
+func (w *localResponseWriter) Write(b []byte) (n int, e error) {
+	if w.err != nil {
+		e = w.err
+		return
+	}
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.bodyAllowed() {
+		e = http.ErrBodyNotAllowed
+		return
+	}
+	if !w.committed {
+		if length, ok := w.contentLength(); ok {
+			e = w.commit(length)
+		} else if w.buf.Len()+len(b) <= localBufferSize {
+			return w.buf.Write(b)
+		} else {
+			e = w.commit(-1)
+		}
+		if e != nil {
+			w.err = e
+			return
+		}
+	}
+	return w.write(b)
+}
+func (w *localResponseWriter) write(b []byte) (n int, e error) {
+	if w.length >= 0 && w.written+int64(len(b)) > w.length {
+		e = http.ErrContentLength
+		return
+	}
+	n, e = w.w.Write(b)
+	w.written += int64(n)
+	if e != nil {
+		w.err = e
+	}
+	return
+}
+
+// 立刻發送已經寫入的數據
+func (w *localResponseWriter) Flush() {
+	if w.err != nil {
+		return
+	}
+	if !w.committed {
+		if w.status == 0 {
+			w.WriteHeader(http.StatusOK)
+		}
+		if !w.bodyAllowed() {
+			return
+		}
+		length, ok := w.contentLength()
+		if !ok {
+			if !w.f.acceptChunked() {
+				// 只能在結束時返回完整 body
+				return
+			}
+			length = -1
+		}
+		e := w.commit(length)
+		if e != nil {
+			w.err = e
+			return
+		}
+	}
+	if w.compress != nil {
+		w.compress.Flush()
+	}
+}
+
+// 發送響應頭，length < 0 表示 body 以 chunked 方式傳輸
+func (w *localResponseWriter) commit(length int64) (e error) {
+	w.committed = true
+	w.length = length
+	header := w.header.Clone()
+	for k := range header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			delete(header, k)
+		}
+	}
+	f := w.f
+	if length < 0 {
+		if !f.acceptChunked() {
+			e = errLocalChunked
+			f.sendErrorDetails(http.StatusBadGateway, &core.Error{
+				Code:    core.ErrorUpstreamError,
+				Message: `http response(` + strconv.Itoa(w.status) + `) not set header: content-length`,
+				Details: map[string]string{
+					`status`: strconv.Itoa(w.status),
+				},
+			})
+			return
+		}
+		var encoding string
+		if header.Get(`Content-Encoding`) == `` {
+			for _, s := range f.encoding {
+				if isSupportedEncoding(s) {
+					encoding = s
+					header.Set(`Content-Encoding`, s)
+					break
+				}
+			}
+		}
+		header.Del(`Content-Length`)
+		e = f.sendMetadata(w.status, header, core.BodyChunked, f.trailer)
+		if e != nil {
+			return
+		}
+		w.cw = core.NewChunkedWriter(f.c)
+		w.w = w.cw
+		if encoding != `` {
+			w.compress, e = newCompressWriter(encoding, w.cw)
+			if e != nil {
+				return
+			}
+			w.w = w.compress
+		}
+	} else {
+		if w.bodyAllowed() {
+			header.Set(`Content-Length`, strconv.FormatInt(length, 10))
+		}
+		e = f.sendMetadata(w.status, header, uint64(length), f.trailer)
+		if e != nil {
+			return
+		}
+		w.w = f.c
+	}
+	if w.buf.Len() != 0 {
+		_, e = w.write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+	return
+}
+
+var errLocalChunked = errors.New(`client not support chunked body`)
+
+// handler 返回後完成響應
+func (w *localResponseWriter) finish() {
+	if w.err != nil {
+		return
+	}
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.committed {
+		// 完整的 body 都在緩存中
+		e := w.commit(int64(w.buf.Len()))
+		if e != nil {
+			return
+		}
+	}
+	if w.compress != nil {
+		if w.compress.Close() != nil {
+			return
+		}
+	}
+	if w.cw != nil {
+		if w.cw.Close() != nil {
+			return
+		}
+	} else if w.written != w.length {
+		// 寫入的 body 少於 Content-Length，無法繼續使用 channel
+		return
+	}
+	if w.f.trailer {
+		if core.WriteTrailer(w.f.c, w.trailer()) != nil {
+			return
+		}
+	}
+	w.f.delayWait()
+}
+
+// 返回 handler 設置的 trailer
+func (w *localResponseWriter) trailer() (trailer http.Header) {
+	for _, v := range w.header.Values(`Trailer`) {
+		for _, k := range strings.Split(v, `,`) {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if vs, ok := w.header[k]; ok {
+				if trailer == nil {
+					trailer = make(http.Header)
+				}
+				trailer[k] = vs
+			}
+		}
+	}
+	for k, vs := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			if trailer == nil {
+				trailer = make(http.Header)
+			}
+			trailer[http.CanonicalHeaderKey(k[len(http.TrailerPrefix):])] = vs
+		}
+	}
+	return
+}
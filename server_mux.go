@@ -0,0 +1,332 @@
+package httpadapter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 端口多路復用識別出的協議
+type MuxProtocol string
+
+const (
+	// tls，可以按照 ClientHello 中的 SNI 路由
+	MuxTLS MuxProtocol = `tls`
+	// ssh，客戶端以 'SSH-' 開始發送版本
+	MuxSSH MuxProtocol = `ssh`
+	// http/1.x，可以按照 Host 路由
+	MuxHTTP MuxProtocol = `http`
+	// 以 'PRI * HTTP/2.0' 連接前言開始的 http/2(h2c prior knowledge)
+	MuxHTTP2 MuxProtocol = `h2c`
+	// 其它無法識別的協議
+	MuxUnknown MuxProtocol = `unknown`
+)
+
+var errSniffTooLarge = errors.New(`httpadapter: sniff data too large`)
+
+// 嗅探時最多緩存的數據，足夠容納一個最大的 tls 記錄
+const maxSniffSize = 5 + 16*1024
+
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// 端口多路復用規則，httpadapter 協議總是由服務器自己處理，其它協議按照規則的設置順序匹配
+type MuxRoute struct {
+	// 要匹配的協議
+	Protocol MuxProtocol
+	// 對 tls 匹配 SNI，對 http 匹配 Host 中的主機名，爲空則匹配任意值。
+	// 路由以連接爲單位，http 只使用連接上第一個請求的 Host
+	//
+	// 支持完整的主機名 'example.com'，匹配子域名的 '*.example.com'，以及匹配任意值的 '*'，不區分大小寫
+	Hosts []string
+	// 將連接轉發到此後端
+	Backend Backend
+	// 只對 MuxHTTP 與 MuxHTTP2 有效，如果不爲 nil 則將連接交給此 http.Handler 處理，優先於 Backend
+	Handler http.Handler
+}
+
+func (r *MuxRoute) handler() http.Handler {
+	if r.Protocol == MuxHTTP || r.Protocol == MuxHTTP2 {
+		return r.Handler
+	}
+	return nil
+}
+
+// 返回主機名是否匹配規則
+func (r *MuxRoute) matchHost(host string) bool {
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, `.`))
+	for _, pattern := range r.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == `*` || pattern == host ||
+			(strings.HasPrefix(pattern, `*.`) && strings.HasSuffix(host, pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// 緩存嗅探時讀取的數據，之後通過 httpConn 重放
+type sniffer struct {
+	c net.Conn
+	b []byte
+}
+
+// 返回至少 n 字節的數據
+func (s *sniffer) peek(n int) (b []byte, e error) {
+	if n > maxSniffSize {
+		e = errSniffTooLarge
+		return
+	}
+	for len(s.b) < n {
+		if cap(s.b) < n {
+			size := cap(s.b) * 2
+			if size < 512 {
+				size = 512
+			}
+			for size < n {
+				size *= 2
+			}
+			if size > maxSniffSize {
+				size = maxSniffSize
+			}
+			b := make([]byte, len(s.b), size)
+			copy(b, s.b)
+			s.b = b
+		}
+		var count int
+		count, e = s.c.Read(s.b[len(s.b):cap(s.b)])
+		s.b = s.b[:len(s.b)+count]
+		if e != nil {
+			return
+		}
+	}
+	b = s.b
+	return
+}
+
+// 返回數據是否以 prefix 開始，只會在已經讀取的數據與 prefix 一致時才讀取更多數據
+func (s *sniffer) hasPrefix(prefix []byte) bool {
+	for i := 1; i <= len(prefix); i++ {
+		b, e := s.peek(i)
+		if e != nil || b[i-1] != prefix[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// 識別協議，只會讀取足以區分協議的數據
+func (s *sniffer) protocol() MuxProtocol {
+	b, e := s.peek(1)
+	if e != nil {
+		return MuxUnknown
+	}
+	switch b[0] {
+	case 0x16:
+		if b, e = s.peek(3); e == nil && b[1] == 3 {
+			return MuxTLS
+		}
+	case 'S':
+		if s.hasPrefix([]byte(`SSH-`)) {
+			return MuxSSH
+		}
+	case 'P':
+		if s.hasPrefix(http2Preface) {
+			return MuxHTTP2
+		}
+	}
+	// http 請求以大寫字母的方法開始並跟隨一個空格
+	for i := 0; i < 16; i++ {
+		b, e = s.peek(i + 1)
+		if e != nil {
+			break
+		}
+		c := b[i]
+		if c == ' ' {
+			if i != 0 {
+				return MuxHTTP
+			}
+			break
+		} else if c < 'A' || c > 'Z' {
+			break
+		}
+	}
+	return MuxUnknown
+}
+
+// 返回 tls ClientHello 中的 SNI，失敗返回空字符串
+func (s *sniffer) serverName() string {
+	b, e := s.peek(5)
+	if e != nil {
+		return ``
+	}
+	b, e = s.peek(5 + int(binary.BigEndian.Uint16(b[3:])))
+	if e != nil {
+		return ``
+	}
+	return parseServerName(b[5 : 5+int(binary.BigEndian.Uint16(b[3:]))])
+}
+
+// 從 ClientHello 握手消息中解析 server_name 擴展
+func parseServerName(b []byte) string {
+	// handshake type(1) + length(3) + version(2) + random(32)
+	if len(b) < 38 || b[0] != 1 {
+		return ``
+	}
+	b = b[38:]
+	// session id
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return ``
+	}
+	b = b[1+int(b[0]):]
+	// cipher suites
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return ``
+	}
+	b = b[2+int(binary.BigEndian.Uint16(b)):]
+	// compression methods
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return ``
+	}
+	b = b[1+int(b[0]):]
+	// extensions
+	if len(b) < 2 {
+		return ``
+	}
+	size := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) > size {
+		b = b[:size]
+	}
+	for len(b) >= 4 {
+		t := binary.BigEndian.Uint16(b)
+		size = int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < size {
+			return ``
+		}
+		if t == 0 {
+			// server_name_list(2) + name_type(1) + name(2+n)
+			ext := b[:size]
+			if len(ext) < 5 || ext[2] != 0 {
+				return ``
+			}
+			size = int(binary.BigEndian.Uint16(ext[3:]))
+			if len(ext) < 5+size {
+				return ``
+			}
+			return string(ext[5 : 5+size])
+		}
+		b = b[size:]
+	}
+	return ``
+}
+
+// 返回 http 請求 Host 中的主機名，失敗返回空字符串
+func (s *sniffer) host() string {
+	for {
+		if i := bytes.Index(s.b, []byte("\r\n\r\n")); i >= 0 {
+			req, e := http.ReadRequest(bufio.NewReader(bytes.NewReader(s.b[:i+4])))
+			if e != nil {
+				return ``
+			}
+			host := req.Host
+			if h, _, e := net.SplitHostPort(host); e == nil {
+				host = h
+			}
+			return host
+		}
+		_, e := s.peek(len(s.b) + 1)
+		if e != nil {
+			return ``
+		}
+	}
+}
+
+// 嗅探非 httpadapter 連接的協議並返回匹配的規則，沒有匹配時返回 -1
+//
+// flag 是已經讀取的數據，返回的 backend 會重放所有已經讀取的數據
+func (s *Server) route(c net.Conn, flag []byte) (backend net.Conn, route int) {
+	route = -1
+	sn := &sniffer{
+		c: c,
+		b: append(make([]byte, 0, 512), flag...),
+	}
+	defer func() {
+		backend = &httpConn{
+			Conn: c,
+			b:    sn.b,
+		}
+	}()
+	if len(s.opts.routes) == 0 {
+		return
+	}
+	var (
+		proto       = sn.protocol()
+		host        string
+		hostSniffed bool
+	)
+	for i := range s.opts.routes {
+		r := &s.opts.routes[i]
+		if r.Protocol != proto {
+			continue
+		}
+		if len(r.Hosts) != 0 && !hostSniffed {
+			hostSniffed = true
+			switch proto {
+			case MuxTLS:
+				host = sn.serverName()
+			case MuxHTTP:
+				host = sn.host()
+			}
+		}
+		if r.matchHost(host) {
+			route = i
+			return
+		}
+	}
+	return
+}
+
+// 在 tls 監聽器上終止 tls 之前嗅探 ClientHello 並按照 SNI 匹配 MuxTLS 規則，沒有匹配時返回 -1
+//
+// 返回的 c 會重放所有已經讀取的數據，沒有匹配時服務器使用它自己終止 tls
+func (s *Server) routeTLS(c net.Conn) (conn net.Conn, route int) {
+	conn = c
+	route = -1
+	found := false
+	for i := range s.opts.routes {
+		if s.opts.routes[i].Protocol == MuxTLS {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	sn := &sniffer{
+		c: c,
+		b: make([]byte, 0, 512),
+	}
+	if sn.protocol() == MuxTLS {
+		host := sn.serverName()
+		for i := range s.opts.routes {
+			r := &s.opts.routes[i]
+			if r.Protocol == MuxTLS && r.matchHost(host) {
+				route = i
+				break
+			}
+		}
+	}
+	conn = &httpConn{
+		Conn: c,
+		b:    sn.b,
+	}
+	return
+}
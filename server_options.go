@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/powerpuffpenguin/easygo/option"
 )
 
@@ -19,22 +20,65 @@ var defaultServerOptions = serverOptions{
 	channels:       0,
 	channelHandler: defaultHandler,
 	tcpDialer:      DefaultTCPDialer{},
+	identity:       defaultIdentity,
 }
 
 type serverOptions struct {
-	window         uint32
-	timeout        time.Duration
-	handler        http.Handler
-	backend        Backend
-	readBuffer     int
-	writeBuffer    int
-	channels       int
-	channelHandler Handler
-	ping           time.Duration
-	tcpDialer      TCPDialer
-	hookURL        HookURL
-	hookDo         HookDo
+	window          uint32
+	timeout         time.Duration
+	handler         http.Handler
+	backend         Backend
+	readBuffer      int
+	writeBuffer     int
+	channels        int
+	channelHandler  Handler
+	ping            time.Duration
+	tcpDialer       TCPDialer
+	hookURL         HookURL
+	hookDo          HookDo
+	methods         map[string]bool
+	bodyLimit       int64
+	expectContinue  bool
+	guard           *DestinationGuard
+	locals          []*localHandler
+	websocketDialer WebsocketDialer
+	// websocket 轉發限制
+	websocketMessageLimit int64
+	websocketFrameRate    int
+	websocketByteRate     int
+	websocketIdleTimeout  time.Duration
+	proxyProtocol         bool
+	proxyTrusted          []string
+	proxyTrustedNets      []*net.IPNet
+	upstreamProxyProtocol int
+	routes                []MuxRoute
+	// 限流與配額
+	chainRate   RateLimit
+	channelRate RateLimit
+	requestRate RateLimit
+	dailyQuota  int64
+	identity    HookIdentity
+	// 帶寬限制
+	channelBandwidth int
+	chainBandwidth   int
+	serverBandwidth  int
+	// 資源上限
+	admission Admission
+	// 超時
+	chainIdleTimeout   time.Duration
+	channelIdleTimeout time.Duration
+	lifetimes          map[string]time.Duration
+	unaryTimeout       time.Duration
 }
+
+// 返回是否允許轉發此 http 方法
+func (opts *serverOptions) allowMethod(method string) bool {
+	if opts.methods == nil {
+		return true
+	}
+	return opts.methods[method]
+}
+
 type HookDo interface {
 	Do(req *http.Request) (*http.Response, error)
 }
@@ -55,6 +99,13 @@ type HookURL interface {
 	Hook(url *url.URL) (*url.URL, error)
 }
 
+// 如果 HookURL 同時實現了此接口，服務器會調用 HookHeader 替代 Hook，
+// 以便在改寫 url 的同時修改要轉發給 http/ws 上游的 header，
+// ctx 在 channel 關閉時被取消，實現可以用它限制 dns 解析等耗時操作
+type HookURLHeader interface {
+	HookHeader(ctx context.Context, url *url.URL, header http.Header) (*url.URL, http.Header, error)
+}
+
 type hookURLFunc struct {
 	f func(*url.URL) (*url.URL, error)
 }
@@ -84,15 +135,40 @@ func TCPDialerFunc(f func(ctx context.Context, addr string, tls bool) (c net.Con
 type TCPDialer interface {
 	DialContext(ctx context.Context, addr string, tls bool) (net.Conn, error)
 }
-type DefaultTCPDialer struct{}
+type DefaultTCPDialer struct {
+	// 如果不爲 nil 則在撥號時使用它檢查目標地址
+	Guard *DestinationGuard
+}
 
-func (DefaultTCPDialer) DialContext(ctx context.Context, addr string, safe bool) (net.Conn, error) {
+func (d DefaultTCPDialer) DialContext(ctx context.Context, addr string, safe bool) (net.Conn, error) {
+	var netDialer net.Dialer
+	if d.Guard != nil {
+		netDialer.Control = d.Guard.Control
+	}
 	if safe {
-		var dialer tls.Dialer
+		dialer := tls.Dialer{
+			NetDialer: &netDialer,
+		}
 		return dialer.DialContext(ctx, `tcp`, addr)
 	} else {
-		var dialer net.Dialer
-		return dialer.DialContext(ctx, `tcp`, addr)
+		return netDialer.DialContext(ctx, `tcp`, addr)
+	}
+}
+
+// 用於連接轉發的 websocket，*websocket.Dialer 實現了此接口
+type WebsocketDialer interface {
+	DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)
+}
+type websocketDialerFunc struct {
+	f func(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)
+}
+
+func (d websocketDialerFunc) DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error) {
+	return d.f(ctx, urlStr, requestHeader)
+}
+func WebsocketDialerFunc(f func(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)) WebsocketDialer {
+	return websocketDialerFunc{
+		f: f,
 	}
 }
 
@@ -128,7 +204,8 @@ func ServerHandler(handler Handler) ServerOption {
 	})
 }
 
-// 如果 backend 不爲空字符串，則將 httpadapter 之外的協議轉發到此後端
+// 如果 backend 不爲空字符串，則將 httpadapter 之外的協議轉發到此後端，
+// 設置了 ServerRoute 時只有沒有匹配規則的連接纔會轉發到此後端
 func ServerBackend(backend Backend) ServerOption {
 	return option.New(func(opts *serverOptions) {
 		opts.backend = backend
@@ -203,7 +280,18 @@ func ServerTCPDialer(dialer TCPDialer) ServerOption {
 	})
 }
 
+// 設置服務器如何連接轉發的 websocket，默認使用 websocket.DefaultDialer
+//
+// 可以使用自定義的 *websocket.Dialer 設置 tls、代理、壓縮等
+func ServerWebsocketDialer(dialer WebsocketDialer) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.websocketDialer = dialer
+	})
+}
+
 // 設置一個 hook 用於在轉發前對 目標 url 進行 過濾
+//
+// 可以使用 rewriter.New 創建一個基於規則的 HookURL
 func ServerHookURL(h HookURL) ServerOption {
 	return option.New(func(opts *serverOptions) {
 		opts.hookURL = h
@@ -216,3 +304,246 @@ func ServerHookDo(h HookDo) ServerOption {
 		opts.hookDo = h
 	})
 }
+
+// 設置允許轉發的 http 方法，如果不設置則允許任何符合 RFC 7230 token 定義的方法
+func ServerMethods(methods ...string) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		if len(methods) == 0 {
+			opts.methods = nil
+			return
+		}
+		keys := make(map[string]bool, len(methods))
+		for _, method := range methods {
+			keys[method] = true
+		}
+		opts.methods = keys
+	})
+}
+
+// 設置允許轉發的最大請求 body，如果 < 1 則不限制
+//
+// chunked 傳輸的 body 在讀取時計數，超過限制時如果還沒有發送響應則返回 413，否則重置 channel
+func ServerBodyLimit(limit int64) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.bodyLimit = limit
+	})
+}
+
+// 如果爲 true，當客戶端要求 100-continue 時服務器會向上游轉發 Expect: 100-continue，
+// 由上游決定是否接收 body，否則服務器在驗證請求後立刻通知客戶端發送 body
+func ServerExpectContinue(forward bool) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.expectContinue = forward
+	})
+}
+
+// 設置目標地址守衛，在撥號時檢查 tcp/tls/ws/wss/http/https 上游的 ip，被拒絕的請求返回 rejected by policy 錯誤
+//
+// 它會作用於 DefaultTCPDialer 以及沒有設置 ServerWebsocketDialer 與 ServerHookDo 時使用的撥號器和 http.Client，
+// 如果設置了自定義的 TCPDialer、WebsocketDialer 或 HookDo 需要自己使用 DestinationGuard.Control 或 DestinationGuard.DialContext
+func ServerDestinationGuard(guard *DestinationGuard) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.guard = guard
+	})
+}
+
+// 將匹配 pattern 的一元請求直接交給 handler 在進程內處理，而不經過網路
+//
+// pattern 可以是 Host(例如 'api.local:8080')、Hostname(例如 'api.local') 或者 url 前綴(例如 'http://api.local/v1/')，
+// 多次設置時按照設置順序匹配。handler 的響應直接寫入 channel，所以不需要設置 Content-Length
+//
+// url 前綴不以 / 結尾時只匹配完整的路徑段，例如 'http://api.local/v1' 匹配 /v1 與 /v1/users 但不匹配 /v1x
+//
+// 與 http.ServeMux.Handle 一樣，如果 pattern 無效或 handler 爲 nil 則 panic
+func ServerLocal(pattern string, handler http.Handler) ServerOption {
+	local, e := newLocalHandler(pattern, handler)
+	if e != nil {
+		panic(e)
+	}
+	return option.New(func(opts *serverOptions) {
+		opts.locals = append(opts.locals, local)
+	})
+}
+
+// 設置轉發 websocket 時單個消息的最大長度，如果 < 1 則不限制
+//
+// 兩個方向的消息都受此限制，超過時服務器以關閉碼 1009 關閉 websocket
+func ServerWebsocketMessageLimit(limit int64) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.websocketMessageLimit = limit
+	})
+}
+
+// 設置轉發 websocket 時每個 channel 上客戶端每秒允許發送的幀數量與字節數，如果 < 1 則不限制
+//
+// 數據幀與控制幀都會被計數，超過時服務器以關閉碼 1008 關閉 websocket
+func ServerWebsocketRateLimit(frames, bytes int) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.websocketFrameRate = frames
+		opts.websocketByteRate = bytes
+	})
+}
+
+// 設置轉發 websocket 時的空閒超時，如果兩個方向都沒有任何幀經過 timeout 時間，服務器以關閉碼 1008 關閉 websocket，
+// 如果 < 1 則不限制
+func ServerWebsocketIdleTimeout(timeout time.Duration) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.websocketIdleTimeout = timeout
+	})
+}
+
+// 如果爲 true，服務器要求每個連接以 HAProxy PROXY protocol v1 或 v2 頭開始，並使用頭中記錄的客戶端地址作爲連接地址，
+// 沒有有效頭的連接會被關閉。只應該在服務器位於發送 PROXY 頭的負載均衡器之後時啓用
+//
+// 使用 tls 時需要使用 ServeTLS 或 ListenAndServeTLS，以便在 tls 握手之前解析 PROXY 頭。
+// 任何能直接訪問端口的客戶端都可以僞造 PROXY 頭，所以應該同時使用 ServerProxyProtocolTrusted 限制負載均衡器的地址
+func ServerProxyProtocol(enable bool) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.proxyProtocol = enable
+	})
+}
+
+// 設置允許發送 PROXY protocol 頭的來源網段(例如負載均衡器的 '10.0.0.0/8')，不設置則信任所有來源
+//
+// 啓用 ServerProxyProtocol 後，來自其它地址的連接會被直接關閉，以免客戶端僞造地址繞過按照 ip 的限流。
+// 與 http.ServeMux.Handle 一樣，如果 cidr 無效則 panic
+func ServerProxyProtocolTrusted(cidrs ...string) ServerOption {
+	nets, e := parseCIDRs(cidrs)
+	if e != nil {
+		panic(`httpadapter: invalid PROXY protocol trusted cidr: ` + e.Error())
+	}
+	trusted := append([]string(nil), cidrs...)
+	return option.New(func(opts *serverOptions) {
+		opts.proxyTrusted = trusted
+		opts.proxyTrustedNets = nets
+	})
+}
+
+// 設置連接 tcp:// 上游與 Backend 後向其發送的 PROXY protocol 頭版本，以便上游獲取真實的客戶端地址，
+// 可以是 1 或 2，其它值表示不發送
+//
+// tls:// 上游不會發送 PROXY 頭
+func ServerUpstreamProxyProtocol(version int) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		if version == 1 || version == 2 {
+			opts.upstreamProxyProtocol = version
+		} else {
+			opts.upstreamProxyProtocol = 0
+		}
+	})
+}
+
+// 添加端口多路復用規則，服務器會嗅探 httpadapter 之外的連接協議並按照添加順序匹配規則，
+// 以便在同一端口上提供 tls(按照 SNI)、ssh、http(按照 Host)、h2c 等多個服務
+//
+// 沒有匹配任何規則的連接會轉發給 ServerBackend，如果沒有設置則交給 ServerHTTP
+//
+// 使用 ServeTLS 時 MuxTLS 規則在服務器終止 tls 之前按照 SNI 匹配，匹配的連接不解密直接轉發給後端，
+// 其它連接由服務器使用自己的證書終止 tls。所以此時 MuxTLS 規則應該設置 Hosts，否則所有 tls 連接都會被轉發
+func ServerRoute(routes ...MuxRoute) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.routes = append(opts.routes, routes...)
+	})
+}
+
+// 設置每個來源 ip 建立 tcp-chain 的速率，超過時服務器返回 HelloBusy 的 hello，Rate 或 Burst < 1 則不限制
+func ServerChainRate(limit RateLimit) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.chainRate = limit
+	})
+}
+
+// 設置每個 tcp-chain 上創建 channel 的速率，超過時服務器以 code 3 拒絕創建，Rate 或 Burst < 1 則不限制
+func ServerChannelRate(limit RateLimit) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.channelRate = limit
+	})
+}
+
+// 設置每個身份發送請求的速率，超過時服務器返回 429 與 ErrorRateLimited，Rate 或 Burst < 1 則不限制
+func ServerRequestRate(limit RateLimit) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.requestRate = limit
+	})
+}
+
+// 設置每個身份每天允許轉發的字節數，包括請求與響應以及 tcp/ws 通道的數據，< 1 則不限制
+//
+// 超過配額後新的請求會收到 429 與 ErrorRateLimited，正在轉發的 channel 會被關閉
+func ServerDailyQuota(bytes int64) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.dailyQuota = bytes
+	})
+}
+
+// 設置如何確定請求者的身份，用於 ServerRequestRate 與 ServerDailyQuota，默認使用客戶端 ip
+func ServerIdentity(identity HookIdentity) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		if identity == nil {
+			opts.identity = defaultIdentity
+		} else {
+			opts.identity = identity
+		}
+	})
+}
+
+// 設置服務器發送數據的帶寬限制，單位是每秒字節數，分別限制每個 channel、每個 tcp-chain 與所有 tcp-chain 的總和，
+// < 1 則不限制。只有 channel 的數據受限制，ping 與確認等控制指令不會被延遲
+//
+// 運行時可以使用 Server.SetBandwidth 調整
+func ServerBandwidth(channel, chain, server int) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.channelBandwidth = channel
+		opts.chainBandwidth = chain
+		opts.serverBandwidth = server
+	})
+}
+
+// 設置服務器資源的上限，超過時新的 tcp-chain 會收到帶有重試提示的 HelloBusy，新的 channel 會以 code 4 被拒絕
+func ServerAdmission(admission Admission) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.admission = admission
+	})
+}
+
+// 設置 tcp-chain 上沒有任何 channel 多久後關閉 tcp-chain，< 1 則不限制
+func ServerChainIdleTimeout(timeout time.Duration) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.chainIdleTimeout = timeout
+	})
+}
+
+// 設置 channel 在兩個方向都沒有數據流動多久後被重置，< 1 則不限制
+func ServerChannelIdleTimeout(timeout time.Duration) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.channelIdleTimeout = timeout
+	})
+}
+
+// 設置轉發 scheme(例如 tcp ws http)的 channel 最長可以存在多久，超過後 channel 被重置，< 1 則不限制
+//
+// scheme 爲空字符串時設置所有 channel 的默認值，它在創建 channel 時生效所以同樣作用於自定義的 ServerHandler，
+// 轉發 scheme 的設置在解析請求後覆蓋默認值
+func ServerChannelLifetime(scheme string, lifetime time.Duration) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		lifetimes := make(map[string]time.Duration, len(opts.lifetimes)+1)
+		for k, v := range opts.lifetimes {
+			lifetimes[k] = v
+		}
+		if lifetime > 0 {
+			lifetimes[scheme] = lifetime
+		} else {
+			delete(lifetimes, scheme)
+		}
+		opts.lifetimes = lifetimes
+	})
+}
+
+// 設置一元請求從收到請求到響應 body 發送完成的最長時間，< 1 則不限制
+//
+// 上游在此時間內沒有響應時服務器返回 504 與 ErrorTimeout，響應已經開始發送則重置 channel
+func ServerUnaryTimeout(timeout time.Duration) ServerOption {
+	return option.New(func(opts *serverOptions) {
+		opts.unaryTimeout = timeout
+	})
+}
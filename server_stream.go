@@ -0,0 +1,25 @@
+package httpadapter
+
+import (
+	"net/http"
+
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+// 轉發全雙工的 http 流，請求 body 與響應 body 同時在 channel 上傳輸，響應結束後返回 trailer
+func (f *forwardConn) stream(client HookDo, md *core.ClientMetadata, bodylen int64) {
+	req, e := f.newRequest(md, bodylen)
+	if e != nil {
+		f.sendError(http.StatusBadRequest, core.ErrorBadRequest, e.Error())
+		return
+	}
+	resp, e := f.do(client, req)
+	if e != nil {
+		f.sendDialError(e)
+		return
+	}
+	defer resp.Body.Close()
+	// 流總是在響應 body 之後返回 trailer
+	f.trailer = true
+	f.sendChunked(resp, resp.Header, resp.Body, ``)
+}
@@ -1,16 +1,33 @@
 package httpadapter_test
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/powerpuffpenguin/httpadapter"
 	"github.com/powerpuffpenguin/httpadapter/core"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
 )
 
 const TCP = "127.0.0.1:12234"
@@ -217,3 +234,1059 @@ func TestServer(t *testing.T) {
 		c.Close()
 	}
 }
+
+type proxyProtocolDialer []byte
+
+func (d proxyProtocolDialer) Dial(network, address string) (net.Conn, error) {
+	c, e := net.Dial(network, address)
+	if e != nil {
+		return nil, e
+	}
+	_, e = c.Write(d)
+	if e != nil {
+		c.Close()
+		return nil, e
+	}
+	return c, nil
+}
+func TestServerProxyProtocol(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/addr`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerProxyProtocol(true),
+		httpadapter.ServerUpstreamProxyProtocol(1),
+	)
+	defer s.CloseAndWait()
+
+	// 兼容的 http 使用 v1 頭中的地址
+	c, e := net.Dial(`tcp`, Addr)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = c.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4000 12233\r\n" +
+		"GET /addr HTTP/1.1\r\nHost: " + Addr + "\r\nConnection: close\r\n\r\n",
+	))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	resp, e := http.ReadResponse(bufio.NewReader(c), nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	b, e := io.ReadAll(resp.Body)
+	c.Close()
+	if !assert.Nil(t, e) || !assert.Equal(t, `203.0.113.7:4000`, string(b)) {
+		t.FailNow()
+	}
+
+	// 沒有 PROXY 頭的連接會被關閉
+	c, e = net.Dial(`tcp`, Addr)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = c.Write([]byte("GET /addr HTTP/1.1\r\nHost: " + Addr + "\r\n\r\n"))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = http.ReadResponse(bufio.NewReader(c), nil)
+	c.Close()
+	if !assert.NotNil(t, e) {
+		t.FailNow()
+	}
+
+	// tcp-chain 使用 v2 頭中的地址，並以 v1 頭告訴 tcp 上游
+	l, e := net.Listen(`tcp`, TCP)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer l.Close()
+	header := make(chan string, 1)
+	go func() {
+		c, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer c.Close()
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		header <- line
+	}()
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 203, 0, 113, 9, 127, 0, 0, 1, 0x13, 0x88, 0x2f, 0xe9)
+	client := httpadapter.NewClient(Addr,
+		httpadapter.WithDialer(proxyProtocolDialer(v2)),
+	)
+	defer client.Close()
+	c, _, e = client.Connect(context.Background(), `tcp://`+TCP)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer c.Close()
+	if !assert.Equal(t, "PROXY TCP4 203.0.113.9 127.0.0.1 5000 12234\r\n", <-header) {
+		t.FailNow()
+	}
+}
+func TestServerProxyProtocolTrusted(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/addr`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	if !assert.Panics(t, func() { httpadapter.ServerProxyProtocolTrusted(`10.0.0.0`) }) {
+		t.FailNow()
+	}
+	request := func() (string, error) {
+		c, e := net.Dial(`tcp`, Addr)
+		if e != nil {
+			return ``, e
+		}
+		defer c.Close()
+		_, e = c.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4000 12233\r\n" +
+			"GET /addr HTTP/1.1\r\nHost: " + Addr + "\r\nConnection: close\r\n\r\n",
+		))
+		if e != nil {
+			return ``, e
+		}
+		resp, e := http.ReadResponse(bufio.NewReader(c), nil)
+		if e != nil {
+			return ``, e
+		}
+		b, e := io.ReadAll(resp.Body)
+		return string(b), e
+	}
+	for _, item := range []struct {
+		trusted string
+		ok      bool
+	}{
+		{`127.0.0.0/8`, true},
+		// 不受信任的來源僞造 PROXY 頭，連接被關閉
+		{`10.0.0.0/8`, false},
+	} {
+		s := newServer(t,
+			httpadapter.ServerHTTP(mux),
+			httpadapter.ServerProxyProtocol(true),
+			httpadapter.ServerProxyProtocolTrusted(item.trusted),
+		)
+		if !assert.Equal(t, []string{item.trusted}, s.ProxyProtocolTrusted()) {
+			t.FailNow()
+		}
+		addr, e := request()
+		s.CloseAndWait()
+		if item.ok {
+			if !assert.Nil(t, e) || !assert.Equal(t, `203.0.113.7:4000`, addr) {
+				t.FailNow()
+			}
+		} else if !assert.NotNil(t, e) {
+			t.FailNow()
+		}
+	}
+}
+func TestServerRoute(t *testing.T) {
+	// 記錄後端收到的第一個字節
+	listen := func(addr string) (net.Listener, chan byte) {
+		l, e := net.Listen(`tcp`, addr)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		ch := make(chan byte, 10)
+		go func() {
+			for {
+				c, e := l.Accept()
+				if e != nil {
+					break
+				}
+				go func() {
+					defer c.Close()
+					b := make([]byte, 1)
+					if _, e := io.ReadFull(c, b); e == nil {
+						ch <- b[0]
+					}
+				}()
+			}
+		}()
+		return l, ch
+	}
+	l0, backend0 := listen(TCP)
+	defer l0.Close()
+	l1, backend1 := listen(`127.0.0.1:12235`)
+	defer l1.Close()
+
+	api := http.NewServeMux()
+	api.HandleFunc(`/name`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`api`))
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/name`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`default`))
+	})
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerRoute(
+			httpadapter.MuxRoute{
+				Protocol: httpadapter.MuxTLS,
+				Hosts:    []string{`*.example.com`},
+				Backend:  httpadapter.NewTCPBackend(TCP),
+			},
+			httpadapter.MuxRoute{
+				Protocol: httpadapter.MuxTLS,
+				Backend:  httpadapter.NewTCPBackend(`127.0.0.1:12235`),
+			},
+			httpadapter.MuxRoute{
+				Protocol: httpadapter.MuxSSH,
+				Backend:  httpadapter.NewTCPBackend(TCP),
+			},
+			httpadapter.MuxRoute{
+				Protocol: httpadapter.MuxHTTP,
+				Hosts:    []string{`api.local`},
+				Handler:  api,
+			},
+		),
+	)
+	defer s.CloseAndWait()
+
+	// tls 按照 SNI 路由
+	for _, item := range []struct {
+		name    string
+		backend chan byte
+	}{
+		{`a.example.com`, backend0},
+		{`other.local`, backend1},
+	} {
+		c, e := net.Dial(`tcp`, Addr)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		go tls.Client(c, &tls.Config{
+			ServerName:         item.name,
+			InsecureSkipVerify: true,
+		}).Handshake()
+		if !assert.Equal(t, byte(0x16), <-item.backend, item.name) {
+			t.FailNow()
+		}
+		c.Close()
+	}
+
+	// ssh
+	c, e := net.Dial(`tcp`, Addr)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = c.Write([]byte("SSH-2.0-OpenSSH_9.0\r\n"))
+	if !assert.Nil(t, e) || !assert.Equal(t, byte('S'), <-backend0) {
+		t.FailNow()
+	}
+	c.Close()
+
+	// http 按照 Host 路由，沒有匹配的連接交給 ServerHTTP
+	for host, name := range map[string]string{
+		`api.local:80`: `api`,
+		`www.local`:    `default`,
+	} {
+		req, e := http.NewRequest(http.MethodGet, BaseURL+`/name`, nil)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		req.Host = host
+		// 路由只在連接的第一個請求上進行
+		req.Close = true
+		resp, e := http.DefaultClient.Do(req)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		b, e := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !assert.Nil(t, e) || !assert.Equal(t, name, string(b)) {
+			t.FailNow()
+		}
+	}
+
+	// httpadapter 仍然由服務器處理
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+	resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/name`,
+	})
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	b, e := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !assert.Nil(t, e) || !assert.Equal(t, `default`, string(b)) {
+		t.FailNow()
+	}
+}
+
+func TestServerRouteTLS(t *testing.T) {
+	l0, e := net.Listen(`tcp`, TCP)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer l0.Close()
+	backend := make(chan byte, 10)
+	go func() {
+		for {
+			c, e := l0.Accept()
+			if e != nil {
+				break
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 1)
+				if _, e := io.ReadFull(c, b); e == nil {
+					backend <- b[0]
+				}
+			}()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/name`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`default`))
+	})
+	certFile, keyFile := writeCertificate(t)
+	l, e := net.Listen(`tcp`, Addr)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	server := httpadapter.NewServer(
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerRoute(httpadapter.MuxRoute{
+			Protocol: httpadapter.MuxTLS,
+			Hosts:    []string{`*.example.com`},
+			Backend:  httpadapter.NewTCPBackend(TCP),
+		}),
+	)
+	done := make(chan struct{})
+	go func() {
+		server.ServeTLS(l, certFile, keyFile)
+		close(done)
+	}()
+	defer func() {
+		server.Close()
+		<-done
+	}()
+
+	// 匹配 SNI 的連接不解密直接轉發，後端收到的是 ClientHello
+	c, e := net.Dial(`tcp`, Addr)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	go tls.Client(c, &tls.Config{
+		ServerName:         `a.example.com`,
+		InsecureSkipVerify: true,
+	}).Handshake()
+	select {
+	case b := <-backend:
+		if !assert.Equal(t, byte(0x16), b) {
+			t.FailNow()
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal(`tls not routed by SNI`)
+	}
+	c.Close()
+
+	// 其它連接由服務器終止 tls
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, e := client.Get(`https://` + Addr + `/name`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	b, e := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !assert.Nil(t, e) || !assert.Equal(t, `default`, string(b)) {
+		t.FailNow()
+	}
+}
+
+// 生成測試使用的自簽名證書
+func writeCertificate(t *testing.T) (certFile, keyFile string) {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: `127.0.0.1`},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, e := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	der, e := x509.MarshalECPrivateKey(key)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, `cert.pem`)
+	keyFile = filepath.Join(dir, `key.pem`)
+	e = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: cert}), 0600)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	e = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: `EC PRIVATE KEY`, Bytes: der}), 0600)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	return
+}
+func TestServerHTTP2(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/proto`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	get := func(client *http.Client, url string) string {
+		resp, e := client.Get(url)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		b, e := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		return string(b)
+	}
+
+	// h2c prior knowledge
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	if !assert.Equal(t, `HTTP/2.0`, get(client, BaseURL+`/proto`)) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `HTTP/1.1`, get(http.DefaultClient, BaseURL+`/proto`)) {
+		t.FailNow()
+	}
+	client.CloseIdleConnections()
+	s.CloseAndWait()
+
+	// tls 通過 ALPN 選擇 h2 或 httpadapter
+	certFile, keyFile := writeCertificate(t)
+	l, e := net.Listen(`tcp`, Addr)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	server := httpadapter.NewServer(httpadapter.ServerHTTP(mux))
+	done := make(chan struct{})
+	go func() {
+		server.ServeTLS(l, certFile, keyFile)
+		close(done)
+	}()
+	defer func() {
+		server.Close()
+		<-done
+	}()
+	client = &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	defer client.CloseIdleConnections()
+	if !assert.Equal(t, `HTTP/2.0`, get(client, `https://`+Addr+`/proto`)) {
+		t.FailNow()
+	}
+
+	for _, item := range []struct {
+		flag string
+		code core.Hello
+	}{
+		{core.Flag, core.HelloOk},
+		// 選擇了 httpadapter 的連接不會被嗅探爲 http
+		{`GET / HTTP/1.1`, core.HelloInvalidProtocol},
+	} {
+		c, e := tls.Dial(`tcp`, Addr, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{httpadapter.ALPNProtocol},
+		})
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, httpadapter.ALPNProtocol, c.ConnectionState().NegotiatedProtocol) {
+			t.FailNow()
+		}
+		b := []byte(item.flag)
+		if item.flag == core.Flag {
+			hello := core.ClientHello{
+				Window:  1,
+				Version: []string{core.ProtocolVersion},
+			}
+			b, e = hello.Marshal()
+			if !assert.Nil(t, e) {
+				t.FailNow()
+			}
+		} else {
+			b = append(b, "\r\nHost: "+Addr+"\r\n\r\n"...)
+		}
+		_, e = c.Write(b)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		sh, e := core.ReadServerHello(c, nil)
+		c.Close()
+		if !assert.Nil(t, e) || !assert.Equal(t, item.code, sh.Code) {
+			t.FailNow()
+		}
+	}
+}
+func TestServerWebsocketHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/name`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`websocket`))
+	})
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+	mux.Handle(`/chain`, httpadapter.WebsocketHandler{Server: s.Server})
+
+	client := httpadapter.NewClient(BaseWebsocket+`/chain`,
+		httpadapter.WithDialer(httpadapter.WebsocketClientDialer{}),
+	)
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+			URL: BaseURL + `/name`,
+		})
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		b, e := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !assert.Nil(t, e) || !assert.Equal(t, `websocket`, string(b)) {
+			t.FailNow()
+		}
+	}
+
+	// 在 websocket 上建立的 channel 是一個完整的 net.Conn
+	l, e := net.Listen(`tcp`, TCP)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer l.Close()
+	go func() {
+		c, e := l.Accept()
+		if e != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	c, _, e := client.Connect(context.Background(), `tcp://`+TCP)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer c.Close()
+	data := strings.Repeat(`0123456789`, 10*1024)
+	go c.Write([]byte(data))
+	b := make([]byte, len(data))
+	_, e = io.ReadFull(c, b)
+	if !assert.Nil(t, e) || !assert.Equal(t, data, string(b)) {
+		t.FailNow()
+	}
+}
+
+// 由兩個 io.Pipe 組成的數據流
+type pipeStream struct {
+	io.Reader
+	io.WriteCloser
+	r *io.PipeReader
+}
+
+func (s pipeStream) Close() error {
+	s.r.Close()
+	return s.WriteCloser.Close()
+}
+func newPipeStream() (s0, s1 pipeStream) {
+	r0, w0 := io.Pipe()
+	r1, w1 := io.Pipe()
+	s0 = pipeStream{Reader: r0, WriteCloser: w1, r: r0}
+	s1 = pipeStream{Reader: r1, WriteCloser: w0, r: r1}
+	return
+}
+func TestServerServeConn(t *testing.T) {
+	l, e := net.Listen(`tcp`, TCP)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				break
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	s := httpadapter.NewServer()
+	s0, s1 := newPipeStream()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- s.ServeConn(ctx, s0)
+	}()
+	client := httpadapter.NewClientFromConn(s1)
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		c, _, e := client.Connect(context.Background(), `tcp://`+TCP)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		data := fmt.Sprint(`stream `, i)
+		_, e = c.Write([]byte(data))
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		b := make([]byte, len(data))
+		_, e = io.ReadFull(c, b)
+		c.Close()
+		if !assert.Nil(t, e) || !assert.Equal(t, data, string(b)) {
+			t.FailNow()
+		}
+	}
+
+	// 取消後 tcp-chain 結束，客戶端不會重連
+	cancel()
+	if !assert.ErrorIs(t, <-result, context.Canceled) {
+		t.FailNow()
+	}
+	// 客戶端可能還沒有發現 tcp-chain 已經斷開
+	for i := 0; i < 10; i++ {
+		_, _, e = client.Connect(context.Background(), `tcp://`+TCP)
+		if errors.Is(e, httpadapter.ErrClientConnUsed) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !assert.ErrorIs(t, e, httpadapter.ErrClientConnUsed) {
+		t.FailNow()
+	}
+
+	// net.Pipe 上的 hello 錯誤
+	c0, c1 := net.Pipe()
+	go func() {
+		result <- s.ServeConn(context.Background(), c0)
+	}()
+	go c1.Write([]byte(`httpadapter` + "\x00\x00\x00\x00\x00\x03" + core.ProtocolVersion))
+	sh, e := core.ReadServerHello(c1, nil)
+	c1.Close()
+	if !assert.Nil(t, e) || !assert.Equal(t, core.HelloInvalidWindow, sh.Code) {
+		t.FailNow()
+	}
+	if !assert.ErrorIs(t, <-result, core.HelloError(core.HelloInvalidWindow)) {
+		t.FailNow()
+	}
+}
+func TestServerLimits(t *testing.T) {
+	hello := func(code core.Hello) {
+		c, e := net.Dial(`tcp`, Addr)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		defer c.Close()
+		b, e := (&core.ClientHello{
+			Window:  1,
+			Version: []string{core.ProtocolVersion},
+		}).Marshal()
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		_, e = c.Write(b)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		sh, e := core.ReadServerHello(c, nil)
+		if !assert.Nil(t, e) || !assert.Equal(t, code, sh.Code) {
+			t.FailNow()
+		}
+	}
+	// 每個 ip 建立 tcp-chain 的速率
+	s := newServer(t,
+		httpadapter.ServerChainRate(httpadapter.RateLimit{Rate: 0.001, Burst: 2}),
+	)
+	hello(core.HelloOk)
+	hello(core.HelloOk)
+	hello(core.HelloBusy)
+	s.CloseAndWait()
+
+	// 每個 tcp-chain 創建 channel 的速率
+	s = newServer(t,
+		ServerEcho(0),
+		httpadapter.ServerChannelRate(httpadapter.RateLimit{Rate: 0.001, Burst: 2}),
+	)
+	client := httpadapter.NewClient(Addr)
+	for i := 0; i < 3; i++ {
+		c, e := client.Dial()
+		if i < 2 {
+			if !assert.Nil(t, e) {
+				t.FailNow()
+			}
+			c.Close()
+		} else if !assert.ErrorIs(t, e, httpadapter.ErrRateLimited) {
+			t.FailNow()
+		}
+	}
+	client.Close()
+	s.CloseAndWait()
+
+	// 每個身份的請求速率與流量配額
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/data`, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat(`0`, 100)))
+	})
+	s = newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerRequestRate(httpadapter.RateLimit{Rate: 0.001, Burst: 3}),
+		httpadapter.ServerDailyQuota(200),
+		httpadapter.ServerIdentity(httpadapter.HookIdentityFunc(func(c httpadapter.Conn, md *core.ClientMetadata) string {
+			return md.Header.Get(`X-User`)
+		})),
+	)
+	defer s.CloseAndWait()
+	client = httpadapter.NewClient(Addr)
+	defer client.Close()
+	get := func(user string) error {
+		resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+			URL:    BaseURL + `/data`,
+			Header: http.Header{`X-User`: []string{user}},
+		})
+		if e != nil {
+			return e
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil
+	}
+	// 響應的元信息與 body 合計超過 200 字節，之後的請求超過配額
+	if !assert.Nil(t, get(`a`)) {
+		t.FailNow()
+	}
+	var fe *httpadapter.ForwardError
+	for i := 0; i < 2; i++ {
+		e := get(`a`)
+		if !assert.ErrorAs(t, e, &fe) || !assert.Equal(t, http.StatusTooManyRequests, fe.Status) ||
+			!assert.Equal(t, `daily quota`, fe.Details[`limit`]) {
+			t.FailNow()
+		}
+	}
+	// 第四個請求超過速率
+	e := get(`a`)
+	if !assert.ErrorAs(t, e, &fe) || !assert.Equal(t, `request rate`, fe.Details[`limit`]) ||
+		!assert.ErrorIs(t, e, httpadapter.ErrRateLimited) {
+		t.FailNow()
+	}
+	// 其它身份不受影響
+	if !assert.Nil(t, get(`b`)) {
+		t.FailNow()
+	}
+}
+
+type countDialer struct {
+	n int32
+}
+
+func (d *countDialer) Dial(network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.n, 1)
+	return net.Dial(network, address)
+}
+func TestServerAdmission(t *testing.T) {
+	// 活動的 tcp-chain 超過上限
+	s := newServer(t,
+		ServerEcho(0),
+		httpadapter.ServerAdmission(httpadapter.Admission{
+			Chains:     1,
+			RetryAfter: time.Second * 2,
+		}),
+	)
+	c0 := httpadapter.NewClient(Addr)
+	c, e := c0.Dial()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	c.Close()
+
+	dialer := &countDialer{}
+	c1 := httpadapter.NewClient(Addr, httpadapter.WithDialer(dialer))
+	var busy *httpadapter.BusyError
+	_, e = c1.Dial()
+	if !assert.ErrorIs(t, e, httpadapter.ErrServerBusy) || !assert.ErrorAs(t, e, &busy) ||
+		!assert.Equal(t, time.Second*2, busy.RetryAfter) {
+		t.FailNow()
+	}
+	// 退避期間不會再連接服務器
+	_, e = c1.Dial()
+	if !assert.ErrorAs(t, e, &busy) || !assert.Greater(t, busy.RetryAfter, time.Second) ||
+		!assert.Equal(t, int32(1), atomic.LoadInt32(&dialer.n)) {
+		t.FailNow()
+	}
+	c1.Close()
+	c0.Close()
+	s.CloseAndWait()
+
+	// 活動的 channel 超過上限
+	s = newServer(t,
+		ServerEcho(0),
+		httpadapter.ServerAdmission(httpadapter.Admission{
+			Channels: 1,
+		}),
+	)
+	defer s.CloseAndWait()
+	if !assert.Equal(t, 1, s.Admission().Channels) ||
+		!assert.Equal(t, time.Second*5, s.Admission().RetryAfter) {
+		t.FailNow()
+	}
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+	c, e = client.Dial()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer c.Close()
+	_, e = client.Dial()
+	if !assert.ErrorAs(t, e, &busy) || !assert.Equal(t, time.Second, busy.RetryAfter) {
+		t.FailNow()
+	}
+	_, e = client.Dial()
+	if !assert.ErrorIs(t, e, httpadapter.ErrServerBusy) {
+		t.FailNow()
+	}
+}
+func TestServerAdmissionConcurrent(t *testing.T) {
+	s := newServer(t,
+		ServerEcho(0),
+		httpadapter.ServerAdmission(httpadapter.Admission{
+			Chains: 3,
+		}),
+	)
+	defer s.CloseAndWait()
+	hello, e := (&core.ClientHello{
+		Window:  1024,
+		Version: []string{core.ProtocolVersion},
+	}).Marshal()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	// 併發的 hello 不能同時通過檢查而超過上限
+	var (
+		wait  sync.WaitGroup
+		ok    int32
+		conns = make(chan net.Conn, 100)
+	)
+	for i := 0; i < 100; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			c, e := net.Dial(`tcp`, Addr)
+			if e != nil {
+				return
+			}
+			conns <- c
+			_, e = c.Write(hello)
+			if e != nil {
+				return
+			}
+			sh, e := core.ReadServerHello(c, nil)
+			if e == nil && sh.Code == core.HelloOk {
+				atomic.AddInt32(&ok, 1)
+			}
+		}()
+	}
+	wait.Wait()
+	close(conns)
+	for c := range conns {
+		c.Close()
+	}
+	if !assert.Equal(t, int32(3), atomic.LoadInt32(&ok)) {
+		t.FailNow()
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	// 沒有 channel 的 tcp-chain 被關閉
+	s := newServer(t,
+		ServerEcho(0),
+		httpadapter.ServerChainIdleTimeout(time.Millisecond*100),
+		httpadapter.ServerChannelIdleTimeout(time.Millisecond*100),
+	)
+	c, e := net.Dial(`tcp`, Addr)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	b, e := (&core.ClientHello{
+		Window:  1024,
+		Version: []string{core.ProtocolVersion},
+	}).Marshal()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = c.Write(b)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	sh, e := core.ReadServerHello(c, nil)
+	if !assert.Nil(t, e) || !assert.Equal(t, core.HelloOk, sh.Code) {
+		t.FailNow()
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, e = c.Read(make([]byte, 1))
+	if !assert.ErrorIs(t, e, io.EOF) {
+		t.FailNow()
+	}
+	c.Close()
+
+	// 服務器重置空閒的 channel
+	client := httpadapter.NewClient(Addr)
+	cc, e := client.Dial()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = cc.Read(make([]byte, 1))
+	if !assert.ErrorIs(t, e, io.EOF) {
+		t.FailNow()
+	}
+	cc.Close()
+	client.Close()
+
+	// 客戶端重置空閒的 channel
+	client = httpadapter.NewClient(Addr,
+		httpadapter.WithChannelIdleTimeout(time.Millisecond*50),
+	)
+	cc, e = client.Dial()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = cc.Read(make([]byte, 1))
+	if !assert.ErrorIs(t, e, httpadapter.ErrChannelIdle) {
+		t.FailNow()
+	}
+	_, e = cc.Write([]byte(`ok`))
+	if !assert.ErrorIs(t, e, httpadapter.ErrChannelIdle) {
+		t.FailNow()
+	}
+	client.Close()
+	s.CloseAndWait()
+
+	// 默認的生存時間在創建 channel 時生效，同樣作用於自定義的 Handler
+	s = newServer(t,
+		ServerEcho(0),
+		httpadapter.ServerChannelLifetime(``, time.Millisecond*100),
+	)
+	client = httpadapter.NewClient(Addr)
+	cc, e = client.Dial()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	at := time.Now()
+	_, e = cc.Read(make([]byte, 1))
+	if !assert.ErrorIs(t, e, io.EOF) ||
+		!assert.GreaterOrEqual(t, time.Since(at), time.Millisecond*50) {
+		t.FailNow()
+	}
+	cc.Close()
+	client.Close()
+	s.CloseAndWait()
+
+	// 轉發 scheme 的生存時間覆蓋默認值
+	slow := http.NewServeMux()
+	slow.HandleFunc(`/slow`, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Millisecond * 300):
+		}
+		w.Write([]byte(`slow`))
+	})
+	for _, item := range []struct {
+		lifetime time.Duration
+		ok       bool
+	}{
+		{time.Hour, true},
+		{time.Millisecond * 100, false},
+	} {
+		s = newServer(t,
+			httpadapter.ServerHTTP(slow),
+			httpadapter.ServerChannelLifetime(``, time.Millisecond*100),
+			httpadapter.ServerChannelLifetime(`http`, item.lifetime),
+		)
+		client = httpadapter.NewClient(Addr)
+		resp, e := client.Unary(context.Background(), &httpadapter.MessageRequest{
+			URL: BaseURL + `/slow`,
+		})
+		if item.ok {
+			checkClientHttpBody(t, resp, e, `slow`)
+		} else if !assert.NotNil(t, e) {
+			t.FailNow()
+		}
+		client.Close()
+		s.CloseAndWait()
+	}
+
+	// 一元請求與 channel 生存時間
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/slow`, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte(`slow`))
+	})
+	s = newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerUnaryTimeout(time.Millisecond*100),
+	)
+	defer s.CloseAndWait()
+	client = httpadapter.NewClient(Addr)
+	defer client.Close()
+	_, e = client.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/slow`,
+	})
+	var fe *httpadapter.ForwardError
+	if !assert.ErrorIs(t, e, httpadapter.ErrTimeout) || !assert.ErrorAs(t, e, &fe) ||
+		!assert.Equal(t, http.StatusGatewayTimeout, fe.Status) {
+		t.FailNow()
+	}
+
+	client1 := httpadapter.NewClient(Addr,
+		httpadapter.WithUnaryTimeout(time.Millisecond*50),
+	)
+	defer client1.Close()
+	_, e = client1.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/slow`,
+	})
+	if !assert.ErrorIs(t, e, context.DeadlineExceeded) {
+		t.FailNow()
+	}
+
+	client2 := httpadapter.NewClient(Addr,
+		httpadapter.WithChannelLifetime(`http`, time.Millisecond*50),
+	)
+	defer client2.Close()
+	_, e = client2.Unary(context.Background(), &httpadapter.MessageRequest{
+		URL: BaseURL + `/slow`,
+	})
+	if !assert.ErrorIs(t, e, httpadapter.ErrChannelLifetime) {
+		t.FailNow()
+	}
+}
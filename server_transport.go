@@ -21,15 +21,18 @@ type serverTransport struct {
 func newServerTransport(server *Server,
 	c net.Conn,
 	remoteWindow uint32,
+	checksum bool,
 ) *serverTransport {
 	return &serverTransport{
 		server: server,
 		keys:   make(map[uint64]*ioChannel),
 		baseTransport: baseTransport{
-			done:   make(chan struct{}),
-			window: remoteWindow,
-			c:      c,
-			ch:     make(chan []byte, 50),
+			done:      make(chan struct{}),
+			window:    remoteWindow,
+			c:         c,
+			ch:        make(chan []byte, 50),
+			checksum:  checksum,
+			bandwidth: server.bandwidth.newChain(),
 		},
 	}
 }
@@ -44,11 +47,19 @@ func (t *serverTransport) Serve(b []byte) {
 		localAddr  = t.c.LocalAddr()
 		remoteAddr = t.c.RemoteAddr()
 		active     chan int
+		createRate *tokenBucket
+		admission  = t.server.admission
 	)
+	if opts.channelRate.enabled() {
+		createRate = newTokenBucket(opts.channelRate, time.Now())
+	}
 	// 建立讀取緩存
 	if opts.readBuffer > 0 {
 		r = bufio.NewReaderSize(r, opts.readBuffer)
 	}
+	if t.checksum {
+		r = newFrameReader(r, t.reset)
+	}
 
 	// ping
 	if opts.ping > time.Second {
@@ -56,6 +67,10 @@ func (t *serverTransport) Serve(b []byte) {
 		go t.servePing(active, opts.ping)
 	}
 
+	if opts.chainIdleTimeout > 0 {
+		go t.serveIdle(opts.chainIdleTimeout, t.channels)
+	}
+
 	// 寫入 tcp-chain
 	go t.serveWrite(active, opts.writeBuffer)
 
@@ -98,12 +113,23 @@ TS:
 				data[1+8] = 1
 			} else if opts.channels > 0 && len(t.keys) >= opts.channels {
 				data[1+8] = 2
+			} else if createRate != nil && !createRate.allow(time.Now()) {
+				data[1+8] = 3
+			} else if !admission.acquireChannel() {
+				data[1+8] = 4
 			} else {
 				val := newIOChannel(t, id,
 					localAddr, remoteAddr,
 					int(opts.window), int(t.window),
 				)
-				go val.Serve()
+				val.bandwidth = t.bandwidth.newChannel()
+				val.buffered = &admission.buffered
+				val.resetIdle(opts.channelIdleTimeout)
+				val.setLifetime(opts.lifetimes[``])
+				go func() {
+					val.Serve()
+					admission.releaseChannel()
+				}()
 				go opts.channelHandler.ServeChannel(t.server, val)
 				t.keys[id] = val
 				data[1+8] = 0
@@ -198,6 +224,12 @@ TS:
 	}
 	t.Unlock()
 }
+func (t *serverTransport) channels() (n int) {
+	t.Lock()
+	n = len(t.keys)
+	t.Unlock()
+	return
+}
 func (t *serverTransport) getWriter() chan<- []byte {
 	return t.ch
 }
@@ -217,6 +249,17 @@ func (t *serverTransport) delete(c *ioChannel) {
 	}
 	t.sendClose(c.id)
 }
+
+// 幀損壞時重置 channel
+func (t *serverTransport) reset(id uint64) {
+	t.Lock()
+	if sc, exists := t.keys[id]; exists {
+		sc.Close()
+		delete(t.keys, id)
+	}
+	t.Unlock()
+	t.sendClose(id)
+}
 func (t *serverTransport) sendClose(id uint64) {
 	b := make([]byte, 1+8)
 	b[0] = byte(core.CommandClose)
@@ -0,0 +1,490 @@
+package httpadapter
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/powerpuffpenguin/httpadapter/core"
+)
+
+// 等待對面回覆 close 的最長時間
+const websocketCloseTimeout = time.Second * 3
+
+func (f *forwardConn) websocket(opts *serverOptions, md *core.ClientMetadata, bodylen int64) {
+	if bodylen != 0 {
+		f.sendError(http.StatusBadRequest, core.ErrorBadRequest, `bodylen invalid`)
+		return
+	} else if !f.checkCompress(md) {
+		return
+	}
+	ctx := f.c.Context()
+	ws, resp, e := opts.websocketDialer.DialContext(ctx, md.URL, md.Header)
+	if e != nil {
+		if resp == nil {
+			f.sendDialError(e)
+		} else {
+			f.sendErrorDetails(http.StatusBadGateway, &core.Error{
+				Code:    core.ErrorUpstreamError,
+				Message: e.Error(),
+				Details: map[string]string{
+					`status`: strconv.Itoa(resp.StatusCode),
+				},
+			})
+		}
+		return
+	}
+	defer ws.Close()
+	e = f.switchingProtocols(md, websocketResponseHeader(resp))
+	if e != nil {
+		return
+	}
+	if opts.websocketMessageLimit > 0 {
+		ws.SetReadLimit(opts.websocketMessageLimit)
+	}
+	w := &websocketForward{
+		f:       f,
+		ws:      ws,
+		control: md.Control,
+		limit:   opts.websocketMessageLimit,
+		rate:    newWebsocketRate(opts.websocketFrameRate, opts.websocketByteRate),
+		idle:    opts.websocketIdleTimeout,
+	}
+	w.serve()
+}
+
+// 返回要轉發給客戶端的上游握手響應 header，刪除只在服務器與上游之間有效的屬性
+func websocketResponseHeader(resp *http.Response) http.Header {
+	if resp == nil {
+		return nil
+	}
+	header := resp.Header.Clone()
+	for _, k := range []string{
+		`Connection`,
+		`Upgrade`,
+		`Sec-Websocket-Accept`,
+		`Sec-Websocket-Extensions`,
+	} {
+		header.Del(k)
+	}
+	return header
+}
+
+// 在 channel 與上游 websocket 之間轉發數據幀
+type websocketForward struct {
+	f  *forwardConn
+	ws *websocket.Conn
+	// 客戶端能夠處理控制幀
+	control bool
+
+	// 正在向客戶端發送數據幀，此時收到的控制幀需要等到數據幀結束後再發送
+	locker  sync.Mutex
+	reading bool
+	pending [][]byte
+
+	// 已經將客戶端的 close 轉發給上游
+	clientClosed int32
+	// 已經將上游的 close 轉發給客戶端
+	upstreamClosed int32
+
+	// 單個消息的最大長度
+	limit int64
+	// 客戶端發送速率限制，只在 writeLoop 中使用
+	rate *websocketRate
+	// 空閒超時與最後一次收到幀的時間
+	idle   time.Duration
+	active int64
+	// 服務器因爲違反限制而主動關閉了 websocket
+	violated int32
+}
+
+func (w *websocketForward) serve() {
+	if w.control {
+		w.ws.SetPingHandler(func(appData string) error {
+			w.touch()
+			return w.sendControl(websocket.PingMessage, []byte(appData))
+		})
+		w.ws.SetPongHandler(func(appData string) error {
+			w.touch()
+			return w.sendControl(websocket.PongMessage, []byte(appData))
+		})
+		w.ws.SetCloseHandler(func(code int, text string) error {
+			atomic.StoreInt32(&w.upstreamClosed, 1)
+			return w.sendControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+		})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	if w.idle > 0 {
+		w.touch()
+		go w.serveIdle(done)
+	}
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		w.readLoop()
+	}()
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		w.writeLoop()
+	}()
+
+	var wait <-chan struct{}
+	select {
+	case <-readDone:
+		// 上游關閉，等待客戶端回覆 close
+		wait = writeDone
+	case <-writeDone:
+		if atomic.LoadInt32(&w.clientClosed) == 0 && atomic.LoadInt32(&w.violated) == 0 {
+			// 客戶端沒有進行關閉握手就關閉了 channel
+			w.ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, ``),
+				time.Now().Add(websocketCloseTimeout),
+			)
+		}
+		// 等待上游回覆 close
+		wait = readDone
+	}
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(websocketCloseTimeout, func() {
+		close(timeout)
+	})
+	defer timer.Stop()
+	select {
+	case <-wait:
+	case <-timeout:
+	}
+	if wait == readDone && w.control &&
+		atomic.LoadInt32(&w.clientClosed) != 0 && atomic.LoadInt32(&w.upstreamClosed) != 0 {
+		// 由客戶端發起的關閉握手，客戶端收到 close 回覆後會關閉 channel，
+		// 在此之前關閉 channel 可能導致回覆的 close 沒有被送達
+		select {
+		case <-w.f.c.Context().Done():
+		case <-timeout:
+		}
+	}
+	w.ws.Close()
+	w.f.c.Close()
+}
+
+// 記錄收到幀的時間
+func (w *websocketForward) touch() {
+	atomic.StoreInt64(&w.active, time.Now().UnixNano())
+}
+
+// 兩個方向都沒有幀超過 idle 時間後關閉 websocket
+func (w *websocketForward) serveIdle(done <-chan struct{}) {
+	timer := time.NewTimer(w.idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&w.active)))
+		if idle >= w.idle {
+			w.violate(websocket.ClosePolicyViolation, `idle timeout`)
+			return
+		}
+		timer.Reset(w.idle - idle)
+	}
+}
+
+// 因爲違反限制關閉 websocket，向上游和客戶端發送 close 後關閉上游連接，
+// 之後等待客戶端回覆 close 再關閉 channel，如果客戶端不能處理控制幀則直接關閉 channel
+func (w *websocketForward) violate(code int, text string) {
+	if !atomic.CompareAndSwapInt32(&w.violated, 0, 1) {
+		return
+	}
+	data := websocket.FormatCloseMessage(code, text)
+	w.ws.WriteControl(websocket.CloseMessage, data, time.Now().Add(websocketCloseTimeout))
+	if w.control {
+		atomic.StoreInt32(&w.upstreamClosed, 1)
+		w.sendControl(websocket.CloseMessage, data)
+		w.ws.Close()
+	} else {
+		w.ws.Close()
+		w.f.c.Close()
+	}
+}
+
+// 向客戶端發送控制幀
+func (w *websocketForward) sendControl(t int, data []byte) (e error) {
+	b := make([]byte, 4+len(data))
+	b[0] = byte(t)
+	b[1] = 1
+	core.ByteOrder.PutUint16(b[2:], uint16(len(data)))
+	copy(b[4:], data)
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	if w.reading {
+		w.pending = append(w.pending, b)
+		return
+	}
+	_, e = w.f.c.Write(b)
+	return
+}
+func (w *websocketForward) readLoop() {
+	b := make([]byte, 1024*32)
+	for {
+		e := w.readMessage(b)
+		if e != nil {
+			if e == websocket.ErrReadLimit {
+				// 上游發送的消息太大，gorilla 已經向上游發送了 1009
+				w.violate(websocket.CloseMessageTooBig, ``)
+			} else if w.control && atomic.LoadInt32(&w.upstreamClosed) == 0 {
+				// 上游異常斷開
+				atomic.StoreInt32(&w.upstreamClosed, 1)
+				text := e.Error()
+				if len(text) > maxControlFramePayloadSize-2 {
+					text = text[:maxControlFramePayloadSize-2]
+				}
+				w.sendControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseAbnormalClosure, text),
+				)
+			}
+			break
+		}
+	}
+}
+
+// 從上游讀取一個數據幀並轉發給客戶端
+func (w *websocketForward) readMessage(b []byte) (e error) {
+	t, r, e := w.ws.NextReader()
+	if e != nil {
+		return
+	}
+	w.touch()
+	w.locker.Lock()
+	w.reading = true
+	w.locker.Unlock()
+	var (
+		n      int
+		end    bool
+		offset = 4
+	)
+	for !end {
+		n, e = r.Read(b[offset:])
+		if e == io.EOF {
+			end = true
+			e = nil
+		} else if e != nil {
+			if offset == 3 {
+				// 結束已經發送了一部分的數據幀
+				w.f.c.Write([]byte{1, 0, 0})
+			}
+			break
+		} else if n == 0 {
+			continue
+		}
+		if offset == 4 {
+			b[0] = byte(t)
+			b[1] = frameFlag(end)
+			core.ByteOrder.PutUint16(b[2:], uint16(n))
+		} else {
+			b[0] = frameFlag(end)
+			core.ByteOrder.PutUint16(b[1:], uint16(n))
+		}
+		_, e = w.f.c.Write(b[:offset+n])
+		if e != nil {
+			break
+		}
+		offset = 3
+	}
+	w.locker.Lock()
+	w.reading = false
+	// 即使上游出錯也要發送等待中的控制幀，其中可能包含了服務器主動發送的 close
+	for _, data := range w.pending {
+		_, err := w.f.c.Write(data)
+		if err != nil {
+			if e == nil {
+				e = err
+			}
+			break
+		}
+	}
+	w.pending = nil
+	w.locker.Unlock()
+	return
+}
+
+// 返回 FrameData 的 DataFlag
+func frameFlag(end bool) byte {
+	if end {
+		return 1
+	}
+	return 0
+}
+func (w *websocketForward) writeLoop() {
+	b := w.f.getBuffer(4)
+	for {
+		e := w.writeMessage(b)
+		if e != nil {
+			break
+		}
+	}
+}
+
+var errWebsocketClosed = errors.New(`websocket closed`)
+
+// 從客戶端讀取一個數據幀並轉發給上游
+//
+// 違反限制後不再轉發，只是讀取並丟棄客戶端的數據直到收到 close 回覆
+func (w *websocketForward) writeMessage(b []byte) (e error) {
+	c := w.f.c
+	_, e = io.ReadFull(c, b[:4])
+	if e != nil {
+		return
+	}
+	var (
+		t   = int(b[0])
+		end = b[1] == 1
+		l   = core.ByteOrder.Uint16(b[2:])
+	)
+	w.touch()
+	w.receive(1, 0)
+	switch t {
+	case websocket.CloseMessage, websocket.PingMessage, websocket.PongMessage:
+		r := &websocketReader{
+			c: c,
+			b: b[1:4],
+			r: io.LimitReader(c, int64(l)),
+		}
+		var data []byte
+		data, e = io.ReadAll(io.LimitReader(r, maxControlFramePayloadSize+1))
+		if e != nil {
+			return
+		} else if len(data) > maxControlFramePayloadSize {
+			e = errInvalidControlFrame
+			return
+		}
+		w.receive(0, len(data))
+		if atomic.LoadInt32(&w.violated) != 0 {
+			if t == websocket.CloseMessage {
+				// 客戶端回覆了服務器發送的 close
+				atomic.StoreInt32(&w.clientClosed, 1)
+				e = errWebsocketClosed
+			}
+			return
+		}
+		if t == websocket.CloseMessage {
+			atomic.StoreInt32(&w.clientClosed, 1)
+		}
+		e = w.ws.WriteControl(t, data, time.Now().Add(websocketCloseTimeout))
+		if e == nil && t == websocket.CloseMessage {
+			// 客戶端發送 close 後不會再有數據幀
+			e = errWebsocketClosed
+		}
+		return
+	}
+
+	var (
+		dst    websocketDiscardWriter
+		writer io.WriteCloser
+		size   int64
+	)
+	if atomic.LoadInt32(&w.violated) == 0 {
+		writer, e = w.ws.NextWriter(t)
+		if e != nil {
+			return
+		}
+		defer writer.Close()
+		dst.w = writer
+	}
+	for {
+		if l != 0 {
+			size += int64(l)
+			if w.limit > 0 && size > w.limit {
+				w.violate(websocket.CloseMessageTooBig, ``)
+			}
+			w.receive(0, int(l))
+			if atomic.LoadInt32(&w.violated) != 0 {
+				dst.w = nil
+			}
+			_, e = io.CopyN(&dst, c, int64(l))
+			if e != nil {
+				return
+			}
+		}
+		if end {
+			break
+		}
+		_, e = io.ReadFull(c, b[:3])
+		if e != nil {
+			return
+		}
+		end = b[0] == 1
+		l = core.ByteOrder.Uint16(b[1:])
+	}
+	if dst.err != nil {
+		if atomic.LoadInt32(&w.violated) == 0 {
+			e = dst.err
+		}
+	} else if dst.w != nil {
+		e = writer.Close()
+	}
+	return
+}
+
+// 統計客戶端發送的幀與字節，超過速率限制時關閉 websocket
+func (w *websocketForward) receive(frames, bytes int) {
+	if !w.rate.allow(frames, bytes) {
+		w.violate(websocket.ClosePolicyViolation, `rate limit exceeded`)
+	}
+}
+
+// 寫入失敗或 w 爲 nil 時丟棄數據，以保證能夠繼續從 channel 中讀取後續的幀
+type websocketDiscardWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *websocketDiscardWriter) Write(b []byte) (int, error) {
+	if d.w != nil && d.err == nil {
+		_, d.err = d.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// 固定窗口的速率限制，每秒重置一次計數
+type websocketRate struct {
+	frames  int
+	bytes   int
+	start   time.Time
+	nframes int
+	nbytes  int
+}
+
+func newWebsocketRate(frames, bytes int) *websocketRate {
+	if frames < 1 && bytes < 1 {
+		return nil
+	}
+	return &websocketRate{
+		frames: frames,
+		bytes:  bytes,
+	}
+}
+
+// 記錄收到的幀與字節，返回是否沒有超過限制
+func (r *websocketRate) allow(frames, bytes int) bool {
+	if r == nil {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(r.start) >= time.Second {
+		r.start = now
+		r.nframes = 0
+		r.nbytes = 0
+	}
+	r.nframes += frames
+	r.nbytes += bytes
+	return (r.frames < 1 || r.nframes <= r.frames) &&
+		(r.bytes < 1 || r.nbytes <= r.bytes)
+}
@@ -1,86 +1,358 @@
 package httpadapter
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"io"
 	"math"
 	"net"
+	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/powerpuffpenguin/httpadapter/core"
 )
 
 var errWriterClosed = errors.New(`writer closed`)
+var errInvalidControlFrame = errors.New(`invalid control frame`)
 
+// 控制幀 payload 的最大長度
+const maxControlFramePayloadSize = 125
+
+// 默認的控制幀寫入超時
+const websocketWriteWait = time.Second
+
+// *websocket.Conn 與 Websocket.Conn 共同實現的接口，可以用它編寫同時支持兩者的代碼
+type WebsocketConn interface {
+	Close() error
+	UnderlyingConn() net.Conn
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Subprotocol() string
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+
+	NextWriter(messageType int) (io.WriteCloser, error)
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	WriteMessage(messageType int, data []byte) error
+	WriteJSON(v interface{}) error
+
+	NextReader() (messageType int, r io.Reader, err error)
+	ReadMessage() (messageType int, p []byte, err error)
+	ReadJSON(v interface{}) error
+
+	SetPingHandler(h func(appData string) error)
+	PingHandler() func(appData string) error
+	SetPongHandler(h func(appData string) error)
+	PongHandler() func(appData string) error
+	SetCloseHandler(h func(code int, text string) error)
+	CloseHandler() func(code int, text string) error
+}
+
+var (
+	_ WebsocketConn = (*websocket.Conn)(nil)
+	_ WebsocketConn = gorillaWebsocket{}
+)
+
+// 通過 httpadapter 代理的 websocket 連接，除了寫入消息的方法會返回寫入的字節數外其接口與 *websocket.Conn 一致，
+// 需要替換 *websocket.Conn 的代碼可以使用 Conn 返回的 WebsocketConn
+//
+// 與 *websocket.Conn 一樣支持一個 goroutine 讀取的同時另一個 goroutine 寫入，
+// 控制幀相關的方法與 Close 可以在任意 goroutine 中調用
 type Websocket struct {
 	c net.Conn
+	// 上游握手響應的 header
+	header http.Header
+
+	// 寫入鎖，在 NextWriter 返回的 writer 關閉前一直被持有，保證控制幀不會插入到數據幀中間，
+	// 使用容量爲 1 的 chan 實現以便 WriteControl 可以在截止時間到達時放棄等待
+	writer        chan struct{}
+	closeSent     bool
+	deadline      sync.Mutex
+	writeDeadline time.Time
+
+	// 讀取鎖，保護下面的讀取狀態
+	read sync.Mutex
+	// 未讀完的數據幀，調用 NextReader 時會丟棄剩餘數據
+	reader    *websocketReader
+	readErr   error
+	readLimit int64
+
+	handler      sync.Mutex
+	pingHandler  func(appData string) error
+	pongHandler  func(appData string) error
+	closeHandler func(code int, text string) error
 }
 
+// 直接關閉 channel，不會進行關閉握手
+//
+// 如果要正常關閉需要先使用 WriteControl 發送 close 並等待讀取到 *websocket.CloseError
 func (w *Websocket) Close() error {
 	return w.c.Close()
 }
 
+// 返回底層的 channel
+func (w *Websocket) UnderlyingConn() net.Conn {
+	return w.c
+}
+
+// 返回本地地址
+func (w *Websocket) LocalAddr() net.Addr {
+	return w.c.LocalAddr()
+}
+
+// 返回遠端地址
+func (w *Websocket) RemoteAddr() net.Addr {
+	return w.c.RemoteAddr()
+}
+
+// 返回上游握手響應的 header，調用者不應該修改它
+func (w *Websocket) ResponseHeader() http.Header {
+	return w.header
+}
+
+// 返回上游協商的子協議
+func (w *Websocket) Subprotocol() string {
+	return w.header.Get(`Sec-Websocket-Protocol`)
+}
+
+// 設置讀取截止時間，超時後讀取會返回錯誤並且連接不再可用，零值表示沒有截止時間
+func (w *Websocket) SetReadDeadline(t time.Time) error {
+	return w.c.SetReadDeadline(t)
+}
+
+// 設置寫入截止時間，超時後寫入會返回錯誤並且連接不再可用，零值表示沒有截止時間
+func (w *Websocket) SetWriteDeadline(t time.Time) error {
+	w.deadline.Lock()
+	w.writeDeadline = t
+	w.deadline.Unlock()
+	return w.c.SetWriteDeadline(t)
+}
+
+// 設置讀取消息的最大長度，超過後會發送關閉碼 1009 的 close 並返回 websocket.ErrReadLimit，小於等於 0 表示不限制
+func (w *Websocket) SetReadLimit(limit int64) {
+	atomic.StoreInt64(&w.readLimit, limit)
+}
+
 // return writer not goroutine safe
+//
+// 在 writer 關閉前其它寫入(包括 WriteControl)會被阻塞
 func (w *Websocket) NextWriter(t int) (io.WriteCloser, error) {
 	switch t {
-	case websocket.TextMessage, websocket.BinaryMessage,
-		websocket.CloseMessage, websocket.PingMessage, websocket.PongMessage:
+	case websocket.TextMessage, websocket.BinaryMessage:
+	case websocket.CloseMessage, websocket.PingMessage, websocket.PongMessage:
+		return &websocketControlWriter{
+			ws: w,
+			t:  t,
+		}, nil
 	default:
 		return nil, errors.New(`unknow websocekt message type: ` + strconv.Itoa(t))
 	}
+	w.lockWriter()
+	if w.closeSent {
+		w.unlockWriter()
+		return nil, websocket.ErrCloseSent
+	}
 	return &websocketWriter{
-		t: byte(t),
-		b: make([]byte, 4),
-		w: w.c,
+		ws: w,
+		t:  byte(t),
+		b:  make([]byte, 4),
+		w:  w.c,
 	}, nil
 }
 
-// not goroutine safe
-func (w *Websocket) WriteMessage(t int, b []byte) (n int, e error) {
-	dst, e := w.NextWriter(t)
-	if e != nil {
-		return
+// 發送一個控制幀，t 可以是 websocket.CloseMessage websocket.PingMessage websocket.PongMessage
+//
+// 發送 close 後不能再寫入任何數據，收到對面的 close 回覆後 channel 會被自動關閉
+//
+// 如果 NextWriter 返回的 writer 沒有關閉，會等待到 deadline 後返回 context.DeadlineExceeded
+func (w *Websocket) WriteControl(t int, data []byte, deadline time.Time) (e error) {
+	switch t {
+	case websocket.CloseMessage, websocket.PingMessage, websocket.PongMessage:
+	default:
+		return errors.New(`not a websocekt control message type: ` + strconv.Itoa(t))
 	}
-	n, e = dst.Write(b)
+	if len(data) > maxControlFramePayloadSize {
+		return errInvalidControlFrame
+	}
+	e = w.lockWriterDeadline(deadline)
 	if e != nil {
 		return
 	}
-	e = dst.Close()
+	defer w.unlockWriter()
+	if w.closeSent {
+		return websocket.ErrCloseSent
+	}
+	if t == websocket.CloseMessage {
+		w.closeSent = true
+	}
+	if !deadline.IsZero() {
+		w.c.SetWriteDeadline(deadline)
+		defer func() {
+			// 恢復用戶設置的寫入截止時間
+			w.deadline.Lock()
+			w.c.SetWriteDeadline(w.writeDeadline)
+			w.deadline.Unlock()
+		}()
+	}
+	b := make([]byte, 4+len(data))
+	b[0] = byte(t)
+	b[1] = 1
+	core.ByteOrder.PutUint16(b[2:], uint16(len(data)))
+	copy(b[4:], data)
+	_, e = w.c.Write(b)
 	return
 }
 
-// not goroutine safe
-func (w *Websocket) WriteText(s string) (n int, e error) {
-	dst, e := w.NextWriter(websocket.TextMessage)
-	if e != nil {
-		return
+func (w *Websocket) lockWriter() {
+	w.writer <- struct{}{}
+}
+func (w *Websocket) unlockWriter() {
+	<-w.writer
+}
+
+// 在 deadline 之前獲取寫入鎖，超時返回 context.DeadlineExceeded，deadline 爲零值則一直等待
+func (w *Websocket) lockWriterDeadline(deadline time.Time) error {
+	if deadline.IsZero() {
+		w.lockWriter()
+		return nil
 	}
-	n, e = dst.Write(core.StringToBytes(s))
-	if e != nil {
-		return
+	select {
+	case w.writer <- struct{}{}:
+		return nil
+	default:
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return context.DeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case w.writer <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return context.DeadlineExceeded
 	}
-	e = dst.Close()
-	return
 }
 
-// not goroutine safe
-func (w *Websocket) Write(b []byte) (n int, e error) {
-	dst, e := w.NextWriter(websocket.BinaryMessage)
+// 設置收到 ping 時的回調，默認回覆一個 pong
+func (w *Websocket) SetPingHandler(h func(appData string) error) {
+	w.handler.Lock()
+	w.pingHandler = h
+	w.handler.Unlock()
+}
+
+// 返回收到 ping 時的回調
+func (w *Websocket) PingHandler() func(appData string) error {
+	w.handler.Lock()
+	h := w.pingHandler
+	w.handler.Unlock()
+	if h == nil {
+		h = w.defaultPingHandler
+	}
+	return h
+}
+func (w *Websocket) defaultPingHandler(appData string) error {
+	e := w.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(websocketWriteWait))
+	if e == websocket.ErrCloseSent {
+		e = nil
+	}
+	return e
+}
+
+// 設置收到 pong 時的回調，默認什麼都不做
+func (w *Websocket) SetPongHandler(h func(appData string) error) {
+	w.handler.Lock()
+	w.pongHandler = h
+	w.handler.Unlock()
+}
+
+// 返回收到 pong 時的回調
+func (w *Websocket) PongHandler() func(appData string) error {
+	w.handler.Lock()
+	h := w.pongHandler
+	w.handler.Unlock()
+	if h == nil {
+		h = func(string) error { return nil }
+	}
+	return h
+}
+
+// 設置收到 close 時的回調，默認回覆一個相同 code 的 close
+//
+// 回調返回後讀取會返回 *websocket.CloseError
+func (w *Websocket) SetCloseHandler(h func(code int, text string) error) {
+	w.handler.Lock()
+	w.closeHandler = h
+	w.handler.Unlock()
+}
+
+// 返回收到 close 時的回調
+func (w *Websocket) CloseHandler() func(code int, text string) error {
+	w.handler.Lock()
+	h := w.closeHandler
+	w.handler.Unlock()
+	if h == nil {
+		h = w.defaultCloseHandler
+	}
+	return h
+}
+func (w *Websocket) defaultCloseHandler(code int, text string) error {
+	e := w.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ``), time.Now().Add(websocketWriteWait))
+	if e == websocket.ErrCloseSent {
+		e = nil
+	}
+	return e
+}
+
+// 可以和讀取同時調用，多個寫入會被依次執行
+func (w *Websocket) WriteMessage(t int, b []byte) (n int, e error) {
+	dst, e := w.NextWriter(t)
 	if e != nil {
 		return
 	}
 	n, e = dst.Write(b)
 	if e != nil {
+		dst.Close()
 		return
 	}
 	e = dst.Close()
 	return
 }
 
-// not goroutine safe
+// 返回與 *websocket.Conn 簽名一致的 WebsocketConn，它與 w 共享同一個連接
+func (w *Websocket) Conn() WebsocketConn {
+	return gorillaWebsocket{w}
+}
+
+// 將 WriteMessage 包裝爲 *websocket.Conn 的簽名
+type gorillaWebsocket struct {
+	*Websocket
+}
+
+func (w gorillaWebsocket) WriteMessage(t int, b []byte) (e error) {
+	_, e = w.Websocket.WriteMessage(t, b)
+	return
+}
+
+// 可以和讀取同時調用，多個寫入會被依次執行
+func (w *Websocket) WriteText(s string) (n int, e error) {
+	return w.WriteMessage(websocket.TextMessage, core.StringToBytes(s))
+}
+
+// 可以和讀取同時調用，多個寫入會被依次執行
+func (w *Websocket) Write(b []byte) (n int, e error) {
+	return w.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// 可以和讀取同時調用，多個寫入會被依次執行
 func (w *Websocket) WriteJSON(obj any) (e error) {
 	b, e := json.Marshal(obj)
 	if e != nil {
@@ -90,26 +362,110 @@ func (w *Websocket) WriteJSON(obj any) (e error) {
 	return
 }
 
-// return reader not goroutine safe
+// return reader not goroutine safe，可以和寫入同時調用
+//
+// 控制幀會交給對應的回調處理而不會返回，收到 close 後返回 *websocket.CloseError
 func (w *Websocket) NextReader() (t int, r io.Reader, e error) {
-	b := make([]byte, 4)
-	_, e = io.ReadFull(w.c, b)
+	w.read.Lock()
+	t, r, e = w.nextReader()
+	w.read.Unlock()
+	return
+}
+func (w *Websocket) nextReader() (t int, r io.Reader, e error) {
+	if w.readErr != nil {
+		e = w.readErr
+		return
+	}
+	if w.reader != nil {
+		// 丟棄上一個沒有讀完的數據幀
+		_, e = io.Copy(io.Discard, w.reader)
+		w.reader = nil
+		if e != nil {
+			w.readErr = e
+			return
+		}
+	}
+	for {
+		b := make([]byte, 4)
+		_, e = io.ReadFull(w.c, b)
+		if e != nil {
+			w.readErr = e
+			return
+		}
+		t = int(b[0])
+		size := core.ByteOrder.Uint16(b[2:])
+		reader := &websocketReader{
+			ws: w,
+			c:  w.c,
+			b:  b[1:4],
+			r:  io.LimitReader(w.c, int64(size)),
+		}
+		switch t {
+		case websocket.CloseMessage, websocket.PingMessage, websocket.PongMessage:
+			e = w.handleControl(t, reader)
+			if e != nil {
+				w.readErr = e
+				return
+			}
+		default:
+			reader.limit = atomic.LoadInt64(&w.readLimit)
+			e = reader.grow(size)
+			if e != nil {
+				w.readErr = e
+				return
+			}
+			w.reader = reader
+			r = reader
+			return
+		}
+	}
+}
+
+// 處理收到的控制幀
+func (w *Websocket) handleControl(t int, r io.Reader) (e error) {
+	data, e := io.ReadAll(io.LimitReader(r, maxControlFramePayloadSize+1))
 	if e != nil {
 		return
+	} else if len(data) > maxControlFramePayloadSize {
+		e = errInvalidControlFrame
+		return
 	}
-	t = int(b[0])
-	size := core.ByteOrder.Uint16(b[2:])
-	r = &websocketReader{
-		c: w.c,
-		b: b[1:4],
-		r: io.LimitReader(w.c, int64(size)),
+	switch t {
+	case websocket.PingMessage:
+		e = w.PingHandler()(string(data))
+	case websocket.PongMessage:
+		e = w.PongHandler()(string(data))
+	default:
+		code := websocket.CloseNoStatusReceived
+		text := ``
+		if len(data) >= 2 {
+			code = int(binary.BigEndian.Uint16(data))
+			text = string(data[2:])
+		} else if len(data) != 0 {
+			e = errInvalidControlFrame
+			return
+		}
+		w.lockWriter()
+		initiated := w.closeSent
+		w.unlockWriter()
+
+		e = w.CloseHandler()(code, text)
+		if e == nil {
+			e = &websocket.CloseError{Code: code, Text: text}
+		}
+		if initiated {
+			// 收到了對面對 close 的回覆，關閉握手完成
+			w.c.Close()
+		}
 	}
 	return
 }
 
-// not goroutine safe
+// 可以和寫入同時調用，多個讀取會被依次執行
 func (w *Websocket) ReadMessage() (t int, b []byte, e error) {
-	t, r, e := w.NextReader()
+	w.read.Lock()
+	defer w.read.Unlock()
+	t, r, e := w.nextReader()
 	if e != nil {
 		return
 	}
@@ -117,18 +473,53 @@ func (w *Websocket) ReadMessage() (t int, b []byte, e error) {
 	return
 }
 
+// 讀取下一個消息並將其作爲 json 解碼到 v
+func (w *Websocket) ReadJSON(v any) (e error) {
+	w.read.Lock()
+	defer w.read.Unlock()
+	_, r, e := w.nextReader()
+	if e != nil {
+		return
+	}
+	e = json.NewDecoder(r).Decode(v)
+	if e == io.EOF {
+		// 空消息不是有效的 json
+		e = io.ErrUnexpectedEOF
+	}
+	return
+}
+
 type websocketReader struct {
+	ws  *Websocket
 	c   io.Reader
 	r   io.Reader
 	b   []byte
 	err error
+	// 消息長度限制與已經接收的長度
+	limit int64
+	n     int64
 	sync.Mutex
 }
 
+// 記錄收到的 FrameData 長度，超過限制時通知對面關閉
+func (r *websocketReader) grow(size uint16) (e error) {
+	r.n += int64(size)
+	if r.limit > 0 && r.n > r.limit {
+		e = websocket.ErrReadLimit
+		r.err = e
+		r.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ``),
+			time.Now().Add(websocketWriteWait),
+		)
+	}
+	return
+}
+
 func (r *websocketReader) Read(b []byte) (n int, e error) {
 	r.Lock()
 	defer r.Unlock()
 	if r.err != nil {
+		e = r.err
 		return
 	}
 	for r.r == nil {
@@ -139,6 +530,10 @@ func (r *websocketReader) Read(b []byte) (n int, e error) {
 		}
 		size := core.ByteOrder.Uint16(r.b[1:])
 		if size != 0 {
+			e = r.grow(size)
+			if e != nil {
+				return
+			}
 			r.r = io.LimitReader(r.c, int64(size))
 			break
 		}
@@ -162,9 +557,10 @@ func (r *websocketReader) Read(b []byte) (n int, e error) {
 }
 
 type websocketWriter struct {
-	t byte
-	b []byte
-	w io.Writer
+	ws *Websocket
+	t  byte
+	b  []byte
+	w  io.Writer
 	sync.Mutex
 	closed  bool
 	writerd bool
@@ -178,10 +574,15 @@ func (w *websocketWriter) Close() (e error) {
 		w.err = e
 	} else {
 		w.closed = true
-		data := w.b[:3]
-		data[0] = 1
-		core.ByteOrder.PutUint16(data[1:], 0)
-		w.w.Write(data)
+		if !w.writerd {
+			_, e = w.w.Write([]byte{w.t, 1, 0, 0})
+		} else {
+			data := w.b[:3]
+			data[0] = 1
+			core.ByteOrder.PutUint16(data[1:], 0)
+			_, e = w.w.Write(data)
+		}
+		w.ws.unlockWriter()
 	}
 	w.Unlock()
 	return
@@ -193,6 +594,9 @@ func (w *websocketWriter) Write(b []byte) (n int, e error) {
 	if w.err != nil {
 		e = w.err
 		return
+	} else if w.closed {
+		e = errWriterClosed
+		return
 	}
 
 	if !w.writerd {
@@ -236,3 +640,31 @@ func (w *websocketWriter) Write(b []byte) (n int, e error) {
 	}
 	return
 }
+
+// 將寫入的數據緩存起來，在 Close 時作爲控制幀發送
+type websocketControlWriter struct {
+	ws     *Websocket
+	t      int
+	data   []byte
+	closed bool
+}
+
+func (w *websocketControlWriter) Write(b []byte) (n int, e error) {
+	if w.closed {
+		e = errWriterClosed
+		return
+	} else if len(w.data)+len(b) > maxControlFramePayloadSize {
+		e = errInvalidControlFrame
+		return
+	}
+	w.data = append(w.data, b...)
+	n = len(b)
+	return
+}
+func (w *websocketControlWriter) Close() error {
+	if w.closed {
+		return errWriterClosed
+	}
+	w.closed = true
+	return w.ws.WriteControl(w.t, w.data, time.Now().Add(websocketWriteWait))
+}
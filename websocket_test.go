@@ -198,3 +198,564 @@ func testClientWebsocket(t *testing.T, opts ...httpadapter.ClientOption) {
 		t.FailNow()
 	}
 }
+func TestClientWebsocketDialer(t *testing.T) {
+	var upgrader = websocket.Upgrader{
+		Subprotocols: []string{`chat`},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/ws`, func(w http.ResponseWriter, r *http.Request) {
+		ws, e := upgrader.Upgrade(w, r, http.Header{
+			`Set-Cookie`: []string{`id=1`},
+		})
+		if e != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			t, p, e := ws.ReadMessage()
+			if e != nil {
+				break
+			}
+			e = ws.WriteMessage(t, p)
+			if e != nil {
+				break
+			}
+		}
+	})
+	var dials int64
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerWebsocketDialer(httpadapter.WebsocketDialerFunc(func(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error) {
+			atomic.AddInt64(&dials, 1)
+			return websocket.DefaultDialer.DialContext(ctx, urlStr, requestHeader)
+		})),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+	ws, resp, e := client.Websocket(context.Background(),
+		BaseWebsocket+`/ws`,
+		http.Header{
+			`Sec-Websocket-Protocol`: []string{`chat`},
+		},
+	)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer ws.Close()
+	if !assert.Equal(t, int64(1), atomic.LoadInt64(&dials)) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `chat`, resp.Header.Get(`Sec-Websocket-Protocol`)) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `id=1`, resp.Header.Get(`Set-Cookie`)) {
+		t.FailNow()
+	}
+	if !assert.Empty(t, resp.Header.Get(`Sec-Websocket-Accept`)) {
+		t.FailNow()
+	}
+
+	_, e = ws.WriteText(`ok`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, b, e := ws.ReadMessage()
+	if !assert.Nil(t, e) || !assert.Equal(t, `ok`, string(b)) {
+		t.FailNow()
+	}
+}
+func TestClientWebsocketControl(t *testing.T) {
+	var upgrader = websocket.Upgrader{}
+	pong := make(chan string, 1)
+	closed := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/ws`, func(w http.ResponseWriter, r *http.Request) {
+		ws, e := upgrader.Upgrade(w, r, nil)
+		if e != nil {
+			return
+		}
+		defer ws.Close()
+		ws.SetPongHandler(func(appData string) error {
+			pong <- appData
+			return nil
+		})
+		for {
+			t, p, e := ws.ReadMessage()
+			if e != nil {
+				closed <- e
+				break
+			}
+			switch string(p) {
+			case `ping-me`:
+				e = ws.WriteControl(websocket.PingMessage, []byte(`p1`), time.Now().Add(time.Second))
+			case `close-me`:
+				e = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4000, `bye`), time.Now().Add(time.Second))
+			default:
+				e = ws.WriteMessage(t, p)
+			}
+			if e != nil {
+				break
+			}
+		}
+	})
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+
+	// 上游發起關閉
+	ws, _, e := client.Websocket(context.Background(), BaseWebsocket+`/ws`, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	ping := make(chan string, 1)
+	clientPong := make(chan string, 1)
+	defaultPing := ws.PingHandler()
+	ws.SetPingHandler(func(appData string) error {
+		ping <- appData
+		return defaultPing(appData)
+	})
+	ws.SetPongHandler(func(appData string) error {
+		clientPong <- appData
+		return nil
+	})
+	_, e = ws.WriteText(`ping-me`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	e = ws.WriteControl(websocket.PingMessage, []byte(`c1`), time.Now().Add(time.Second))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = ws.WriteText(`echo`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, b, e := ws.ReadMessage()
+	if !assert.Nil(t, e) || !assert.Equal(t, `echo`, string(b)) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `p1`, <-ping) || !assert.Equal(t, `p1`, <-pong) || !assert.Equal(t, `c1`, <-clientPong) {
+		t.FailNow()
+	}
+	_, e = ws.WriteText(`close-me`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, _, e = ws.ReadMessage()
+	if !assert.True(t, websocket.IsCloseError(e, 4000), e) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `bye`, e.(*websocket.CloseError).Text) {
+		t.FailNow()
+	}
+	if !assert.True(t, websocket.IsCloseError(<-closed, 4000)) {
+		t.FailNow()
+	}
+	_, e = ws.WriteText(`echo`)
+	if !assert.ErrorIs(t, e, websocket.ErrCloseSent) {
+		t.FailNow()
+	}
+	ws.Close()
+
+	// 客戶端發起關閉
+	ws, _, e = client.Websocket(context.Background(), BaseWebsocket+`/ws`, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer ws.Close()
+	e = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, `done`), time.Now().Add(time.Second))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	e = <-closed
+	if !assert.True(t, websocket.IsCloseError(e, websocket.CloseNormalClosure)) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `done`, e.(*websocket.CloseError).Text) {
+		t.FailNow()
+	}
+	_, _, e = ws.ReadMessage()
+	if !assert.True(t, websocket.IsCloseError(e, websocket.CloseNormalClosure), e) {
+		t.FailNow()
+	}
+}
+func TestClientWebsocketControlDeadline(t *testing.T) {
+	var upgrader = websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/ws`, func(w http.ResponseWriter, r *http.Request) {
+		ws, e := upgrader.Upgrade(w, r, nil)
+		if e != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			t, p, e := ws.ReadMessage()
+			if e != nil {
+				break
+			}
+			e = ws.WriteMessage(t, p)
+			if e != nil {
+				break
+			}
+		}
+	})
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+	ws, _, e := client.Websocket(context.Background(), BaseWebsocket+`/ws`, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer ws.Close()
+	pong := make(chan string, 1)
+	ws.SetPongHandler(func(appData string) error {
+		pong <- appData
+		return nil
+	})
+
+	// writer 沒有關閉時 WriteControl 在截止時間後放棄等待
+	w, e := ws.NextWriter(websocket.TextMessage)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = w.Write([]byte(`part1 `))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	at := time.Now()
+	e = ws.WriteControl(websocket.PingMessage, []byte(`c1`), time.Now().Add(time.Millisecond*100))
+	if !assert.ErrorIs(t, e, context.DeadlineExceeded) {
+		t.FailNow()
+	}
+	if !assert.Less(t, time.Since(at), time.Second) {
+		t.FailNow()
+	}
+	e = ws.WriteControl(websocket.PingMessage, []byte(`c1`), time.Now().Add(-time.Second))
+	if !assert.ErrorIs(t, e, context.DeadlineExceeded) {
+		t.FailNow()
+	}
+
+	// 超時的控制幀沒有寫入任何數據，數據幀保持完整
+	_, e = w.Write([]byte(`part2`))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	e = w.Close()
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, b, e := ws.ReadMessage()
+	if !assert.Nil(t, e) || !assert.Equal(t, `part1 part2`, string(b)) {
+		t.FailNow()
+	}
+
+	// writer 關閉後可以正常發送
+	e = ws.WriteControl(websocket.PingMessage, []byte(`c2`), time.Now().Add(time.Second))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, e = ws.WriteText(`echo`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, b, e = ws.ReadMessage()
+	if !assert.Nil(t, e) || !assert.Equal(t, `echo`, string(b)) {
+		t.FailNow()
+	}
+	if !assert.Equal(t, `c2`, <-pong) {
+		t.FailNow()
+	}
+}
+func TestClientWebsocketAPI(t *testing.T) {
+	var upgrader = websocket.Upgrader{
+		Subprotocols: []string{`chat`},
+	}
+	closed := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/ws`, func(w http.ResponseWriter, r *http.Request) {
+		ws, e := upgrader.Upgrade(w, r, http.Header{
+			`Set-Cookie`: []string{`id=1`},
+		})
+		if e != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			t, p, e := ws.ReadMessage()
+			if e != nil {
+				if websocket.IsCloseError(e, websocket.CloseMessageTooBig) {
+					closed <- e
+				}
+				break
+			}
+			if string(p) == `silent` {
+				continue
+			}
+			e = ws.WriteMessage(t, p)
+			if e != nil {
+				break
+			}
+		}
+	})
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+	ws, _, e := client.Websocket(context.Background(),
+		BaseWebsocket+`/ws`,
+		http.Header{
+			`Sec-Websocket-Protocol`: []string{`chat`},
+		},
+	)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer ws.Close()
+	if !assert.Equal(t, `chat`, ws.Subprotocol()) ||
+		!assert.Equal(t, `id=1`, ws.ResponseHeader().Get(`Set-Cookie`)) ||
+		!assert.NotNil(t, ws.UnderlyingConn()) {
+		t.FailNow()
+	}
+
+	// 多個 goroutine 同時寫入，一個 goroutine 讀取
+	type message struct {
+		ID  int `json:"id"`
+		Seq int `json:"seq"`
+	}
+	const (
+		writers = 4
+		count   = 50
+	)
+	for i := 0; i < writers; i++ {
+		go func(id int) {
+			for seq := 0; seq < count; seq++ {
+				if ws.WriteJSON(message{ID: id, Seq: seq}) != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	next := make([]int, writers)
+	for i := 0; i < writers*count; i++ {
+		var m message
+		e = ws.ReadJSON(&m)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, next[m.ID], m.Seq) {
+			t.FailNow()
+		}
+		next[m.ID]++
+	}
+
+	// 讀取超時
+	_, e = ws.WriteText(`silent`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	e = ws.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, _, e = ws.ReadMessage()
+	if !assert.ErrorIs(t, e, context.DeadlineExceeded) {
+		t.FailNow()
+	}
+	ws.Close()
+
+	// 消息長度限制
+	ws, _, e = client.Websocket(context.Background(), BaseWebsocket+`/ws`, nil)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	defer ws.Close()
+	ws.SetReadLimit(8)
+	_, e = ws.WriteText(`12345678`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, b, e := ws.ReadMessage()
+	if !assert.Nil(t, e) || !assert.Equal(t, `12345678`, string(b)) {
+		t.FailNow()
+	}
+	_, e = ws.WriteText(`123456789`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, _, e = ws.ReadMessage()
+	if !assert.ErrorIs(t, e, websocket.ErrReadLimit) {
+		t.FailNow()
+	}
+	if !assert.True(t, websocket.IsCloseError(<-closed, websocket.CloseMessageTooBig)) {
+		t.FailNow()
+	}
+}
+func TestClientWebsocketLimit(t *testing.T) {
+	var upgrader = websocket.Upgrader{}
+	closed := make(chan int, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/ws`, func(w http.ResponseWriter, r *http.Request) {
+		ws, e := upgrader.Upgrade(w, r, nil)
+		if e != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			t, p, e := ws.ReadMessage()
+			if e != nil {
+				code := 0
+				if ce, ok := e.(*websocket.CloseError); ok {
+					code = ce.Code
+				}
+				closed <- code
+				break
+			}
+			if string(p) == `big` {
+				p = bytes.Repeat([]byte{'b'}, 32)
+			}
+			// 服務器關閉時可能寫入失敗，繼續讀取以便收到 close
+			ws.WriteMessage(t, p)
+		}
+	})
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+		httpadapter.ServerWebsocketMessageLimit(16),
+		httpadapter.ServerWebsocketRateLimit(10, 0),
+		httpadapter.ServerWebsocketIdleTimeout(time.Millisecond*200),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+	dial := func() *httpadapter.Websocket {
+		ws, _, e := client.Websocket(context.Background(), BaseWebsocket+`/ws`, nil)
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		return ws
+	}
+	expectClose := func(ws *httpadapter.Websocket, code int, text string) {
+		var e error
+		for e == nil {
+			_, _, e = ws.ReadMessage()
+		}
+		if !assert.True(t, websocket.IsCloseError(e, code), e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, text, e.(*websocket.CloseError).Text) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, code, <-closed) {
+			t.FailNow()
+		}
+		ws.Close()
+	}
+
+	// 客戶端發送的消息太大
+	ws := dial()
+	_, e := ws.WriteText(`ok`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	_, b, e := ws.ReadMessage()
+	if !assert.Nil(t, e) || !assert.Equal(t, `ok`, string(b)) {
+		t.FailNow()
+	}
+	_, e = ws.Write(bytes.Repeat([]byte{'a'}, 32))
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	expectClose(ws, websocket.CloseMessageTooBig, ``)
+
+	// 上游發送的消息太大
+	ws = dial()
+	_, e = ws.WriteText(`big`)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	expectClose(ws, websocket.CloseMessageTooBig, ``)
+
+	// 客戶端發送太快
+	ws = dial()
+	for i := 0; i < 20; i++ {
+		if _, e = ws.WriteText(`ok`); e != nil {
+			break
+		}
+	}
+	expectClose(ws, websocket.ClosePolicyViolation, `rate limit exceeded`)
+
+	// 空閒超時
+	ws = dial()
+	expectClose(ws, websocket.ClosePolicyViolation, `idle timeout`)
+}
+func TestClientWebsocketConn(t *testing.T) {
+	var upgrader = websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/ws`, func(w http.ResponseWriter, r *http.Request) {
+		ws, e := upgrader.Upgrade(w, r, nil)
+		if e != nil {
+			return
+		}
+		defer ws.Close()
+		// 服務器端的 *websocket.Conn 與客戶端使用相同的代碼
+		echoWebsocketConn(ws)
+	})
+	s := newServer(t,
+		httpadapter.ServerHTTP(mux),
+	)
+	defer s.CloseAndWait()
+
+	client := httpadapter.NewClient(Addr)
+	defer client.Close()
+	ws, _, e := client.Websocket(context.Background(),
+		BaseWebsocket+`/ws`,
+		nil,
+	)
+	if !assert.Nil(t, e) {
+		t.FailNow()
+	}
+	var conn httpadapter.WebsocketConn = ws.Conn()
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		str := fmt.Sprintf("conn-%v", i)
+		e = conn.WriteMessage(websocket.TextMessage, []byte(str))
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		ty, b, e := conn.ReadMessage()
+		if !assert.Nil(t, e) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, websocket.TextMessage, ty) {
+			t.FailNow()
+		}
+		if !assert.Equal(t, str, string(b)) {
+			t.FailNow()
+		}
+	}
+}
+func echoWebsocketConn(ws httpadapter.WebsocketConn) {
+	for {
+		t, p, e := ws.ReadMessage()
+		if e != nil {
+			break
+		}
+		e = ws.WriteMessage(t, p)
+		if e != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package httpadapter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errWebsocketTextMessage = errors.New(`httpadapter: tcp-chain over websocket only accepts binary messages`)
+
+// 將 websocket 適配爲 net.Conn 以便在其上運行 tcp-chain，每次 Write 發送一個二進制消息，Read 將消息作爲連續的數據流讀取
+type websocketConn struct {
+	ws *websocket.Conn
+	r  io.Reader
+
+	locker sync.Mutex
+}
+
+func newWebsocketConn(ws *websocket.Conn) *websocketConn {
+	return &websocketConn{
+		ws: ws,
+	}
+}
+func (c *websocketConn) Read(b []byte) (n int, e error) {
+	for {
+		if c.r == nil {
+			var t int
+			t, c.r, e = c.ws.NextReader()
+			if e != nil {
+				if websocket.IsCloseError(e, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					e = io.EOF
+				}
+				return
+			} else if t != websocket.BinaryMessage {
+				e = errWebsocketTextMessage
+				return
+			}
+		}
+		n, e = c.r.Read(b)
+		if e == io.EOF {
+			c.r = nil
+			e = nil
+			if n == 0 {
+				continue
+			}
+		}
+		return
+	}
+}
+func (c *websocketConn) Write(b []byte) (n int, e error) {
+	c.locker.Lock()
+	e = c.ws.WriteMessage(websocket.BinaryMessage, b)
+	c.locker.Unlock()
+	if e == nil {
+		n = len(b)
+	}
+	return
+}
+
+// 盡量通知對端正常關閉後關閉底層連接
+func (c *websocketConn) Close() error {
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ``),
+		time.Now().Add(time.Second),
+	)
+	return c.ws.Close()
+}
+func (c *websocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+func (c *websocketConn) SetDeadline(t time.Time) (e error) {
+	e = c.ws.SetReadDeadline(t)
+	if e != nil {
+		return
+	}
+	e = c.ws.SetWriteDeadline(t)
+	return
+}
+func (c *websocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+func (c *websocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// 將 websocket 連接作爲 tcp-chain 處理的 http.Handler，
+// 可以掛載到 ServerHTTP 或者任意 net/http 兼容的服務器上，以便瀏覽器或只能訪問 http 的客戶端使用
+type WebsocketHandler struct {
+	// 運行 tcp-chain 的服務器，使用它的所有設定
+	Server *Server
+	// 如果爲 nil 則使用默認設定，這會拒絕跨域的請求
+	Upgrader *websocket.Upgrader
+}
+
+func (h WebsocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := h.Upgrader
+	if upgrader == nil {
+		upgrader = &websocket.Upgrader{}
+	}
+	ws, e := upgrader.Upgrade(w, r, nil)
+	if e != nil {
+		return
+	}
+	h.Server.serveChain(newWebsocketConn(ws))
+}
+
+// 通過 websocket 連接服務器的 ClientDialer，NewClient 的地址需要是 WebsocketHandler 的 ws:// 或 wss:// url
+type WebsocketClientDialer struct {
+	// 如果爲 nil 則使用 websocket.DefaultDialer
+	Dialer *websocket.Dialer
+	// 握手時發送的 http 頭
+	Header http.Header
+}
+
+func (d WebsocketClientDialer) Dial(network, address string) (c net.Conn, e error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	ws, resp, e := dialer.Dial(address, d.Header)
+	if e != nil {
+		return
+	}
+	resp.Body.Close()
+	c = newWebsocketConn(ws)
+	return
+}